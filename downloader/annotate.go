@@ -0,0 +1,451 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// AnnotationConfig burns GeoJSON features, such as repeaters, meeting points
+// or evacuation routes, into the downloaded tiles
+type AnnotationConfig struct {
+	Files        []string        `yaml:"files"`
+	KeepOriginal bool            `yaml:"keep_original"`
+	Style        AnnotationStyle `yaml:"style"`
+}
+
+// AnnotationStyle is the default look of annotations. The simplestyle
+// properties of each GeoJSON feature override it.
+type AnnotationStyle struct {
+	Color  string  `yaml:"color"`  // line and marker colour (default: #d00000)
+	Width  float64 `yaml:"width"`  // line width in pixels (default: 3)
+	Fill   string  `yaml:"fill"`   // polygon fill colour (default: line colour at 25% opacity)
+	Marker string  `yaml:"marker"` // circle (default), square, triangle or none
+	Size   float64 `yaml:"size"`   // marker size in pixels (default: 10)
+	Label  string  `yaml:"label"`  // feature property shown as label (default: name)
+}
+
+// featureStyle is the resolved look of a single feature
+type featureStyle struct {
+	stroke     color.NRGBA
+	fill       color.NRGBA
+	marker     color.NRGBA
+	width      float64
+	markerType string
+	markerSize float64
+	label      string
+}
+
+// LoadAnnotations reads the configured GeoJSON annotation files
+func (m *MeshtasticTileDownloader) LoadAnnotations() error {
+	m.annotations = nil
+	for _, file := range m.config.Map.Annotations.Files {
+		features, err := LoadGeoJSON(file)
+		if err != nil {
+			return err
+		}
+		m.annotations = append(m.annotations, features...)
+		slog.Info("Loaded annotations", "annotations", len(features), "file", file)
+	}
+	return nil
+}
+
+// AnnotateTiles draws the annotations onto every stored tile of the list they
+// touch. It returns how many tiles could not be annotated.
+func (m *MeshtasticTileDownloader) AnnotateTiles(ctx context.Context, tiles []TileCoord) (int, error) {
+	if len(m.annotations) == 0 {
+		return 0, nil
+	}
+
+	metadata, err := m.LoadTileMetadata()
+	if err != nil {
+		return 0, err
+	}
+
+	annotated, failed := 0, 0
+	for _, tile := range tiles {
+		if err := ctx.Err(); err != nil {
+			return failed, err
+		}
+		features := m.featuresInTile(tile)
+		if len(features) == 0 {
+			continue
+		}
+		done, err := m.AnnotateTile(ctx, tile, features, metadata[m.TileKey(tile.Zoom, tile.X, tile.Y)])
+		if err != nil {
+			slog.Error("Error annotating tile", "tile", tile.String(), "error", err)
+			m.reportTile(TileEvent{Zone: m.zone, Step: StepAnnotate, Tile: tile, Err: err}, false)
+			failed++
+			continue
+		}
+		if done {
+			annotated++
+		}
+	}
+
+	slog.Info("Annotated tiles", "tiles", annotated, "failed", failed)
+	return failed, nil
+}
+
+// featuresInTile returns the annotations drawn, even partially, on a tile
+func (m *MeshtasticTileDownloader) featuresInTile(tile TileCoord) []Feature {
+	project := m.tileProjection(tile, tileSize)
+
+	var features []Feature
+	for _, feature := range m.annotations {
+		minLat, minLon, maxLat, maxLon, ok := feature.Bounds()
+		if !ok {
+			continue
+		}
+
+		style := m.resolveStyle(feature)
+		margin := math.Max(style.width, style.markerSize)
+		if style.label != "" && len(feature.Points) > 0 {
+			margin += float64(len(style.label)*7) + style.markerSize
+		}
+
+		left, top := project(minLon, maxLat)
+		right, bottom := project(maxLon, minLat)
+		if right+margin >= 0 && left-margin <= tileSize && bottom+margin >= 0 && top-margin <= tileSize {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// tileProjection returns a function converting coordinates to pixels within a
+// tile of the given size, built from the tile corners
+func (m *MeshtasticTileDownloader) tileProjection(tile TileCoord, size int) func(lon, lat float64) (float64, float64) {
+	west := TileXToLong(tile.X, tile.Zoom)
+	east := TileXToLong(tile.X+1, tile.Zoom)
+	north := LatToMercatorY(TileYToLat(tile.Y, tile.Zoom))
+	south := LatToMercatorY(TileYToLat(tile.Y+1, tile.Zoom))
+
+	return func(lon, lat float64) (float64, float64) {
+		x := (lon - west) / (east - west) * float64(size)
+		y := (north - LatToMercatorY(lat)) / (north - south) * float64(size)
+		return x, y
+	}
+}
+
+// AnnotateTile draws features onto a stored tile. Tiles already annotated are
+// skipped, unless their original was kept, in which case they are redrawn from it.
+func (m *MeshtasticTileDownloader) AnnotateTile(ctx context.Context, tile TileCoord, features []Feature, info TileInfo) (bool, error) {
+	tilePath := m.TilePath(tile.Zoom, tile.X, tile.Y)
+	if _, err := os.Stat(tilePath); err != nil {
+		return false, nil
+	}
+
+	sourcePath := tilePath
+	if m.config.Map.Annotations.KeepOriginal {
+		originalPath := filepath.Join(m.outputDirectory, "originals", filepath.FromSlash(m.TileKey(tile.Zoom, tile.X, tile.Y)))
+		if _, err := os.Stat(originalPath); err != nil {
+			if info.Annotated {
+				slog.Debug("Tile is annotated and has no original. Skipping", "path", tilePath)
+				return false, nil
+			}
+			if err := copyFile(ctx, tilePath, originalPath); err != nil {
+				return false, fmt.Errorf("failed to keep original: %w", err)
+			}
+		}
+		sourcePath = originalPath
+	} else if info.Annotated {
+		return false, nil
+	}
+
+	imgData, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read tile: %w", err)
+	}
+	img, err := m.LoadImageBytes(imgData)
+	if err != nil {
+		return false, err
+	}
+
+	bounds := img.Bounds()
+	canvas := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(canvas, canvas.Bounds(), img, bounds.Min, draw.Src)
+
+	project := m.tileProjection(tile, bounds.Dx())
+	scale := float64(bounds.Dx()) / tileSize
+	for _, feature := range features {
+		drawFeature(canvas, feature, m.resolveStyle(feature), project, scale)
+	}
+
+	if err := m.SaveDerivedImage(canvas, tilePath); err != nil {
+		return false, err
+	}
+	m.RecordTile(tile.Zoom, tile.X, tile.Y, TileInfo{Annotated: true})
+	return true, nil
+}
+
+// copyFile copies a file, creating the destination directory. A partial copy
+// is removed, so it is never mistaken for the original.
+func copyFile(ctx context.Context, source, destination string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return err
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		os.Remove(destination)
+	}
+	return err
+}
+
+// resolveStyle combines the configured style with the feature properties
+func (m *MeshtasticTileDownloader) resolveStyle(feature Feature) featureStyle {
+	defaults := m.config.Map.Annotations.Style
+	property := func(names ...string) string {
+		for _, name := range names {
+			if value, ok := feature.Properties[name]; ok && value != nil {
+				return fmt.Sprint(value)
+			}
+		}
+		return ""
+	}
+
+	style := featureStyle{
+		stroke:     parseColor(defaults.Color, color.NRGBA{R: 0xd0, A: 0xff}),
+		width:      defaults.Width,
+		markerType: defaults.Marker,
+		markerSize: defaults.Size,
+	}
+	style.stroke = parseColor(property("stroke", "color"), style.stroke)
+	if opacity, err := strconv.ParseFloat(property("stroke-opacity"), 64); err == nil {
+		style.stroke.A = uint8(math.Round(math.Max(0, math.Min(1, opacity)) * 255))
+	}
+
+	defaultFill := style.stroke
+	defaultFill.A = defaultFill.A / 4
+	style.fill = parseColor(property("fill"), parseColor(defaults.Fill, defaultFill))
+	if opacity, err := strconv.ParseFloat(property("fill-opacity"), 64); err == nil {
+		style.fill.A = uint8(math.Round(math.Max(0, math.Min(1, opacity)) * 255))
+	}
+	style.marker = parseColor(property("marker-color"), style.stroke)
+
+	if width, err := strconv.ParseFloat(property("stroke-width", "width"), 64); err == nil {
+		style.width = width
+	}
+	if style.width <= 0 {
+		style.width = 3
+	}
+
+	if marker := property("marker-symbol", "marker"); marker != "" {
+		style.markerType = marker
+	}
+	if style.markerType == "" {
+		style.markerType = "circle"
+	}
+
+	switch size := property("marker-size"); size {
+	case "small":
+		style.markerSize = 7
+	case "medium":
+		style.markerSize = 10
+	case "large":
+		style.markerSize = 14
+	default:
+		if value, err := strconv.ParseFloat(size, 64); err == nil {
+			style.markerSize = value
+		}
+	}
+	if style.markerSize <= 0 {
+		style.markerSize = 10
+	}
+
+	labelProperty := defaults.Label
+	if labelProperty == "" {
+		labelProperty = "name"
+	}
+	style.label = property("label", labelProperty, "title")
+	return style
+}
+
+// parseColor parses #rgb, #rrggbb and #rrggbbaa colours and a few names
+func parseColor(value string, fallback color.NRGBA) color.NRGBA {
+	named := map[string]string{
+		"black": "#000000", "white": "#ffffff", "red": "#d00000", "green": "#008000",
+		"blue": "#0050d0", "yellow": "#ffd000", "orange": "#ff8000", "purple": "#8000a0",
+	}
+	value = strings.ToLower(strings.TrimSpace(value))
+	if hex, ok := named[value]; ok {
+		value = hex
+	}
+	if !strings.HasPrefix(value, "#") {
+		return fallback
+	}
+
+	hex := value[1:]
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	parsed, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return fallback
+	}
+	return color.NRGBA{R: uint8(parsed >> 24), G: uint8(parsed >> 16), B: uint8(parsed >> 8), A: uint8(parsed)}
+}
+
+// drawFeature rasterizes the polygons, lines, markers and label of a feature
+func drawFeature(canvas *image.RGBA, feature Feature, style featureStyle, project func(lon, lat float64) (float64, float64), scale float64) {
+	size := canvas.Bounds().Size()
+	width := style.width * scale
+
+	for _, polygon := range feature.Polygons {
+		fill := vector.NewRasterizer(size.X, size.Y)
+		for _, ring := range polygon {
+			for i, position := range ring {
+				x, y := project(position[0], position[1])
+				if i == 0 {
+					fill.MoveTo(float32(x), float32(y))
+				} else {
+					fill.LineTo(float32(x), float32(y))
+				}
+			}
+			fill.ClosePath()
+		}
+		fill.Draw(canvas, canvas.Bounds(), image.NewUniform(style.fill), image.Point{})
+
+		for _, ring := range polygon {
+			strokeLine(canvas, ring, width, style.stroke, project)
+		}
+	}
+
+	for _, line := range feature.Lines {
+		strokeLine(canvas, line, width, style.stroke, project)
+	}
+
+	markerSize := style.markerSize * scale
+	for _, point := range feature.Points {
+		x, y := project(point[0], point[1])
+		if style.markerType != "none" {
+			drawMarker(canvas, style.markerType, x, y, markerSize+2*scale, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+			drawMarker(canvas, style.markerType, x, y, markerSize, style.marker)
+		}
+		if style.label != "" {
+			drawLabel(canvas, style.label, int(math.Round(x+markerSize/2+3)), int(math.Round(y+4)))
+		}
+	}
+}
+
+// strokeLine draws a polyline with round joins
+func strokeLine(canvas *image.RGBA, line [][2]float64, width float64, c color.NRGBA, project func(lon, lat float64) (float64, float64)) {
+	size := canvas.Bounds().Size()
+	stroke := vector.NewRasterizer(size.X, size.Y)
+	half := width / 2
+
+	var previousX, previousY float64
+	for i, position := range line {
+		x, y := project(position[0], position[1])
+		addCircle(stroke, x, y, half)
+		if i > 0 {
+			length := math.Hypot(x-previousX, y-previousY)
+			if length > 0 {
+				// Normal of the segment, scaled to half the line width
+				nx, ny := -(y-previousY)/length*half, (x-previousX)/length*half
+				stroke.MoveTo(float32(previousX+nx), float32(previousY+ny))
+				stroke.LineTo(float32(x+nx), float32(y+ny))
+				stroke.LineTo(float32(x-nx), float32(y-ny))
+				stroke.LineTo(float32(previousX-nx), float32(previousY-ny))
+				stroke.ClosePath()
+			}
+		}
+		previousX, previousY = x, y
+	}
+	stroke.Draw(canvas, canvas.Bounds(), image.NewUniform(c), image.Point{})
+}
+
+// addCircle adds a circle approximated by a polygon to a rasterizer path. It
+// winds the same way as the line segments of strokeLine, so overlapping
+// shapes add up instead of cancelling each other.
+func addCircle(z *vector.Rasterizer, x, y, radius float64) {
+	const segments = 24
+	for i := 0; i <= segments; i++ {
+		angle := -2 * math.Pi * float64(i) / segments
+		px, py := float32(x+radius*math.Cos(angle)), float32(y+radius*math.Sin(angle))
+		if i == 0 {
+			z.MoveTo(px, py)
+		} else {
+			z.LineTo(px, py)
+		}
+	}
+	z.ClosePath()
+}
+
+// drawMarker draws a point marker centred on x, y
+func drawMarker(canvas *image.RGBA, marker string, x, y, size float64, c color.NRGBA) {
+	bounds := canvas.Bounds().Size()
+	z := vector.NewRasterizer(bounds.X, bounds.Y)
+	half := size / 2
+
+	switch marker {
+	case "square":
+		z.MoveTo(float32(x-half), float32(y-half))
+		z.LineTo(float32(x+half), float32(y-half))
+		z.LineTo(float32(x+half), float32(y+half))
+		z.LineTo(float32(x-half), float32(y+half))
+		z.ClosePath()
+	case "triangle":
+		z.MoveTo(float32(x), float32(y-half))
+		z.LineTo(float32(x+half), float32(y+half))
+		z.LineTo(float32(x-half), float32(y+half))
+		z.ClosePath()
+	default:
+		addCircle(z, x, y, half)
+	}
+	z.Draw(canvas, canvas.Bounds(), image.NewUniform(c), image.Point{})
+}
+
+// drawLabel writes a label with a white halo, so it stays readable on any map
+func drawLabel(canvas *image.RGBA, label string, x, y int) {
+	drawer := font.Drawer{Dst: canvas, Face: basicfont.Face7x13}
+
+	drawer.Src = image.White
+	for dx := -1; dx <= 1; dx++ {
+		for dy := -1; dy <= 1; dy++ {
+			drawer.Dot = fixed.P(x+dx, y+dy)
+			drawer.DrawString(label)
+		}
+	}
+
+	drawer.Src = image.Black
+	drawer.Dot = fixed.P(x, y)
+	drawer.DrawString(label)
+}
@@ -0,0 +1,102 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAnnotateTiles(t *testing.T) {
+	dir := t.TempDir()
+	tile := TileCoord{Zoom: 10, X: 487, Y: 379}
+
+	// A blue point at the centre of the tile and a green line across its upper quarter
+	centerLon, centerLat := TileXToLong(2*tile.X+1, tile.Zoom+1), TileYToLat(2*tile.Y+1, tile.Zoom+1)
+	lineLat := TileYToLat(4*tile.Y+1, tile.Zoom+2)
+	west, east := TileXToLong(tile.X-1, tile.Zoom), TileXToLong(tile.X+2, tile.Zoom)
+	geojson := fmt.Sprintf(`{"type":"FeatureCollection","features":[
+		{"type":"Feature","geometry":{"type":"Point","coordinates":[%f,%f]},"properties":{"marker-color":"#0000ff"}},
+		{"type":"Feature","geometry":{"type":"LineString","coordinates":[[%f,%f],[%f,%f]]},"properties":{"stroke":"#00ff00"}}
+	]}`, centerLon, centerLat, west, lineLat, east, lineLat)
+	annotations := filepath.Join(dir, "annotations.geojson")
+	if err := os.WriteFile(annotations, []byte(geojson), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMeshtasticTileDownloader(Options{OutputDirectory: filepath.Join(dir, "maps")})
+	m.SetConfig(Config{Map: MapConfig{
+		Provider:    "openstreetmap",
+		Annotations: AnnotationConfig{Files: []string{annotations}, KeepOriginal: true},
+	}})
+	if err := m.LoadAnnotations(); err != nil {
+		t.Fatal(err)
+	}
+
+	original := encodeTestTile(t, color.White, true)
+	tilePath := m.TilePath(tile.Zoom, tile.X, tile.Y)
+	if err := os.MkdirAll(filepath.Dir(tilePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tilePath, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+	originalPath := filepath.Join(m.outputDirectory, "originals", filepath.FromSlash(m.TileKey(tile.Zoom, tile.X, tile.Y)))
+
+	// A stopped run doesn't touch the tile or keep a partial original
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.AnnotateTiles(ctx, []TileCoord{tile}); !errors.Is(err, context.Canceled) {
+		t.Errorf("AnnotateTiles with a stopped context = %v, want it cancelled", err)
+	}
+	if _, err := os.Stat(originalPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("original kept by a stopped run: %v", err)
+	}
+
+	// Annotating twice redraws the tile from its original
+	for run := 0; run < 2; run++ {
+		if failed, err := m.AnnotateTiles(context.Background(), []TileCoord{tile}); err != nil || failed != 0 {
+			t.Fatalf("AnnotateTiles = %d failed, %v", failed, err)
+		}
+		if err := m.SaveTileMetadata(); err != nil {
+			t.Fatal(err)
+		}
+
+		kept, err := os.ReadFile(originalPath)
+		if err != nil || !bytes.Equal(kept, original) {
+			t.Fatalf("run %d: original not kept unchanged: %v", run, err)
+		}
+
+		img, err := m.LoadTileImage(tile.Zoom, tile.X, tile.Y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pixel := range []struct {
+			x, y int
+			want color.NRGBA
+		}{
+			{127, 127, color.NRGBA{B: 0xff, A: 0xff}},
+			{128, 128, color.NRGBA{B: 0xff, A: 0xff}},
+			{30, 63, color.NRGBA{G: 0xff, A: 0xff}},
+			{220, 64, color.NRGBA{G: 0xff, A: 0xff}},
+			{30, 200, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}},
+			{127, 100, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}},
+		} {
+			if got := color.NRGBAModel.Convert(img.At(pixel.x, pixel.y)); got != pixel.want {
+				t.Errorf("run %d: pixel %d,%d = %v, want %v", run, pixel.x, pixel.y, got, pixel.want)
+			}
+		}
+	}
+
+	metadata, err := m.LoadTileMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metadata[m.TileKey(tile.Zoom, tile.X, tile.Y)].Annotated {
+		t.Error("tile not recorded as annotated")
+	}
+}
@@ -0,0 +1,251 @@
+package downloader
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// WGS84 ellipsoid and UTM projection constants
+const (
+	wgs84A         = 6378137.0
+	wgs84F         = 1 / 298.257223563
+	utmScaleFactor = 0.9996
+	utmFalseEast   = 500000.0
+	utmFalseNorth  = 10000000.0 // added to southern hemisphere northings
+)
+
+// mgrsBands are the latitude bands of UTM and MGRS, 8 degrees each from 80°S
+const mgrsBands = "CDEFGHJKLMNPQRSTUVWX"
+
+var (
+	utmPattern       = regexp.MustCompile(`^(\d{1,2})\s*([C-HJ-NP-X])\s+(\d+(?:\.\d+)?)\s*[mE]?\s+(\d+(?:\.\d+)?)\s*[mN]?$`)
+	mgrsPattern      = regexp.MustCompile(`^(\d{1,2})([C-HJ-NP-X])([A-HJ-NP-Z])([A-HJ-NP-V])(\d*)$`)
+	geohashPattern   = regexp.MustCompile(`^[0-9b-hjkmnp-z]{1,12}$`)
+	plusCodePattern  = regexp.MustCompile(`^[23456789CFGHJMPQRVWX]{2}(?:[23456789CFGHJMPQRVWX]{6}|[23456789CFGHJMPQRVWX]{4}00|[23456789CFGHJMPQRVWX]{2}0000|000000)\+[23456789CFGHJMPQRVWX]*$`)
+	decimalPairRegex = regexp.MustCompile(`^\s*[-+]?\d+(?:\.\d+)?\s*,\s*[-+]?\d+(?:\.\d+)?\s*$`)
+)
+
+// ParseCoordinate reads a position written in decimal degrees ("lat,long"),
+// as a UTM or MGRS grid reference, a geohash or an Open Location Code (Plus
+// Code). Grid squares, geohashes and Plus Codes are areas: their cell is
+// returned along with its center. UTM positions and decimal degrees have no cell.
+func ParseCoordinate(text string) (Point, *Region, error) {
+	text = strings.TrimSpace(text)
+	compact := strings.ToUpper(strings.ReplaceAll(text, " ", ""))
+
+	switch {
+	case decimalPairRegex.MatchString(text):
+		var point Point
+		latText, longText, _ := strings.Cut(text, ",")
+		point.Lat, _ = strconv.ParseFloat(strings.TrimSpace(latText), 64)
+		point.Long, _ = strconv.ParseFloat(strings.TrimSpace(longText), 64)
+		if point.Lat < -90 || point.Lat > 90 || point.Long < -180 || point.Long > 180 {
+			return Point{}, nil, fmt.Errorf("position %s is out of range", text)
+		}
+		return point, nil, nil
+	case utmPattern.MatchString(strings.ToUpper(text)):
+		point, err := parseUTM(utmPattern.FindStringSubmatch(strings.ToUpper(text)))
+		return point, nil, err
+	case mgrsPattern.MatchString(compact):
+		return parseMGRS(mgrsPattern.FindStringSubmatch(compact))
+	case plusCodePattern.MatchString(compact):
+		return parsePlusCode(compact)
+	case geohashPattern.MatchString(text):
+		return parseGeohash(text)
+	default:
+		return Point{}, nil, fmt.Errorf("'%s' is not a position: use \"lat,long\", UTM (29T 519000 4676000), MGRS (29TNG1900076000), a geohash (ezjmg) or a Plus Code (8CJH6PC6+8X)", text)
+	}
+}
+
+// IsCoordinate tells if a text is a position in any of the supported formats
+func IsCoordinate(text string) bool {
+	_, _, err := ParseCoordinate(text)
+	return err == nil
+}
+
+// parseUTM converts a "zone band easting northing" UTM position
+func parseUTM(match []string) (Point, error) {
+	zone, _ := strconv.Atoi(match[1])
+	easting, _ := strconv.ParseFloat(match[3], 64)
+	northing, _ := strconv.ParseFloat(match[4], 64)
+	if zone < 1 || zone > 60 {
+		return Point{}, fmt.Errorf("UTM zone %d is out of range (1-60)", zone)
+	}
+	return utmToPoint(zone, match[2][0] < 'N', easting, northing), nil
+}
+
+// parseMGRS converts an MGRS grid reference into its grid square
+func parseMGRS(match []string) (Point, *Region, error) {
+	zone, _ := strconv.Atoi(match[1])
+	band := match[2][0]
+	column, row, digits := match[3][0], match[4][0], match[5]
+	if zone < 1 || zone > 60 {
+		return Point{}, nil, fmt.Errorf("MGRS zone %d is out of range (1-60)", zone)
+	}
+	if len(digits)%2 != 0 || len(digits) > 10 {
+		return Point{}, nil, fmt.Errorf("MGRS reference %s needs as many easting as northing digits", match[0])
+	}
+
+	// 100 km square letters: columns repeat every three zones, rows every two
+	columnSets := []string{"ABCDEFGH", "JKLMNPQR", "STUVWXYZ"}
+	columnIndex := strings.IndexByte(columnSets[(zone-1)%3], column)
+	if columnIndex < 0 {
+		return Point{}, nil, fmt.Errorf("MGRS column letter %c is not used in zone %d", column, zone)
+	}
+	const rowLetters = "ABCDEFGHJKLMNPQRSTUV"
+	rowIndex := strings.IndexByte(rowLetters, row)
+	if zone%2 == 0 {
+		rowIndex = (rowIndex + len(rowLetters) - 5) % len(rowLetters)
+	}
+
+	precision := len(digits) / 2
+	cellSize := math.Pow(10, float64(5-precision))
+	easting := float64(columnIndex+1) * 100000
+	northing := float64(rowIndex) * 100000
+	if precision > 0 {
+		e, _ := strconv.Atoi(digits[:precision])
+		n, _ := strconv.Atoi(digits[precision:])
+		easting += float64(e) * cellSize
+		northing += float64(n) * cellSize
+	}
+
+	// Rows repeat every 2000 km: pick the cycle that falls in the latitude band
+	southern := band < 'N'
+	bandMinLat := -80 + 8*float64(strings.IndexByte(mgrsBands, band))
+	minNorthing := utmScaleFactor * meridianArc(bandMinLat*math.Pi/180)
+	if southern {
+		minNorthing += utmFalseNorth
+	}
+	minNorthing = math.Floor(minNorthing/100000) * 100000
+	for northing < minNorthing {
+		northing += 2000000
+	}
+
+	center := utmToPoint(zone, southern, easting+cellSize/2, northing+cellSize/2)
+	cell := &Region{MinLat: 90, MinLon: 180, MaxLat: -90, MaxLon: -180}
+	for _, corner := range [][2]float64{{0, 0}, {cellSize, 0}, {0, cellSize}, {cellSize, cellSize}} {
+		point := utmToPoint(zone, southern, easting+corner[0], northing+corner[1])
+		cell.MinLat, cell.MaxLat = math.Min(cell.MinLat, point.Lat), math.Max(cell.MaxLat, point.Lat)
+		cell.MinLon, cell.MaxLon = math.Min(cell.MinLon, point.Long), math.Max(cell.MaxLon, point.Long)
+	}
+	return center, cell, nil
+}
+
+// meridianArc returns the distance in meters from the equator to a latitude
+// in radians along the WGS84 meridian
+func meridianArc(lat float64) float64 {
+	e2 := wgs84F * (2 - wgs84F)
+	e4, e6 := e2*e2, e2*e2*e2
+	return wgs84A * ((1-e2/4-3*e4/64-5*e6/256)*lat -
+		(3*e2/8+3*e4/32+45*e6/1024)*math.Sin(2*lat) +
+		(15*e4/256+45*e6/1024)*math.Sin(4*lat) -
+		(35*e6/3072)*math.Sin(6*lat))
+}
+
+// utmToPoint converts UTM coordinates into latitude and longitude with the
+// inverse transverse Mercator series on the WGS84 ellipsoid
+func utmToPoint(zone int, southern bool, easting, northing float64) Point {
+	e2 := wgs84F * (2 - wgs84F)
+	ep2 := e2 / (1 - e2)
+	x := easting - utmFalseEast
+	y := northing
+	if southern {
+		y -= utmFalseNorth
+	}
+
+	mu := y / utmScaleFactor / (wgs84A * (1 - e2/4 - 3*e2*e2/64 - 5*e2*e2*e2/256))
+	e1 := (1 - math.Sqrt(1-e2)) / (1 + math.Sqrt(1-e2))
+	phi1 := mu + (3*e1/2-27*math.Pow(e1, 3)/32)*math.Sin(2*mu) +
+		(21*e1*e1/16-55*math.Pow(e1, 4)/32)*math.Sin(4*mu) +
+		(151*math.Pow(e1, 3)/96)*math.Sin(6*mu) +
+		(1097*math.Pow(e1, 4)/512)*math.Sin(8*mu)
+
+	sinPhi, cosPhi, tanPhi := math.Sin(phi1), math.Cos(phi1), math.Tan(phi1)
+	n1 := wgs84A / math.Sqrt(1-e2*sinPhi*sinPhi)
+	t1 := tanPhi * tanPhi
+	c1 := ep2 * cosPhi * cosPhi
+	r1 := wgs84A * (1 - e2) / math.Pow(1-e2*sinPhi*sinPhi, 1.5)
+	d := x / (n1 * utmScaleFactor)
+
+	lat := phi1 - (n1*tanPhi/r1)*(d*d/2-
+		(5+3*t1+10*c1-4*c1*c1-9*ep2)*math.Pow(d, 4)/24+
+		(61+90*t1+298*c1+45*t1*t1-252*ep2-3*c1*c1)*math.Pow(d, 6)/720)
+	long := (d - (1+2*t1+c1)*math.Pow(d, 3)/6 +
+		(5-2*c1+28*t1-3*c1*c1+8*ep2+24*t1*t1)*math.Pow(d, 5)/120) / cosPhi
+
+	centralMeridian := float64(zone-1)*6 - 180 + 3
+	return Point{Lat: lat * 180 / math.Pi, Long: centralMeridian + long*180/math.Pi}
+}
+
+// parseGeohash decodes a geohash into its cell
+func parseGeohash(hash string) (Point, *Region, error) {
+	const alphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+	cell := &Region{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180}
+
+	longitudeBit := true
+	for _, char := range hash {
+		value := strings.IndexRune(alphabet, char)
+		for bit := 4; bit >= 0; bit-- {
+			set := value>>bit&1 == 1
+			if longitudeBit {
+				middle := (cell.MinLon + cell.MaxLon) / 2
+				if set {
+					cell.MinLon = middle
+				} else {
+					cell.MaxLon = middle
+				}
+			} else {
+				middle := (cell.MinLat + cell.MaxLat) / 2
+				if set {
+					cell.MinLat = middle
+				} else {
+					cell.MaxLat = middle
+				}
+			}
+			longitudeBit = !longitudeBit
+		}
+	}
+
+	center := Point{Lat: (cell.MinLat + cell.MaxLat) / 2, Long: (cell.MinLon + cell.MaxLon) / 2}
+	return center, cell, nil
+}
+
+// parsePlusCode decodes a full Open Location Code into its area
+func parsePlusCode(code string) (Point, *Region, error) {
+	const alphabet = "23456789CFGHJMPQRVWX"
+	digits := strings.TrimRight(strings.Replace(code, "+", "", 1), "0")
+	if len(digits) < 2 || len(digits)%2 != 0 && len(digits) < 10 || len(digits) > 15 {
+		return Point{}, nil, fmt.Errorf("Plus Code %s is not valid", code)
+	}
+
+	lat, long := -90.0, -180.0
+	resolution := 20.0
+	pairs := min(len(digits), 10)
+	for i := 0; i < pairs; i += 2 {
+		lat += float64(strings.IndexByte(alphabet, digits[i])) * resolution
+		long += float64(strings.IndexByte(alphabet, digits[i+1])) * resolution
+		if i+2 < pairs {
+			resolution /= 20
+		}
+	}
+	latSize, longSize := resolution, resolution
+
+	// Digits after the tenth refine a 5 rows by 4 columns grid
+	for i := 10; i < len(digits); i++ {
+		value := strings.IndexByte(alphabet, digits[i])
+		latSize /= 5
+		longSize /= 4
+		lat += float64(value/4) * latSize
+		long += float64(value%4) * longSize
+	}
+
+	if lat >= 90 || long >= 180 {
+		return Point{}, nil, fmt.Errorf("Plus Code %s is out of range", code)
+	}
+	cell := &Region{MinLat: lat, MinLon: long, MaxLat: math.Min(lat+latSize, 90), MaxLon: math.Min(long+longSize, 180)}
+	center := Point{Lat: (cell.MinLat + cell.MaxLat) / 2, Long: (cell.MinLon + cell.MaxLon) / 2}
+	return center, cell, nil
+}
@@ -0,0 +1,113 @@
+package downloader
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseCoordinate(t *testing.T) {
+	tests := []struct {
+		text      string
+		lat, long float64
+		tolerance float64 // degrees
+		cell      bool
+	}{
+		{"42.2406, -8.7207", 42.2406, -8.7207, 1e-9, false},
+		{"32U 340000 5710000", 51.51842959, 6.69387749, 1e-6, false},
+		{"56H 334900.57 6252288.75", -33.8568, 151.2153, 1e-6, false},
+		{"32U 395201.31 5673135.24", 51.2, 7.5, 1e-6, false},
+		// Mirror of the previous position: southern northings count down from 10000 km
+		{"32F 395201.31 4326864.76", -51.2, 7.5, 1e-6, false},
+		{"15TWG0000049776", 42.0, -93.0, 1e-5, true},
+		{"15T WG 00000 49776", 42.0, -93.0, 1e-5, true},
+		{"32ULB9520173135", 51.2, 7.5, 1e-5, true},
+		{"32FLJ9520126864", -51.2, 7.5, 1e-5, true},
+		{"56HLH3490052288", -33.8568, 151.2153, 1e-5, true},
+		{"ezs42", 42.60498046875, -5.60302734375, 1e-9, true},
+		{"u4pruydqqvj", 57.64911, 10.40744, 1e-5, true},
+		{"8FVC9G8F+6X", 47.3655625, 8.5249375, 1e-9, true},
+		{"8fvc9g8f+6x", 47.3655625, 8.5249375, 1e-9, true},
+		{"8FVC0000+", 47.5, 8.5, 1e-9, true},
+	}
+	for _, test := range tests {
+		point, cell, err := ParseCoordinate(test.text)
+		if err != nil {
+			t.Errorf("%s: %v", test.text, err)
+			continue
+		}
+		if math.Abs(point.Lat-test.lat) > test.tolerance || math.Abs(point.Long-test.long) > test.tolerance {
+			t.Errorf("%s = %.8f,%.8f, want %.8f,%.8f", test.text, point.Lat, point.Long, test.lat, test.long)
+		}
+		if (cell != nil) != test.cell {
+			t.Errorf("%s: cell = %v, want a cell: %v", test.text, cell, test.cell)
+		}
+	}
+}
+
+func TestParseCoordinateCells(t *testing.T) {
+	tests := []struct {
+		text string
+		cell Region
+	}{
+		{"ezs42", Region{MinLat: 42.5830078125, MinLon: -5.625, MaxLat: 42.626953125, MaxLon: -5.5810546875}},
+		{"8FVC9G8F+6X", Region{MinLat: 47.3655, MinLon: 8.524875, MaxLat: 47.365625, MaxLon: 8.525}},
+	}
+	for _, test := range tests {
+		_, cell, err := ParseCoordinate(test.text)
+		if err != nil {
+			t.Errorf("%s: %v", test.text, err)
+			continue
+		}
+		if math.Abs(cell.MinLat-test.cell.MinLat) > 1e-9 || math.Abs(cell.MinLon-test.cell.MinLon) > 1e-9 ||
+			math.Abs(cell.MaxLat-test.cell.MaxLat) > 1e-9 || math.Abs(cell.MaxLon-test.cell.MaxLon) > 1e-9 {
+			t.Errorf("%s cell = %v, want %v", test.text, cell, test.cell)
+		}
+	}
+}
+
+func TestParseMGRSPrecision(t *testing.T) {
+	// Each pair of digits fewer makes the grid square ten times larger
+	for _, test := range []struct {
+		text   string
+		sizeKm float64
+	}{
+		{"32ULB", 100},
+		{"32ULB97", 10},
+		{"32ULB9573", 1},
+		{"32ULB952731", 0.1},
+	} {
+		_, cell, err := ParseCoordinate(test.text)
+		if err != nil {
+			t.Errorf("%s: %v", test.text, err)
+			continue
+		}
+		heightKm := (cell.MaxLat - cell.MinLat) * 111.2
+		if heightKm < test.sizeKm*0.95 || heightKm > test.sizeKm*1.1 {
+			t.Errorf("%s: square is %.3f km high, want about %g km", test.text, heightKm, test.sizeKm)
+		}
+		if cell.MinLat > 51.2 || cell.MaxLat < 51.2 || cell.MinLon > 7.5 || cell.MaxLon < 7.5 {
+			t.Errorf("%s: square %v does not contain 51.2,7.5", test.text, cell)
+		}
+	}
+}
+
+func TestParseCoordinateInvalid(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"hello world",
+		"91,0",
+		"0,181",
+		"61U 395201 5673135",  // zone out of range
+		"32ULB952",            // odd number of digits
+		"32UAB9520173135",     // column letter of another zone set
+		"32ULB952017313512",   // more than 5 digits per coordinate
+		"ezs4a",               // not a geohash letter
+		"8FVC9G8F6X",          // missing separator
+		"8FVC9G8+6X",          // separator misplaced
+		"8FVC9G8F+6XRRRRRRRR", // more than 15 digits
+	} {
+		if point, cell, err := ParseCoordinate(text); err == nil {
+			t.Errorf("%q = %v, %v, want an error", text, point, cell)
+		}
+	}
+}
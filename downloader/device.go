@@ -0,0 +1,171 @@
+package downloader
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// DeviceProfile describes the tiles expected by a Meshtastic device map viewer
+type DeviceProfile struct {
+	TileSize   int    // tile width and height in pixels
+	Format     string // png or jpeg
+	ColorDepth int    // bits per pixel: 32, 24, 8 (256 colours), 2 (4 grays) or 1 (black and white)
+	Layout     string // tile path relative to the output directory
+	MaxZoom    int    // deepest recommended zoom level, 0 for no recommendation
+}
+
+// KnownDeviceProfiles returns the built-in device profiles
+func KnownDeviceProfiles() map[string]DeviceProfile {
+	return map[string]DeviceProfile{
+		"default": {
+			TileSize:   256,
+			Format:     "png",
+			ColorDepth: 32,
+			Layout:     "{provider}/{style}/{z}/{x}/{y}.{ext}",
+		},
+		// T-Deck and other TFT devices running the device-ui map viewer
+		"tdeck": {
+			TileSize:   256,
+			Format:     "png",
+			ColorDepth: 8,
+			Layout:     "maps/{style}/{z}/{x}/{y}.{ext}",
+			MaxZoom:    16,
+		},
+		// Larger TFT screens running the device-ui map viewer, such as the SenseCAP Indicator
+		"indicator": {
+			TileSize:   256,
+			Format:     "png",
+			ColorDepth: 24,
+			Layout:     "maps/{style}/{z}/{x}/{y}.{ext}",
+			MaxZoom:    17,
+		},
+		// Small monochrome e-ink screens
+		"eink": {
+			TileSize:   128,
+			Format:     "png",
+			ColorDepth: 1,
+			Layout:     "maps/{style}/{z}/{x}/{y}.{ext}",
+			MaxZoom:    15,
+		},
+	}
+}
+
+// KnownDevices returns the names of the built-in device profiles
+func KnownDevices() []string {
+	devices := make([]string, 0, len(KnownDeviceProfiles()))
+	for name := range KnownDeviceProfiles() {
+		devices = append(devices, name)
+	}
+	sort.Strings(devices)
+	return devices
+}
+
+// Extension returns the file extension of the profile image format
+func (d DeviceProfile) Extension() string {
+	if d.Format == "jpeg" {
+		return "jpg"
+	}
+	return "png"
+}
+
+// DeviceProfile returns the selected device profile
+func (m *MeshtasticTileDownloader) DeviceProfile() DeviceProfile {
+	if profile, ok := KnownDeviceProfiles()[m.config.Map.Device]; ok {
+		return profile
+	}
+	return KnownDeviceProfiles()["default"]
+}
+
+// IsValidDevice checks if the device profile is known
+func (m *MeshtasticTileDownloader) IsValidDevice() bool {
+	if m.config.Map.Device == "" {
+		return true
+	}
+	_, ok := KnownDeviceProfiles()[m.config.Map.Device]
+	return ok
+}
+
+// DeviceTilePath returns a tile path relative to the output directory, following the device layout
+func (m *MeshtasticTileDownloader) DeviceTilePath(zoom, x, y int) string {
+	device := m.DeviceProfile()
+	replacer := strings.NewReplacer(
+		"{provider}", m.TileProvider(),
+		"{style}", m.MapStyle(),
+		"{z}", fmt.Sprint(zoom),
+		"{x}", fmt.Sprint(x),
+		"{y}", fmt.Sprint(y),
+		"{ext}", device.Extension(),
+	)
+	return replacer.Replace(device.Layout)
+}
+
+// EncodeTile scales an image to the device tile size, reduces its colour depth
+// and writes it in the device image format
+func (m *MeshtasticTileDownloader) EncodeTile(w io.Writer, img image.Image) error {
+	device := m.DeviceProfile()
+	size := m.OutputTileSize()
+
+	bounds := img.Bounds()
+	if bounds.Dx() != size || bounds.Dy() != size {
+		scaled := image.NewRGBA(image.Rect(0, 0, size, size))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+		img = scaled
+	}
+
+	if device.Format == "jpeg" {
+		return jpeg.Encode(w, flattenImage(img), &jpeg.Options{Quality: 85})
+	}
+
+	switch device.ColorDepth {
+	case 24:
+		img = flattenImage(img)
+	case 8:
+		img = paletteImage(img)
+	case 1, 2:
+		// Rendered tiles may already have a palette, but with more levels than the panel
+		if p, ok := img.(*image.Paletted); !ok || len(p.Palette) > 1<<device.ColorDepth {
+			img = quantizeGray(grayLevels(img, RenderConfig{}), img.Bounds(), 1<<device.ColorDepth, "ordered")
+		}
+	}
+
+	// Use png encoder with best compression
+	encoder := png.Encoder{
+		CompressionLevel: png.BestCompression,
+	}
+	return encoder.Encode(w, img)
+}
+
+// flattenImage draws an image onto a white background, removing transparency
+func flattenImage(img image.Image) image.Image {
+	if img.ColorModel() == color.GrayModel {
+		return img
+	}
+
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flat
+}
+
+// paletteImage maps an image to a 256 colour palette, unless it already has one
+func paletteImage(img image.Image) image.Image {
+	if _, ok := img.(*image.Paletted); ok {
+		return img
+	}
+	if img.ColorModel() == color.GrayModel {
+		return img
+	}
+
+	paletted := image.NewPaletted(img.Bounds(), palette.Plan9)
+	draw.Draw(paletted, paletted.Bounds(), flattenImage(img), img.Bounds().Min, draw.Src)
+	return paletted
+}
@@ -0,0 +1,41 @@
+package downloader
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestEncodeTileColorDepth(t *testing.T) {
+	// A gray4 rendered tile already has a palette, of four levels
+	gray4 := color.Palette{color.Gray{0}, color.Gray{85}, color.Gray{170}, color.Gray{255}}
+	tile := image.NewPaletted(image.Rect(0, 0, 128, 128), gray4)
+	for i := range tile.Pix {
+		tile.Pix[i] = uint8(i / 128 % 4)
+	}
+
+	m := NewMeshtasticTileDownloader(Options{})
+	m.SetConfig(Config{Map: MapConfig{Device: "eink"}})
+
+	var encoded bytes.Buffer
+	if err := m.EncodeTile(&encoded, tile); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(&encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	colors := make(map[color.Color]bool)
+	bounds := decoded.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			colors[decoded.At(x, y)] = true
+		}
+	}
+	if len(colors) > 2 {
+		t.Errorf("1-bit tile has %d colours, want at most 2", len(colors))
+	}
+}
@@ -0,0 +1,1407 @@
+// Package downloader obtains map tiles for Meshtastic devices from the
+// configured providers, building the zoom levels it can locally.
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // Register JPEG decoder
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config represents the YAML configuration structure
+type Config struct {
+	Zones     map[string]Zone           `yaml:"zones"`
+	Map       MapConfig                 `yaml:"map"`
+	Providers map[string]ProviderConfig `yaml:"providers"`
+	Gazetteer []string                  `yaml:"gazetteer"`
+}
+
+// Zone represents a geographical zone with regions and zoom levels
+type Zone struct {
+	Regions []RegionConfig `yaml:"regions"`
+	Zoom    struct {
+		In  int `yaml:"in"`
+		Out int `yaml:"out"`
+	} `yaml:"zoom"`
+	Render   *RenderConfig `yaml:"render"`
+	Layers   []LayerConfig `yaml:"layers"`
+	Nodes    *NodesConfig  `yaml:"nodes"`
+	Provider string        `yaml:"provider"`
+	Style    string        `yaml:"style"`
+	Reduce   int           `yaml:"reduce"`
+	Output   string        `yaml:"output"`
+}
+
+// MapConfig represents map provider configuration
+type MapConfig struct {
+	Provider    string           `yaml:"provider"`
+	Style       string           `yaml:"style"`
+	Reduce      int              `yaml:"reduce"`
+	Downsample  int              `yaml:"downsample"`
+	Render      RenderConfig     `yaml:"render"`
+	Device      string           `yaml:"device"`
+	Scale       int              `yaml:"scale"`
+	Retina      string           `yaml:"retina"`
+	Fallback    []SourceConfig   `yaml:"fallback"`
+	Layers      []LayerConfig    `yaml:"layers"`
+	Annotations AnnotationConfig `yaml:"annotations"`
+}
+
+// SourceConfig identifies a provider and style to request tiles from
+type SourceConfig struct {
+	Provider string `yaml:"provider"`
+	Style    string `yaml:"style"`
+}
+
+// ProviderConfig overrides the built-in settings of a map provider or defines a new one
+type ProviderConfig struct {
+	Type          string `yaml:"type"`            // xyz (default), wms or wmts
+	URL           string `yaml:"url"`             // URL template (xyz), service endpoint (wms) or GetCapabilities file or URL (wmts)
+	Layers        string `yaml:"layers"`          // WMS layers or WMTS layer
+	Styles        string `yaml:"styles"`          // WMS styles or WMTS style
+	Format        string `yaml:"format"`          // image format requested from WMS and WMTS services
+	Version       string `yaml:"version"`         // WMS version (default: 1.3.0)
+	TileMatrixSet string `yaml:"tile_matrix_set"` // WMTS tile matrix set (default: the first one in EPSG:3857)
+	Scheme        string `yaml:"scheme"`          // xyz (default), tms or quadkey
+	MaxZoom       int    `yaml:"max_zoom"`
+}
+
+// Point represents a point on the map
+type Point struct {
+	Lat  float64
+	Long float64
+}
+
+// TileCoord identifies a single tile in the XYZ tile pyramid
+type TileCoord struct {
+	Zoom int
+	X    int
+	Y    int
+}
+
+// String returns the tile coordinate in z/x/y notation
+func (t TileCoord) String() string {
+	return fmt.Sprintf("%d/%d/%d", t.Zoom, t.X, t.Y)
+}
+
+// Children returns the four tiles covering the tile at the next zoom level
+func (t TileCoord) Children() []TileCoord {
+	return []TileCoord{
+		{Zoom: t.Zoom + 1, X: 2 * t.X, Y: 2 * t.Y},
+		{Zoom: t.Zoom + 1, X: 2 * t.X, Y: 2*t.Y + 1},
+		{Zoom: t.Zoom + 1, X: 2*t.X + 1, Y: 2 * t.Y},
+		{Zoom: t.Zoom + 1, X: 2*t.X + 1, Y: 2*t.Y + 1},
+	}
+}
+
+// Area is a set of regions downloaded at the same zoom levels
+type Area struct {
+	Regions    []Region
+	ZoomLevels []int
+}
+
+// ErrCancelled is returned when the download is declined after its size estimate
+var ErrCancelled = errors.New("download cancelled by user")
+
+// ErrNotImage is returned when a provider answers with something else than an image
+var ErrNotImage = errors.New("not an image")
+
+// ErrInvalidImage is returned when an image can't be decoded
+var ErrInvalidImage = errors.New("failed to decode image")
+
+// StatusError is returned when a provider answers a tile request with an error status
+type StatusError struct {
+	Tile       TileCoord
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("failed to download tile %s: %d %s", e.Tile, e.StatusCode, e.Status)
+}
+
+// Options configures a MeshtasticTileDownloader
+type Options struct {
+	OutputDirectory string            // directory the tiles are stored in
+	APIKeys         map[string]string // API key of each provider, by provider name
+	DryRun          bool              // log the tiles that would be obtained instead of obtaining them
+	Progress        ProgressObserver  // told about the progress of runs (default: SilentProgress)
+	Metrics         *Metrics          // counts the tiles and provider requests of runs (default: none)
+
+	// ConfirmDownload is asked before downloads estimated above 100 MB, which
+	// are cancelled when it returns false. Nil downloads without asking.
+	ConfirmDownload func(estimatedSize int64) bool
+}
+
+// Summary counts the tiles obtained by a run
+type Summary struct {
+	Tiles      int           `json:"tiles"`      // tiles to download, before splitting @2x tiles
+	Requests   int           `json:"requests"`   // tiles requested from the providers
+	Downloaded int           `json:"downloaded"` // requests stored
+	Skipped    int           `json:"skipped"`    // requests already stored
+	Failed     int           `json:"failed"`     // requests that failed
+	Built      int           `json:"built"`      // tiles built locally from other zoom levels
+	Remaining  int           `json:"remaining"`  // tiles left to obtain when the run was interrupted
+	Duration   time.Duration `json:"-"`          // time taken
+
+	// Interrupted is set when the context was cancelled or its deadline
+	// passed before every tile was obtained
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+// Add returns the sum of two summaries
+func (s Summary) Add(other Summary) Summary {
+	s.Tiles += other.Tiles
+	s.Requests += other.Requests
+	s.Downloaded += other.Downloaded
+	s.Skipped += other.Skipped
+	s.Failed += other.Failed
+	s.Built += other.Built
+	s.Remaining += other.Remaining
+	s.Interrupted = s.Interrupted || other.Interrupted
+	s.Duration += other.Duration
+	return s
+}
+
+// MeshtasticTileDownloader is the main application struct
+type MeshtasticTileDownloader struct {
+	config          Config
+	configFile      string
+	configData      []byte
+	configNode      yaml.Node
+	outputDirectory string
+	apiKeys         map[string]string
+	dryRun          bool
+	confirmDownload func(estimatedSize int64) bool
+	progress        ProgressObserver
+	metrics         *Metrics
+	zone            string
+	isPointRadius   bool
+	points          []PointRadius
+	tileMetadata    map[string]TileInfo
+	wmtsLayers      map[string]*WMTSLayer
+	annotations     []Feature
+	gazetteer       *Gazetteer
+	plan            *Plan
+	report          *Report
+}
+
+// NewMeshtasticTileDownloader creates a new tile downloader
+func NewMeshtasticTileDownloader(options Options) *MeshtasticTileDownloader {
+	m := &MeshtasticTileDownloader{
+		outputDirectory: options.OutputDirectory,
+		dryRun:          options.DryRun,
+		confirmDownload: options.ConfirmDownload,
+		progress:        options.Progress,
+		metrics:         options.Metrics,
+	}
+	if m.progress == nil {
+		m.progress = SilentProgress{}
+	}
+	for provider, apiKey := range options.APIKeys {
+		m.SetAPIKey(provider, apiKey)
+	}
+	return m
+}
+
+// SetConfig replaces the configuration, as an alternative to LoadConfig
+func (m *MeshtasticTileDownloader) SetConfig(config Config) {
+	m.config = config
+}
+
+// AddPoints switches to point-radius mode and adds points to download around
+func (m *MeshtasticTileDownloader) AddPoints(points ...PointRadius) {
+	m.points = append(m.points, points...)
+	m.isPointRadius = true
+}
+
+// LoadConfig loads configuration from a YAML file
+func (m *MeshtasticTileDownloader) LoadConfig(configFile string) error {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if err := yaml.Unmarshal(data, &m.config); err != nil {
+		return fmt.Errorf("failed to parse YAML: %w", err)
+	}
+
+	// Keep the document to report the line of invalid settings
+	m.configFile, m.configData = configFile, data
+	if err := yaml.Unmarshal(data, &m.configNode); err != nil {
+		return fmt.Errorf("failed to parse YAML: %w", err)
+	}
+
+	return nil
+}
+
+// ValidateConfig validates the configuration
+func (m *MeshtasticTileDownloader) ValidateConfig(ctx context.Context) bool {
+	slog.Info("Analysing configuration")
+
+	// Report every problem before trying to fix or use anything
+	if configErrors := m.CheckConfig(); len(configErrors) > 0 {
+		for _, configError := range configErrors {
+			slog.Error("Configuration problem", "error", configError)
+		}
+		slog.Error("Configuration is not valid", "problems", len(configErrors))
+		return false
+	}
+
+	// When using point-radius mode, we don't need to validate zones
+	if m.isPointRadius {
+		slog.Info("Using point-radius mode", "points", len(m.points))
+		for _, point := range m.points {
+			slog.Info("Point", "lat", point.Lat, "long", point.Long, "radius_km", point.RadiusKm, "detail", point.Detail)
+		}
+	} else {
+		// Check zones
+		slog.Info("Found zones", "zones", len(m.config.Zones))
+		for zoneName, zone := range m.config.Zones {
+			// Add the coverage of the Meshtastic nodes as regions
+			modified := false
+			if zone.Nodes != nil {
+				if err := m.AddNodeCoverage(zoneName, &zone); err != nil {
+					slog.Error("Invalid node coverage", "zone", zoneName, "error", err)
+					return false
+				}
+				modified = true
+			}
+
+			slog.Info("Zone regions", "zone", zoneName, "regions", len(zone.Regions))
+
+			// Set default zoom levels if not specified
+			if zone.Zoom.In == 0 {
+				zone.Zoom.In = 8
+				modified = true
+				slog.Info("Setting default zoom in level", "zone", zoneName, "zoom", 8)
+			}
+			if zone.Zoom.Out == 0 {
+				zone.Zoom.Out = 1
+				modified = true
+				slog.Info("Setting default zoom out level", "zone", zoneName, "zoom", 1)
+			}
+
+			// If we modified the zone, update it in the map
+			if modified {
+				m.config.Zones[zoneName] = zone
+			}
+
+			if zone.Render != nil {
+				if err := zone.Render.Validate(); err != nil {
+					slog.Error("Invalid render settings", "zone", zoneName, "error", err)
+					return false
+				}
+			}
+			if err := m.PrepareLayers(ctx, zone.Layers); err != nil {
+				slog.Error("Invalid layers", "zone", zoneName, "error", err)
+				return false
+			}
+		}
+	}
+
+	// Set map defaults if needed
+	if m.config.Map.Provider == "" {
+		m.config.Map.Provider = "thunderforest"
+		slog.Info("Setting default provider", "provider", "thunderforest")
+	}
+	if m.config.Map.Style == "" {
+		m.config.Map.Style = "atlas"
+		slog.Info("Setting default style", "style", "atlas")
+	}
+	if m.config.Map.Reduce == 0 {
+		m.config.Map.Reduce = 12
+		slog.Info("Setting default reduce level", "zoom", 12)
+	}
+	if m.config.Map.Downsample < 0 {
+		m.config.Map.Downsample = 0
+		slog.Warn("Disabling downsampling due to negative value")
+	} else if m.config.Map.Downsample > 0 {
+		slog.Info("Lower zoom levels will be built locally", "down_to_zoom", m.config.Map.Downsample)
+	}
+
+	if err := m.config.Map.Render.Validate(); err != nil {
+		slog.Error("Invalid render settings", "error", err)
+		return false
+	}
+
+	// Validate provider
+	if !m.IsValidProvider() {
+		knownProviders := strings.Join(m.KnownProviders(), ", ")
+		slog.Error("Provider is unknown", "provider", m.config.Map.Provider, "known", knownProviders)
+		return false
+	}
+	if err := m.PrepareProvider(ctx); err != nil {
+		slog.Error("Provider can't be used", "provider", m.TileProvider(), "error", err)
+		return false
+	}
+	if err := m.PrepareFallbackSources(ctx); err != nil {
+		slog.Error("Invalid fallback sources", "error", err)
+		return false
+	}
+	if err := m.PrepareLayers(ctx, m.config.Map.Layers); err != nil {
+		slog.Error("Invalid layers", "error", err)
+		return false
+	}
+	if !m.isPointRadius && !m.PrepareZoneProviders(ctx) {
+		return false
+	}
+	if err := m.LoadAnnotations(); err != nil {
+		slog.Error("Invalid annotations", "error", err)
+		return false
+	}
+	// Validate retina settings
+	if m.config.Map.Scale == 0 {
+		m.config.Map.Scale = 1
+	} else if m.config.Map.Scale != 1 && m.config.Map.Scale != 2 {
+		slog.Error("Scale is not supported", "scale", m.config.Map.Scale, "valid", "1, 2")
+		return false
+	}
+	if m.config.Map.Retina == "" {
+		m.config.Map.Retina = "downscale"
+	} else if !m.IsValidRetinaMode() {
+		slog.Error("Retina mode is unknown", "retina", m.config.Map.Retina, "known", "keep, downscale, split")
+		return false
+	}
+	if m.config.Map.Scale == 2 && !m.SupportsScale() {
+		m.config.Map.Scale = 1
+		slog.Warn("Provider has no @2x tiles. Setting scale to 1", "provider", m.TileProvider())
+	}
+
+	// Validate device profile
+	if !m.IsValidDevice() {
+		slog.Error("Device is unknown", "device", m.config.Map.Device, "known", strings.Join(KnownDevices(), ", "))
+		return false
+	}
+	if maxZoom := m.DeviceProfile().MaxZoom; maxZoom > 0 {
+		if m.isPointRadius {
+			for _, point := range m.points {
+				zoomLevels := ZoomLevelsForDetail(point.Detail)
+				if deepest := zoomLevels[len(zoomLevels)-1]; deepest > maxZoom {
+					slog.Warn("Detail level zooms in deeper than recommended for the device",
+						"detail", point.Detail, "zoom", deepest, "recommended_zoom", maxZoom, "device", m.config.Map.Device)
+				}
+			}
+		} else {
+			for zoneName, zone := range m.config.Zones {
+				if zone.Zoom.In > maxZoom {
+					slog.Warn("Zone zooms in deeper than recommended for the device",
+						"zone", zoneName, "zoom", zone.Zoom.In, "recommended_zoom", maxZoom, "device", m.config.Map.Device)
+				}
+			}
+		}
+	}
+
+	if maxZoom := m.ProviderMaxZoom(); maxZoom > 0 {
+		slog.Info("Provider has a maximum zoom. Deeper tiles will be synthesized", "provider", m.TileProvider(), "max_zoom", maxZoom)
+	}
+
+	return true
+}
+
+// ZoneMapConfig returns the map configuration in effect for a zone
+func (m *MeshtasticTileDownloader) ZoneMapConfig(zone Zone) MapConfig {
+	mapConfig := m.config.Map
+	if zone.Render != nil {
+		mapConfig.Render = *zone.Render
+	}
+	if zone.Layers != nil {
+		mapConfig.Layers = zone.Layers
+	}
+	if zone.Provider != "" {
+		mapConfig.Provider = zone.Provider
+	}
+	if zone.Style != "" {
+		mapConfig.Style = zone.Style
+	}
+	if zone.Reduce != 0 {
+		mapConfig.Reduce = zone.Reduce
+	}
+	return mapConfig
+}
+
+// ZoneOutputDirectory returns the directory the tiles of a zone are stored in.
+// Relative output overrides are resolved against the download directory.
+func (m *MeshtasticTileDownloader) ZoneOutputDirectory(zone Zone) string {
+	if zone.Output == "" {
+		return m.outputDirectory
+	}
+	if filepath.IsAbs(zone.Output) {
+		return zone.Output
+	}
+	return filepath.Join(m.outputDirectory, zone.Output)
+}
+
+// ZoneZoomLevels returns the zoom levels of a zone, from its zoom out to its zoom in level
+func ZoneZoomLevels(zone Zone) []int {
+	zoomLevels := make([]int, 0, zone.Zoom.In-zone.Zoom.Out+1)
+	for i := zone.Zoom.Out; i <= zone.Zoom.In; i++ {
+		zoomLevels = append(zoomLevels, i)
+	}
+	return zoomLevels
+}
+
+// useZone applies the map configuration and output directory of a zone. The
+// returned function restores the previous ones.
+func (m *MeshtasticTileDownloader) useZone(zone Zone) (restore func()) {
+	originalMap, originalOutputDir := m.config.Map, m.outputDirectory
+	m.config.Map, m.outputDirectory = m.ZoneMapConfig(zone), m.ZoneOutputDirectory(zone)
+	if m.config.Map.Scale == 2 && !m.SupportsScale() {
+		m.config.Map.Scale = 1
+	}
+	return func() {
+		m.config.Map, m.outputDirectory = originalMap, originalOutputDir
+	}
+}
+
+// PrepareZoneProviders checks the provider in effect for every zone overriding it
+func (m *MeshtasticTileDownloader) PrepareZoneProviders(ctx context.Context) bool {
+	originalMap := m.config.Map
+	defer func() { m.config.Map = originalMap }()
+
+	for zoneName, zone := range m.config.Zones {
+		if zone.Provider == "" && zone.Style == "" {
+			continue
+		}
+
+		m.config.Map = m.ZoneMapConfig(zone)
+		if !m.IsValidProvider() {
+			knownProviders := strings.Join(m.KnownProviders(), ", ")
+			slog.Error("Provider is unknown", "zone", zoneName, "provider", m.TileProvider(), "known", knownProviders)
+			return false
+		}
+		if err := m.PrepareProvider(ctx); err != nil {
+			slog.Error("Provider can't be used", "zone", zoneName, "provider", m.TileProvider(), "error", err)
+			return false
+		}
+		if m.config.Map.Scale == 2 && !m.SupportsScale() {
+			slog.Warn("Provider has no @2x tiles. Using scale 1 for this zone", "zone", zoneName, "provider", m.TileProvider())
+		}
+		slog.Info("Using zone provider", "zone", zoneName, "provider", m.TileProvider(), "style", m.MapStyle())
+	}
+	return true
+}
+
+// TileProvider returns the configured tile provider
+func (m *MeshtasticTileDownloader) TileProvider() string {
+	return m.config.Map.Provider
+}
+
+// MapStyle returns the configured map style
+func (m *MeshtasticTileDownloader) MapStyle() string {
+	return m.config.Map.Style
+}
+
+// IsValidProvider checks if the provider is valid
+func (m *MeshtasticTileDownloader) IsValidProvider() bool {
+	if _, ok := m.GetTileProviderURLTemplate()[m.TileProvider()]; ok {
+		return true
+	}
+	custom, ok := m.config.Providers[m.TileProvider()]
+	return ok && custom.URL != ""
+}
+
+// KnownProviders returns a list of known providers
+func (m *MeshtasticTileDownloader) KnownProviders() []string {
+	providers := make([]string, 0, len(m.GetTileProviderURLTemplate()))
+	for k := range m.GetTileProviderURLTemplate() {
+		providers = append(providers, k)
+	}
+	for k, custom := range m.config.Providers {
+		if _, ok := m.GetTileProviderURLTemplate()[k]; !ok && custom.URL != "" {
+			providers = append(providers, k)
+		}
+	}
+	return providers
+}
+
+// GetTileProviderURLTemplate returns a map of provider URL templates
+func (m *MeshtasticTileDownloader) GetTileProviderURLTemplate() map[string]string {
+	return map[string]string{
+		"thunderforest": "https://tile.thunderforest.com/{{MAP_STYLE}}/{{ZOOM}}/{{X}}/{{Y}}{{SCALE}}.png?apikey={{API_KEY}}",
+		"geoapify":      "https://maps.geoapify.com/v1/tile/{{MAP_STYLE}}/{{ZOOM}}/{{X}}/{{Y}}{{SCALE}}.png?apiKey={{API_KEY}}",
+		"cnig.es":       "https://tms-ign-base.idee.es/1.0.0/IGNBaseTodo/{{ZOOM}}/{{X}}/{{Y}}.jpeg",
+	}
+}
+
+// GetTileProviderMaxZoom returns the deepest zoom level served by each provider
+func (m *MeshtasticTileDownloader) GetTileProviderMaxZoom() map[string]int {
+	return map[string]int{
+		"thunderforest": 22,
+		"geoapify":      20,
+		"cnig.es":       17,
+	}
+}
+
+// ProviderMaxZoom returns the deepest zoom level served by the configured provider.
+// Zero means the provider has no known limit.
+func (m *MeshtasticTileDownloader) ProviderMaxZoom() int {
+	if override, ok := m.config.Providers[m.TileProvider()]; ok && override.MaxZoom > 0 {
+		return override.MaxZoom
+	}
+	if layer, ok := m.wmtsLayers[m.TileProvider()]; ok {
+		return layer.MaxZoom()
+	}
+	return m.GetTileProviderMaxZoom()[m.TileProvider()]
+}
+
+// ProviderType returns how tiles are requested from the configured provider: xyz, wms or wmts
+func (m *MeshtasticTileDownloader) ProviderType() string {
+	if custom, ok := m.config.Providers[m.TileProvider()]; ok && custom.Type != "" {
+		return custom.Type
+	}
+	return "xyz"
+}
+
+// ProviderURLTemplate returns the URL template, service endpoint or capabilities
+// location of the configured provider
+func (m *MeshtasticTileDownloader) ProviderURLTemplate() string {
+	if custom, ok := m.config.Providers[m.TileProvider()]; ok && custom.URL != "" {
+		return custom.URL
+	}
+	return m.GetTileProviderURLTemplate()[m.TileProvider()]
+}
+
+// PrepareProvider checks the settings of the configured provider and loads
+// whatever it needs before requesting tiles, such as WMTS capabilities
+func (m *MeshtasticTileDownloader) PrepareProvider(ctx context.Context) error {
+	custom := m.config.Providers[m.TileProvider()]
+
+	switch m.ProviderType() {
+	case "xyz":
+		return m.ValidateScheme()
+	case "wms":
+		if custom.Layers == "" {
+			return fmt.Errorf("WMS providers need the layers to request")
+		}
+		return nil
+	case "wmts":
+		if _, ok := m.wmtsLayers[m.TileProvider()]; ok {
+			return nil
+		}
+		layer, err := LoadWMTSLayer(ctx, custom)
+		if err != nil {
+			return err
+		}
+		if m.wmtsLayers == nil {
+			m.wmtsLayers = make(map[string]*WMTSLayer)
+		}
+		m.wmtsLayers[m.TileProvider()] = layer
+		slog.Info("Using WMTS layer", "layer", layer.Identifier, "tile_matrix_set", layer.TileMatrixSet)
+		return nil
+	default:
+		return fmt.Errorf("provider type '%s' is unknown. Known: xyz, wms, wmts", custom.Type)
+	}
+}
+
+// RequiresAPIKey checks if the configured provider needs an API key
+func (m *MeshtasticTileDownloader) RequiresAPIKey() bool {
+	return strings.Contains(m.ProviderURLTemplate(), "{{API_KEY}}")
+}
+
+// ParseURL parses a URL template with the given parameters
+func (m *MeshtasticTileDownloader) ParseURL(zoom, x, y int) string {
+	var url string
+	switch m.ProviderType() {
+	case "wms":
+		url = m.WMSTileURL(zoom, x, y)
+	case "wmts":
+		url = m.wmtsLayers[m.TileProvider()].TileURL(zoom, x, y)
+	default:
+		url = NormalizeTemplate(m.ProviderURLTemplate())
+	}
+
+	// TMS counts rows from the bottom of the map
+	schemeY := y
+	if m.ProviderScheme() == "tms" {
+		schemeY = FlipY(y, zoom)
+	}
+
+	url = strings.Replace(url, "{{MAP_STYLE}}", m.MapStyle(), -1)
+	url = strings.Replace(url, "{{ZOOM}}", strconv.Itoa(zoom), -1)
+	url = strings.Replace(url, "{{X}}", strconv.Itoa(x), -1)
+	url = strings.Replace(url, "{{Y}}", strconv.Itoa(schemeY), -1)
+	url = strings.Replace(url, "{{-Y}}", strconv.Itoa(FlipY(y, zoom)), -1)
+	url = strings.Replace(url, "{{QUADKEY}}", QuadKey(zoom, x, y), -1)
+	url = strings.Replace(url, "{{SCALE}}", m.ScaleSuffix(), -1)
+	url = strings.Replace(url, "{{API_KEY}}", m.APIKey(), -1)
+	return url
+}
+
+// APIKey returns the API key of the configured provider
+func (m *MeshtasticTileDownloader) APIKey() string {
+	return m.apiKeys[m.TileProvider()]
+}
+
+// SetAPIKey sets the API key used for a provider
+func (m *MeshtasticTileDownloader) SetAPIKey(provider, apiKey string) {
+	if m.apiKeys == nil {
+		m.apiKeys = make(map[string]string)
+	}
+	m.apiKeys[provider] = apiKey
+}
+
+// RedactKey redacts the API keys in a URL for logging
+func (m *MeshtasticTileDownloader) RedactKey(url string) string {
+	for _, apiKey := range m.apiKeys {
+		if apiKey != "" {
+			url = strings.Replace(url, apiKey, "[REDACTED]", -1)
+		}
+	}
+	return url
+}
+
+// LongToTileX converts longitude to tile X coordinate. The antimeridian at
+// 180° falls in the last column.
+func LongToTileX(lon float64, zoom int) int {
+	xyTilesCount := math.Pow(2, float64(zoom))
+	x := int(math.Floor(((lon + 180.0) / 360.0) * xyTilesCount))
+	return clampTile(x, zoom)
+}
+
+// LatToTileY converts latitude to tile Y coordinate. The southern limit of
+// the Web Mercator projection falls in the last row.
+func LatToTileY(lat float64, zoom int) int {
+	xyTilesCount := math.Pow(2, float64(zoom))
+	y := int(math.Floor(((1.0 - math.Log(math.Tan((lat*math.Pi)/180.0)+1.0/math.Cos((lat*math.Pi)/180.0))/math.Pi) / 2.0) * xyTilesCount))
+	return clampTile(y, zoom)
+}
+
+// clampTile keeps a tile column or row within the 2^zoom tiles of a zoom level
+func clampTile(n, zoom int) int {
+	return max(0, min(n, 1<<zoom-1))
+}
+
+// TileXToLong converts tile X coordinate to longitude
+func TileXToLong(x int, zoom int) float64 {
+	xyTilesCount := math.Pow(2, float64(zoom))
+	return (float64(x) / xyTilesCount * 360.0) - 180.0
+}
+
+// TileYToLat converts tile Y coordinate to latitude
+func TileYToLat(y int, zoom int) float64 {
+	xyTilesCount := math.Pow(2, float64(zoom))
+	n := math.Pi - 2.0*math.Pi*float64(y)/xyTilesCount
+	return 180.0 / math.Pi * math.Atan(0.5*(math.Exp(n)-math.Exp(-n)))
+}
+
+// IsDryRun checks if tiles are only logged instead of being obtained
+func (m *MeshtasticTileDownloader) IsDryRun() bool {
+	return m.dryRun
+}
+
+// LoadImageBytes loads and returns an image from bytes
+func (m *MeshtasticTileDownloader) LoadImageBytes(imgData []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(imgData))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidImage, err)
+	}
+	return img, nil
+}
+
+// IsReducing reports whether downloaded tiles of a zoom level are reduced to 8 bits
+func (m *MeshtasticTileDownloader) IsReducing(zoom int) bool {
+	return zoom >= m.config.Map.Reduce
+}
+
+// TilePath returns the path where a tile is stored on disk
+func (m *MeshtasticTileDownloader) TilePath(zoom, x, y int) string {
+	return filepath.Join(m.outputDirectory, filepath.FromSlash(m.DeviceTilePath(zoom, x, y)))
+}
+
+// DownloadTile downloads a single tile
+func (m *MeshtasticTileDownloader) DownloadTile(ctx context.Context, zoom, x, y int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	reducing := m.IsReducing(zoom)
+	url := m.ParseURL(zoom, x, y)
+	redactedURL := m.RedactKey(url)
+
+	// Determine the output path
+	tilePath := m.TilePath(zoom, x, y)
+	tileDir := filepath.Dir(tilePath)
+
+	// Create directories if they don't exist
+	if err := os.MkdirAll(tileDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Skip if file already exists
+	if _, err := os.Stat(tilePath); err == nil {
+		slog.Debug("File already exists. Skipping", "path", tilePath, "url", redactedURL)
+		return nil
+	}
+
+	// Skip download in dry-run mode
+	if m.IsDryRun() {
+		slog.Info("Dry run: not obtaining tile", "url", redactedURL, "path", tilePath, "would_reduce", reducing)
+		return nil
+	}
+
+	// Download the tile, trying the fallback sources when needed
+	imgData, contentType, source, err := m.FetchTileWithFallback(ctx, zoom, x, y)
+	if err != nil {
+		return err
+	}
+	if len(m.config.Map.Fallback) > 0 {
+		m.RecordTile(zoom, x, y, TileInfo{Source: source.String()})
+	}
+
+	// Composite the overlay layers onto the base tile
+	if len(m.config.Map.Layers) > 0 {
+		imgData, err = m.ComposeLayers(ctx, imgData, zoom, x, y)
+		if err != nil {
+			return err
+		}
+		contentType = "image/png"
+	}
+
+	// Process and save the image
+	if reducing {
+		slog.Debug("Reducing tile", "url", redactedURL, "path", tilePath)
+		return m.ReduceTile(imgData, tilePath)
+	}
+
+	if !m.config.Map.Render.IsIdentity() {
+		slog.Debug("Rendering tile", "url", redactedURL, "path", tilePath)
+		return m.SaveConvertedTile(imgData, tilePath)
+	}
+
+	slog.Debug("Saving not altered tile", "url", redactedURL, "path", tilePath)
+	if contentType != "image/png" || !m.IsPassthrough() {
+		return m.SaveConvertedTile(imgData, tilePath)
+	}
+
+	return os.WriteFile(tilePath, imgData, 0644)
+}
+
+// FetchTile requests a tile from the provider and returns its data and content
+// type. When the provider limits the rate of requests and says how long to
+// wait, the request is retried after waiting.
+func (m *MeshtasticTileDownloader) FetchTile(ctx context.Context, url string, zoom, x, y int) ([]byte, string, error) {
+	for attempt := 1; ; attempt++ {
+		imgData, contentType, retryAfter, err := m.requestTile(ctx, url, zoom, x, y)
+		if retryAfter <= 0 || attempt > maxRateLimitRetries {
+			return imgData, contentType, err
+		}
+
+		slog.Warn("Rate limited by the provider. Waiting before retrying", "provider", m.TileProvider(),
+			"tile", fmt.Sprintf("%d/%d/%d", zoom, x, y), "wait", retryAfter)
+		if err := m.waitRateLimit(ctx, retryAfter); err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+// requestTile requests a tile once. When the provider answers that the rate
+// limit was reached, it also returns how long to wait before retrying.
+func (m *MeshtasticTileDownloader) requestTile(ctx context.Context, url string, zoom, x, y int) ([]byte, string, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	startTime := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("failed to download: %w", err)
+	}
+	defer resp.Body.Close()
+	m.metrics.response(m.TileProvider(), resp.StatusCode, time.Since(startTime))
+
+	if resp.StatusCode != http.StatusOK {
+		statusErr := &StatusError{Tile: TileCoord{Zoom: zoom, X: x, Y: y}, StatusCode: resp.StatusCode, Status: resp.Status}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return nil, "", ParseRetryAfter(resp.Header.Get("Retry-After")), statusErr
+		}
+		return nil, "", 0, statusErr
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, "", 0, fmt.Errorf("failed to parse tile %d/%d/%d: %d: %w", zoom, x, y, resp.StatusCode, ErrNotImage)
+	}
+
+	// Read the image data
+	imgData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	return imgData, contentType, 0, nil
+}
+
+// maxRateLimitRetries is how many times a rate limited request is retried
+const maxRateLimitRetries = 3
+
+// maxRateLimitWait is the longest wait for a rate limit before retrying
+const maxRateLimitWait = 2 * time.Minute
+
+// ParseRetryAfter returns the wait asked by a Retry-After header, in seconds
+// or as a date, up to two minutes. It returns 0 when there is none.
+func ParseRetryAfter(value string) time.Duration {
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = time.Until(date)
+	}
+	return min(max(wait, 0), maxRateLimitWait)
+}
+
+// waitRateLimit waits before retrying a rate limited request, unless the
+// context stops first
+func (m *MeshtasticTileDownloader) waitRateLimit(ctx context.Context, wait time.Duration) error {
+	m.metrics.rateLimitWait(time.Now().Add(wait))
+	defer m.metrics.rateLimitWait(time.Time{})
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// ReduceTile reduces the color depth of an image
+func (m *MeshtasticTileDownloader) ReduceTile(imgData []byte, destination string) error {
+	img, err := m.LoadImageBytes(imgData)
+	if err != nil {
+		return err
+	}
+
+	return m.SaveImage(img, destination)
+}
+
+// SaveConvertedTile saves a tile converted to PNG
+func (m *MeshtasticTileDownloader) SaveConvertedTile(imgData []byte, destination string) error {
+	img, err := m.LoadImageBytes(imgData)
+	if err != nil {
+		return err
+	}
+
+	return m.SaveImage(img, destination)
+}
+
+// SaveImage renders an image with the active profile and encodes it for the device at the given destination
+func (m *MeshtasticTileDownloader) SaveImage(img image.Image, destination string) error {
+	img = m.RenderImage(img)
+
+	f, err := os.Create(destination)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer f.Close()
+
+	return m.EncodeTile(f, img)
+}
+
+// PointRadiusBounds calculates the bounding box around any point using the Haversine formula
+func PointRadiusBounds(center Point, radiusKm float64) (minLat, minLon, maxLat, maxLon float64) {
+	// Earth's radius in kilometers
+	//earthRadius := 6371.0
+
+	// Convert radius from km to degrees (approximate)
+	// 1 degree of latitude is approximately 111.32 km at the equator
+	// 1 degree of longitude varies with latitude
+	latRadius := radiusKm / 111.32
+
+	// Longitude degrees per km varies with latitude
+	// cos(lat) gives the scale factor
+	longRadius := radiusKm / (111.32 * math.Cos(center.Lat*math.Pi/180.0))
+
+	minLat = center.Lat - latRadius
+	maxLat = center.Lat + latRadius
+	minLon = center.Long - longRadius
+	maxLon = center.Long + longRadius
+
+	// Handle latitude boundary conditions
+	if minLat < -90.0 {
+		minLat = -90.0
+	}
+	if maxLat > 90.0 {
+		maxLat = 90.0
+	}
+
+	// Handle longitude wrap-around
+	if minLon < -180.0 {
+		minLon += 360.0
+	}
+	if maxLon > 180.0 {
+		maxLon -= 360.0
+	}
+
+	return minLat, minLon, maxLat, maxLon
+}
+
+// ZoomLevelsForDetail returns the appropriate zoom level range based on detail level
+func ZoomLevelsForDetail(detailLevel int) []int {
+	var minZoom, maxZoom int
+
+	// Map detail level to zoom levels
+	switch detailLevel {
+	case 1: // Low detail - good for very large areas
+		minZoom = 6
+		maxZoom = 10
+	case 2: // Medium detail - balanced for regional areas
+		minZoom = 7
+		maxZoom = 12
+	case 3: // High detail - good for cities and towns
+		minZoom = 8
+		maxZoom = 14
+	case 4: // Very high detail - for detailed city navigation
+		minZoom = 9
+		maxZoom = 16
+	default: // Default to medium detail
+		minZoom = 7
+		maxZoom = 12
+	}
+
+	// Create zoom level range
+	zoomLevels := make([]int, 0, maxZoom-minZoom+1)
+	for i := minZoom; i <= maxZoom; i++ {
+		zoomLevels = append(zoomLevels, i)
+	}
+
+	return zoomLevels
+}
+
+// estimateTileSize estimates the average size of a tile at a specific zoom level
+func (m *MeshtasticTileDownloader) estimateTileSize(zoom int) int64 {
+	// These are rough estimates based on average tile sizes
+	// Size generally increases with zoom level as tiles contain more detail
+	switch {
+	case zoom <= 5:
+		return 20 * 1024 // ~20KB for very low zoom levels
+	case zoom <= 8:
+		return 30 * 1024 // ~30KB for low zoom levels
+	case zoom <= 11:
+		return 50 * 1024 // ~50KB for medium zoom levels
+	case zoom <= 14:
+		return 80 * 1024 // ~80KB for high zoom levels
+	default:
+		return 120 * 1024 // ~120KB for very high zoom levels
+	}
+}
+
+// FormatSize formats a byte size to a human-readable string (KB, MB, GB)
+func FormatSize(bytes int64) string {
+	const (
+		KB = 1024
+		MB = 1024 * KB
+		GB = 1024 * MB
+	)
+
+	switch {
+	case bytes >= GB:
+		return fmt.Sprintf("%.2f GB", float64(bytes)/float64(GB))
+	case bytes >= MB:
+		return fmt.Sprintf("%.2f MB", float64(bytes)/float64(MB))
+	case bytes >= KB:
+		return fmt.Sprintf("%.2f KB", float64(bytes)/float64(KB))
+	default:
+		return fmt.Sprintf("%d bytes", bytes)
+	}
+}
+
+// ParseRegion parses a "lat,long,lat,long" region string into its bounds
+func ParseRegion(region string) (minLat, minLon, maxLat, maxLon float64, err error) {
+	coords := strings.Split(region, ",")
+	if len(coords) != 4 {
+		return 0, 0, 0, 0, fmt.Errorf("invalid region format: %s", region)
+	}
+
+	values := make([]float64, 4)
+	for i, coord := range coords {
+		values[i], err = strconv.ParseFloat(strings.TrimSpace(coord), 64)
+		if err != nil {
+			if i%2 == 0 {
+				return 0, 0, 0, 0, fmt.Errorf("invalid latitude: %w", err)
+			}
+			return 0, 0, 0, 0, fmt.Errorf("invalid longitude: %w", err)
+		}
+	}
+
+	minLat = math.Min(values[0], values[2])
+	maxLat = math.Max(values[0], values[2])
+	minLon = math.Min(values[1], values[3])
+	maxLon = math.Max(values[1], values[3])
+	return minLat, minLon, maxLat, maxLon, nil
+}
+
+// TileRange returns the inclusive tile ranges covering a bounding box at a zoom level
+func TileRange(minLat, minLon, maxLat, maxLon float64, zoom int) (minX, maxX, minY, maxY int) {
+	startX := LongToTileX(minLon, zoom)
+	endX := LongToTileX(maxLon, zoom)
+	startY := LatToTileY(maxLat, zoom)
+	endY := LatToTileY(minLat, zoom)
+
+	minX = int(math.Min(float64(startX), float64(endX)))
+	maxX = int(math.Max(float64(startX), float64(endX)))
+	minY = int(math.Min(float64(startY), float64(endY)))
+	maxY = int(math.Max(float64(startY), float64(endY)))
+	return minX, maxX, minY, maxY
+}
+
+// PlanTiles lists every tile needed for the given regions and zoom levels.
+// Tiles shared by overlapping regions are only listed once.
+func (m *MeshtasticTileDownloader) PlanTiles(regions []Region, zoomLevels []int) []TileCoord {
+	var tiles []TileCoord
+	seen := make(map[TileCoord]bool)
+
+	for _, zoom := range zoomLevels {
+		for _, region := range regions {
+			minX, maxX, minY, maxY := TileRange(region.MinLat, region.MinLon, region.MaxLat, region.MaxLon, zoom)
+			for x := minX; x <= maxX; x++ {
+				for y := minY; y <= maxY; y++ {
+					tile := TileCoord{Zoom: zoom, X: x, Y: y}
+					if !seen[tile] {
+						seen[tile] = true
+						tiles = append(tiles, tile)
+					}
+				}
+			}
+		}
+	}
+
+	return tiles
+}
+
+// PlanAreas returns the tiles of the given zoom levels covered by any of the
+// areas, each at its own zoom levels. Tiles shared by several areas are listed once.
+func (m *MeshtasticTileDownloader) PlanAreas(areas []Area, zoomLevels []int) []TileCoord {
+	var tiles []TileCoord
+	seen := make(map[TileCoord]bool)
+
+	for _, area := range areas {
+		var areaZoomLevels []int
+		for _, zoom := range zoomLevels {
+			if slices.Contains(area.ZoomLevels, zoom) {
+				areaZoomLevels = append(areaZoomLevels, zoom)
+			}
+		}
+
+		for _, tile := range m.PlanTiles(area.Regions, areaZoomLevels) {
+			if !seen[tile] {
+				seen[tile] = true
+				tiles = append(tiles, tile)
+			}
+		}
+	}
+
+	return tiles
+}
+
+// AreaZoomLevels returns the zoom levels of any of the areas, in increasing order
+func AreaZoomLevels(areas []Area) []int {
+	var zoomLevels []int
+	for _, area := range areas {
+		for _, zoom := range area.ZoomLevels {
+			if !slices.Contains(zoomLevels, zoom) {
+				zoomLevels = append(zoomLevels, zoom)
+			}
+		}
+	}
+	slices.Sort(zoomLevels)
+	return zoomLevels
+}
+
+// TileZoomLevels returns the zoom levels of any of the tiles, in increasing order
+func TileZoomLevels(tiles []TileCoord) []int {
+	var zoomLevels []int
+	for _, tile := range tiles {
+		if !slices.Contains(zoomLevels, tile.Zoom) {
+			zoomLevels = append(zoomLevels, tile.Zoom)
+		}
+	}
+	slices.Sort(zoomLevels)
+	return zoomLevels
+}
+
+// TilesAtZoom returns the tiles of a zoom level
+func TilesAtZoom(tiles []TileCoord, zoom int) []TileCoord {
+	var atZoom []TileCoord
+	for _, tile := range tiles {
+		if tile.Zoom == zoom {
+			atZoom = append(atZoom, tile)
+		}
+	}
+	return atZoom
+}
+
+// EstimateSize estimates the download size of the given tiles
+func (m *MeshtasticTileDownloader) EstimateSize(tiles []TileCoord) int64 {
+	estimatedSize := int64(0)
+	for _, tile := range tiles {
+		estimatedSize += m.estimateTileSize(tile.Zoom)
+	}
+	return estimatedSize
+}
+
+// ObtainTiles downloads the given tiles, stopping when the context is done,
+// and returns how many were downloaded, skipped or failed
+func (m *MeshtasticTileDownloader) ObtainTiles(ctx context.Context, tiles []TileCoord) (Summary, error) {
+	startTime := time.Now()
+	totalTiles := len(tiles)
+	summary := Summary{Tiles: totalTiles}
+
+	// Calculate estimated size
+	estimatedSize := int64(0)
+	for _, zoom := range TileZoomLevels(tiles) {
+		atZoom := TilesAtZoom(tiles, zoom)
+		zoomSize := m.EstimateSize(atZoom)
+		estimatedSize += zoomSize
+		slog.Info("Zoom level", "zoom", zoom, "tiles", len(atZoom), "estimated_size", FormatSize(zoomSize))
+	}
+
+	slog.Info("Total tiles", "tiles", totalTiles, "estimated_size", FormatSize(estimatedSize))
+
+	// Ask for confirmation if size is large
+	if estimatedSize > 100*1024*1024 && m.confirmDownload != nil && !m.confirmDownload(estimatedSize) { // 100MB
+		return summary, ErrCancelled
+	}
+
+	// Request @2x parents instead when splitting retina tiles. Zoom 0 tiles,
+	// which have no parent, come first and are not split.
+	splitting := m.IsSplittingRetina()
+	direct := 0
+	if splitting {
+		tiles, direct = m.RetinaRequests(tiles)
+		slog.Info("Splitting @2x tiles", "requests", len(tiles), "instead_of", totalTiles)
+	}
+	summary.Requests = len(tiles)
+	provider := m.TileProvider()
+	m.metrics.tilesPlannedAt(provider, tiles)
+	m.progress.PlanComputed(PlanEvent{
+		Zone: m.zone, Step: StepDownload, ZoomLevels: TileZoomLevels(tiles),
+		Tiles: totalTiles, Requests: len(tiles), EstimatedSize: estimatedSize,
+	})
+
+	// Download tiles
+	for i, tile := range tiles {
+		if err := ctx.Err(); err != nil {
+			summary.Remaining = len(tiles) - i
+			summary.Downloaded = i - summary.Skipped - summary.Failed
+			summary.Duration = time.Since(startTime)
+			return summary, err
+		}
+
+		split := splitting && i >= direct
+		stored := m.IsStored(tile, split)
+		err := m.obtainTile(StepDownload, tile, split, func() error {
+			if split {
+				return m.DownloadSplitTile(ctx, tile.Zoom, tile.X, tile.Y)
+			}
+			return m.DownloadTile(ctx, tile.Zoom, tile.X, tile.Y)
+		})
+		if err != nil && ctx.Err() != nil {
+			// The tile was cut short, so it is left with the others
+			summary.Remaining = len(tiles) - i
+			summary.Downloaded = i - summary.Skipped - summary.Failed
+			summary.Duration = time.Since(startTime)
+			return summary, ctx.Err()
+		}
+		if stored {
+			summary.Skipped++
+			m.metrics.tileResult(provider, tile, "skipped", 0)
+		} else if err != nil {
+			summary.Failed++
+			m.metrics.tileResult(provider, tile, "failed", 0)
+		} else {
+			m.metrics.tileResult(provider, tile, "downloaded", m.StoredSize(tile, split))
+		}
+	}
+
+	summary.Downloaded = summary.Requests - summary.Skipped - summary.Failed
+	summary.Duration = time.Since(startTime)
+	return summary, nil
+}
+
+// StoredSize returns the size of a stored tile, or of every child of a split @2x tile
+func (m *MeshtasticTileDownloader) StoredSize(tile TileCoord, splitting bool) int64 {
+	if !splitting {
+		info, err := os.Stat(m.TilePath(tile.Zoom, tile.X, tile.Y))
+		if err != nil {
+			return 0
+		}
+		return info.Size()
+	}
+
+	size := int64(0)
+	for dx := 0; dx < 2; dx++ {
+		for dy := 0; dy < 2; dy++ {
+			size += m.StoredSize(TileCoord{Zoom: tile.Zoom + 1, X: 2*tile.X + dx, Y: 2*tile.Y + dy}, false)
+		}
+	}
+	return size
+}
+
+// IsStored reports whether a tile, or every child of a split @2x tile, is already stored
+func (m *MeshtasticTileDownloader) IsStored(tile TileCoord, splitting bool) bool {
+	if !splitting {
+		_, err := os.Stat(m.TilePath(tile.Zoom, tile.X, tile.Y))
+		return err == nil
+	}
+	for dx := 0; dx < 2; dx++ {
+		for dy := 0; dy < 2; dy++ {
+			if _, err := os.Stat(m.TilePath(tile.Zoom+1, 2*tile.X+dx, 2*tile.Y+dy)); err != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// RunPointRadius executes the tile download process for point-radius mode
+func (m *MeshtasticTileDownloader) RunPointRadius(ctx context.Context) (Summary, error) {
+	startTime := time.Now()
+
+	// Calculate the area covered by each point
+	areas := m.PointRadiusAreas()
+	var metadataContent strings.Builder
+	for i, point := range m.points {
+		minLat, minLon, maxLat, maxLon := PointRadiusBounds(point.Point, point.RadiusKm)
+		zoomLevels := areas[i].ZoomLevels
+
+		slog.Info("Point-radius mode", "lat", point.Lat, "long", point.Long, "radius_km", point.RadiusKm,
+			"bounding_box", fmt.Sprintf("%.6f,%.6f,%.6f,%.6f", minLat, minLon, maxLat, maxLon),
+			"detail", point.Detail, "zoom_levels", zoomLevels)
+
+		fmt.Fprintf(&metadataContent, "Center: %.6f, %.6f\nRadius: %.2f km\nDetail Level: %d\nZoom Levels: %v\nBounding Box: %.6f,%.6f,%.6f,%.6f\n",
+			point.Lat, point.Long, point.RadiusKm, point.Detail,
+			zoomLevels, minLat, minLon, maxLat, maxLon)
+	}
+	fmt.Fprintf(&metadataContent, "Timestamp: %s\n", time.Now().Format(time.RFC3339))
+
+	// Create a dedicated output directory for the points
+	pointOutputDir := filepath.Join(m.outputDirectory, m.PointRadiusFolder())
+	if err := os.MkdirAll(pointOutputDir, 0755); err != nil {
+		return Summary{}, fmt.Errorf("failed to create output directory for point: %w", err)
+	}
+
+	// Save the bounds to a metadata file
+	metadataPath := filepath.Join(pointOutputDir, "metadata.txt")
+	if err := os.WriteFile(metadataPath, []byte(metadataContent.String()), 0644); err != nil {
+		slog.Error("Error writing metadata", "error", err)
+	}
+
+	// Store original output directory
+	originalOutputDir := m.outputDirectory
+	// Set output directory to the point-specific directory
+	m.outputDirectory, m.zone = pointOutputDir, "points"
+
+	summary, err := m.ObtainPyramid(ctx, areas)
+
+	// Restore original output directory
+	m.outputDirectory, m.zone = originalOutputDir, ""
+
+	summary.Duration = time.Since(startTime)
+	m.finishZone("points", summary)
+	if errors.Is(err, ErrCancelled) {
+		slog.Info("Download cancelled by user")
+		return summary, nil // User cancellation is not an error
+	}
+	if err != nil {
+		return summary, fmt.Errorf("error obtaining tiles: %w", err)
+	}
+
+	slog.Info("Total download time", "duration", summary.Duration.Round(time.Second))
+	return summary, nil
+}
+
+// Run executes the tile download process for all configured zones and
+// returns how many tiles were obtained. The run is recorded in the report
+// returned by Report.
+func (m *MeshtasticTileDownloader) Run(ctx context.Context) (Summary, error) {
+	m.startReport()
+	summary, err := m.run(ctx)
+	m.finishReport(summary, err)
+	return summary, err
+}
+
+// run obtains the tiles of a plan, of point-radius mode or of the zones
+func (m *MeshtasticTileDownloader) run(ctx context.Context) (Summary, error) {
+	if !m.IsValidProvider() {
+		return Summary{}, fmt.Errorf("unknown provider '%s'", m.TileProvider())
+	}
+
+	// Replay a plan instead of the zones when one was loaded
+	if m.plan != nil {
+		return m.RunPlan(ctx)
+	}
+
+	// If in point-radius mode, use that instead of the configuration file
+	if m.isPointRadius {
+		return m.RunPointRadius(ctx)
+	}
+
+	startTime := time.Now()
+	var summary Summary
+
+	zoneNames := slices.Sorted(maps.Keys(m.config.Zones))
+	for i, zoneName := range zoneNames {
+		zone := m.config.Zones[zoneName]
+		zoomLevels := ZoneZoomLevels(zone)
+
+		regions, err := m.ZoneRegions(zone)
+		if err != nil {
+			return summary, fmt.Errorf("error in the regions of zone %s: %w", zoneName, err)
+		}
+
+		slog.Info("Obtaining zone", "zone", zoneName, "zoom_out", zone.Zoom.Out, "zoom_in", zone.Zoom.In,
+			"regions", fmt.Sprint(regions))
+
+		// Apply the zone overrides while obtaining its tiles
+		zoneStart := time.Now()
+		restore := m.useZone(zone)
+		m.zone = zoneName
+		zoneSummary, err := m.ObtainPyramid(ctx, []Area{{Regions: regions, ZoomLevels: zoomLevels}})
+		m.zone = ""
+		restore()
+		zoneSummary.Duration = time.Since(zoneStart)
+		summary = summary.Add(zoneSummary)
+		m.finishZone(zoneName, zoneSummary)
+
+		if errors.Is(err, ErrCancelled) {
+			slog.Info("Download cancelled by user", "zone", zoneName)
+			summary.Duration = time.Since(startTime)
+			return summary, nil // User cancellation is not an error
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				summary.Remaining += m.ZoneTileCount(zoneNames[i+1:]...)
+			}
+			summary.Duration = time.Since(startTime)
+			return summary, fmt.Errorf("error obtaining tiles for zone %s: %w", zoneName, err)
+		}
+
+		slog.Info("Finished with zone", "zone", zoneName)
+	}
+
+	summary.Duration = time.Since(startTime)
+	slog.Info("Total download time", "duration", summary.Duration.Round(time.Second))
+
+	// List all processed zones
+	slog.Info("Finished processing zones", "zones", strings.Join(zoneNames, ", "))
+
+	return summary, nil
+}
@@ -0,0 +1,196 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{" 7 ", 7 * time.Second},
+		{"120", 2 * time.Minute},
+		{"600", maxRateLimitWait},
+		{"0", 0},
+		{"-3", 0},
+		{"soon", 0},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", 0}, // already passed
+	}
+	for _, test := range tests {
+		if got := ParseRetryAfter(test.value); got != test.want {
+			t.Errorf("ParseRetryAfter(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+
+	date := time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)
+	if got := ParseRetryAfter(date); got < 28*time.Second || got > 30*time.Second {
+		t.Errorf("ParseRetryAfter(%q) = %v, want about 30s", date, got)
+	}
+	date = time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := ParseRetryAfter(date); got != maxRateLimitWait {
+		t.Errorf("ParseRetryAfter(%q) = %v, want %v", date, got, maxRateLimitWait)
+	}
+}
+
+func TestFetchTileRateLimit(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("tile"))
+	}))
+	defer server.Close()
+
+	m := NewMeshtasticTileDownloader(Options{})
+	start := time.Now()
+	data, _, err := m.FetchTile(context.Background(), server.URL, 1, 0, 0)
+	if err != nil || string(data) != "tile" {
+		t.Fatalf("FetchTile = %q, %v, want the tile after waiting for the rate limit", data, err)
+	}
+	if requests.Load() != 2 || time.Since(start) < time.Second {
+		t.Errorf("%d requests in %v, want 2 with a 1s wait between them", requests.Load(), time.Since(start))
+	}
+}
+
+func TestFetchTileRateLimitCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	m := NewMeshtasticTileDownloader(Options{})
+	_, _, err := m.FetchTile(ctx, server.URL, 1, 0, 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("FetchTile = %v, want the wait stopped by the context", err)
+	}
+}
+
+func TestFetchTileWithoutRetryAfter(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	m := NewMeshtasticTileDownloader(Options{})
+	_, _, err := m.FetchTile(context.Background(), server.URL, 1, 0, 0)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusTooManyRequests || requests.Load() != 1 {
+		t.Errorf("FetchTile = %v after %d requests, want the 429 without retrying", err, requests.Load())
+	}
+}
+
+func TestExecutePyramidTimeBudget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(40 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/png")
+		_ = png.Encode(w, image.NewRGBA(image.Rect(0, 0, tileSize, tileSize)))
+	}))
+	defer server.Close()
+
+	m := NewMeshtasticTileDownloader(Options{OutputDirectory: t.TempDir()})
+	m.SetConfig(Config{
+		Map:       MapConfig{Provider: "custom", Downsample: 1},
+		Providers: map[string]ProviderConfig{"custom": {URL: server.URL + "/{z}/{x}/{y}.png"}},
+	})
+
+	var fetch []TileCoord
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 2; y++ {
+			fetch = append(fetch, TileCoord{Zoom: 3, X: x, Y: y})
+		}
+	}
+	plan := PyramidPlan{Fetch: fetch, Downsample: []TileCoord{{Zoom: 2, X: 0, Y: 0}, {Zoom: 2, X: 1, Y: 0}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	summary, err := m.ExecutePyramid(ctx, plan)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ExecutePyramid = %v, want the deadline", err)
+	}
+	if !summary.Interrupted {
+		t.Error("summary is not interrupted")
+	}
+	obtained := summary.Downloaded + summary.Skipped + summary.Failed
+	if obtained == 0 || summary.Remaining == 0 || obtained+summary.Remaining != len(fetch)+len(plan.Downsample) {
+		t.Errorf("summary = %+v, want the %d tiles split between obtained and remaining", summary, len(fetch)+len(plan.Downsample))
+	}
+
+	// Running again skips the stored tiles and obtains the rest
+	summary, err = m.ExecutePyramid(context.Background(), plan)
+	if err != nil || summary.Interrupted || summary.Remaining != 0 || summary.Skipped != obtained || summary.Failed != 0 {
+		t.Errorf("second run = %+v, %v, want the %d stored tiles skipped and the rest obtained", summary, err, obtained)
+	}
+}
+
+func TestUseZone(t *testing.T) {
+	outputDirectory := t.TempDir()
+	base := MapConfig{
+		Provider: "thunderforest",
+		Style:    "atlas",
+		Reduce:   4,
+		Scale:    2,
+		Render:   RenderConfig{Profile: "grayscale"},
+		Layers:   []LayerConfig{{SourceConfig: SourceConfig{Provider: "openstreetmap"}}},
+	}
+
+	tests := []struct {
+		name       string
+		zone       Zone
+		want       MapConfig
+		wantOutput string
+	}{
+		{"no overrides", Zone{}, base, outputDirectory},
+		{"provider", Zone{Provider: "geoapify"},
+			MapConfig{Provider: "geoapify", Style: "atlas", Reduce: 4, Scale: 2, Render: base.Render, Layers: base.Layers}, outputDirectory},
+		{"provider without scale", Zone{Provider: "openstreetmap", Style: "osm"},
+			MapConfig{Provider: "openstreetmap", Style: "osm", Reduce: 4, Scale: 1, Render: base.Render, Layers: base.Layers}, outputDirectory},
+		{"style and reduce", Zone{Style: "outdoors", Reduce: 2},
+			MapConfig{Provider: "thunderforest", Style: "outdoors", Reduce: 2, Scale: 2, Render: base.Render, Layers: base.Layers}, outputDirectory},
+		{"render and layers", Zone{Render: &RenderConfig{Profile: "mono"}, Layers: []LayerConfig{}},
+			MapConfig{Provider: "thunderforest", Style: "atlas", Reduce: 4, Scale: 2, Render: RenderConfig{Profile: "mono"}, Layers: []LayerConfig{}}, outputDirectory},
+		{"relative output", Zone{Output: "hiking"}, base, filepath.Join(outputDirectory, "hiking")},
+		{"absolute output", Zone{Output: "/media/sd"}, base, "/media/sd"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMeshtasticTileDownloader(Options{OutputDirectory: outputDirectory})
+			m.SetConfig(Config{Map: base})
+
+			restore := m.useZone(test.zone)
+			if !reflect.DeepEqual(m.config.Map, test.want) {
+				t.Errorf("map = %+v, want %+v", m.config.Map, test.want)
+			}
+			if want := filepath.Join(test.wantOutput, test.want.Provider, test.want.Style, "3", "1", "2.png"); m.TilePath(3, 1, 2) != want {
+				t.Errorf("tile path = %s, want %s", m.TilePath(3, 1, 2), want)
+			}
+
+			restore()
+			if !reflect.DeepEqual(m.config.Map, base) || m.outputDirectory != outputDirectory {
+				t.Errorf("restored map = %+v in %s, want %+v in %s", m.config.Map, m.outputDirectory, base, outputDirectory)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"image/color"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// String returns the source in provider/style notation
+func (s SourceConfig) String() string {
+	if s.Style == "" {
+		return s.Provider
+	}
+	return s.Provider + "/" + s.Style
+}
+
+// Sources returns the configured provider followed by its fallback sources, in order
+func (m *MeshtasticTileDownloader) Sources() []SourceConfig {
+	sources := []SourceConfig{{Provider: m.TileProvider(), Style: m.MapStyle()}}
+	return append(sources, m.config.Map.Fallback...)
+}
+
+// ProvidersInUse returns every provider tiles may be requested from, including
+// fallback sources, the providers of the zones, the overlay layers of the
+// map and of every zone, and the providers of a loaded plan
+func (m *MeshtasticTileDownloader) ProvidersInUse() []string {
+	var providers []string
+	seen := make(map[string]bool)
+	add := func(provider string) {
+		if !seen[provider] {
+			seen[provider] = true
+			providers = append(providers, provider)
+		}
+	}
+
+	for _, source := range m.Sources() {
+		add(source.Provider)
+	}
+	for _, layer := range m.config.Map.Layers {
+		add(layer.Provider)
+	}
+	for _, zone := range m.config.Zones {
+		if zone.Provider != "" {
+			add(zone.Provider)
+		}
+		for _, layer := range zone.Layers {
+			add(layer.Provider)
+		}
+	}
+	if m.plan != nil {
+		for _, job := range m.plan.Jobs {
+			add(job.Map.Provider)
+			for _, source := range job.Map.Fallback {
+				add(source.Provider)
+			}
+			for _, layer := range job.Map.Layers {
+				add(layer.Provider)
+			}
+		}
+	}
+	return providers
+}
+
+// useSource makes a source the active provider and style. The returned
+// function restores the previous ones.
+func (m *MeshtasticTileDownloader) useSource(source SourceConfig) (restore func()) {
+	provider, style := m.config.Map.Provider, m.config.Map.Style
+	m.config.Map.Provider, m.config.Map.Style = source.Provider, source.Style
+	return func() {
+		m.config.Map.Provider, m.config.Map.Style = provider, style
+	}
+}
+
+// NeedsStyle checks if the URL template of the active provider has a
+// {{MAP_STYLE}} placeholder
+func (m *MeshtasticTileDownloader) NeedsStyle() bool {
+	return m.ProviderType() == "xyz" && strings.Contains(NormalizeTemplate(m.ProviderURLTemplate()), "{{MAP_STYLE}}")
+}
+
+// ProviderRequiresAPIKey checks if a provider needs an API key
+func (m *MeshtasticTileDownloader) ProviderRequiresAPIKey(provider string) bool {
+	defer m.useSource(SourceConfig{Provider: provider})()
+	return m.RequiresAPIKey()
+}
+
+// APIKeyEnvVar returns the environment variable holding the API key of a provider
+func APIKeyEnvVar(provider string) string {
+	name := regexp.MustCompile(`[^A-Za-z0-9]+`).ReplaceAllString(provider, "_")
+	return strings.ToUpper(name + "_API_KEY")
+}
+
+// PrepareFallbackSources checks every fallback source can be used
+func (m *MeshtasticTileDownloader) PrepareFallbackSources(ctx context.Context) error {
+	for _, source := range m.config.Map.Fallback {
+		restore := m.useSource(source)
+		var err error
+		if !m.IsValidProvider() {
+			err = fmt.Errorf("fallback provider '%s' is unknown. Known: '%s'", source.Provider, strings.Join(m.KnownProviders(), ", "))
+		} else if source.Style == "" && m.NeedsStyle() {
+			err = fmt.Errorf("fallback provider '%s' needs a style", source.Provider)
+		} else if prepareErr := m.PrepareProvider(ctx); prepareErr != nil {
+			err = fmt.Errorf("fallback provider '%s' can't be used: %w", source.Provider, prepareErr)
+		}
+		restore()
+
+		if err != nil {
+			return err
+		}
+		slog.Info("Falling back to another source for missing or failing tiles", "source", source.String())
+	}
+	return nil
+}
+
+// FetchTileWithFallback requests a tile from each source in order until one
+// returns a tile that isn't blank. When every source fails the first error
+// is returned; when every tile is blank the first blank tile is kept.
+func (m *MeshtasticTileDownloader) FetchTileWithFallback(ctx context.Context, zoom, x, y int) ([]byte, string, SourceConfig, error) {
+	sources := m.Sources()
+
+	var firstErr error
+	var blankData []byte
+	var blankType string
+	var blankSource SourceConfig
+
+	for i, source := range sources {
+		restore := m.useSource(source)
+		url := m.ParseURL(zoom, x, y)
+		imgData, contentType, err := m.FetchTile(ctx, url, zoom, x, y)
+		redactedURL := m.RedactKey(url)
+		restore()
+
+		last := i == len(sources)-1
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, "", source, ctxErr
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if !last {
+				slog.Warn("Tile failed. Trying the next source", "tile", fmt.Sprintf("%d/%d/%d", zoom, x, y),
+					"source", source.String(), "error", m.RedactKey(err.Error()), "next_source", sources[i+1].String())
+			}
+			continue
+		}
+
+		// Without other sources there is nothing better to look for
+		if len(sources) == 1 || !m.IsBlankTile(imgData) {
+			return imgData, contentType, source, nil
+		}
+
+		if !last {
+			slog.Debug("Tile is blank. Trying the next source", "url", redactedURL, "next_source", sources[i+1].String())
+		}
+		if blankData == nil {
+			blankData, blankType, blankSource = imgData, contentType, source
+		}
+	}
+
+	if blankData != nil {
+		return blankData, blankType, blankSource, nil
+	}
+	return nil, "", SourceConfig{}, firstErr
+}
+
+// IsBlankTile checks if a tile is a single fully transparent, white or black
+// colour, which providers return for areas they don't cover
+func (m *MeshtasticTileDownloader) IsBlankTile(imgData []byte) bool {
+	img, err := m.LoadImageBytes(imgData)
+	if err != nil {
+		return false
+	}
+
+	bounds := img.Bounds()
+	first := color.NRGBAModel.Convert(img.At(bounds.Min.X, bounds.Min.Y)).(color.NRGBA)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c != first && !(c.A == 0 && first.A == 0) {
+				return false
+			}
+		}
+	}
+
+	white := first.R == 0xff && first.G == 0xff && first.B == 0xff
+	black := first.R == 0 && first.G == 0 && first.B == 0
+	return first.A == 0 || white || black
+}
@@ -0,0 +1,107 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// encodeTestTile encodes a tile of a single colour, with a red pixel unless blank
+func encodeTestTile(t *testing.T, background color.Color, blank bool) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+	for i := 0; i < tileSize*tileSize; i++ {
+		img.Set(i%tileSize, i/tileSize, background)
+	}
+	if !blank {
+		img.Set(10, 10, color.NRGBA{R: 0xff, A: 0xff})
+	}
+	var data bytes.Buffer
+	if err := png.Encode(&data, img); err != nil {
+		t.Fatal(err)
+	}
+	return data.Bytes()
+}
+
+func TestFetchTileWithFallback(t *testing.T) {
+	tiles := map[string][]byte{
+		"transparent": encodeTestTile(t, color.Transparent, true),
+		"white":       encodeTestTile(t, color.White, true),
+		"real":        encodeTestTile(t, color.White, false),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		data, ok := tiles[source]
+		if !ok {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	providers := make(map[string]ProviderConfig)
+	for _, source := range []string{"transparent", "white", "real", "error", "down"} {
+		providers[source] = ProviderConfig{URL: server.URL + "/" + source + "/{z}/{x}/{y}.png"}
+	}
+
+	tests := []struct {
+		name    string
+		sources []string
+		want    string // source of the tile kept, empty for an error
+	}{
+		{"real tile after blank and failing sources", []string{"transparent", "error", "real"}, "real"},
+		{"first blank tile when every tile is blank", []string{"transparent", "error", "white"}, "transparent"},
+		{"blank tile when the last source fails", []string{"error", "white", "down"}, "white"},
+		{"first error when every source fails", []string{"error", "down"}, ""},
+		{"blank tile without fallback sources", []string{"white"}, "white"},
+	}
+	for _, test := range tests {
+		var fallback []SourceConfig
+		for _, source := range test.sources[1:] {
+			fallback = append(fallback, SourceConfig{Provider: source})
+		}
+		m := NewMeshtasticTileDownloader(Options{})
+		m.SetConfig(Config{Map: MapConfig{Provider: test.sources[0], Fallback: fallback}, Providers: providers})
+
+		data, _, source, err := m.FetchTileWithFallback(context.Background(), 1, 0, 0)
+		if test.want == "" {
+			if err == nil || !strings.Contains(err.Error(), "503") {
+				t.Errorf("%s: error = %v, want the 503 of the first source", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if source.Provider != test.want || !bytes.Equal(data, tiles[test.want]) {
+			t.Errorf("%s: kept the tile of %s, want %s", test.name, source.Provider, test.want)
+		}
+	}
+}
+
+func TestPrepareFallbackSourcesStyle(t *testing.T) {
+	tests := []struct {
+		source SourceConfig
+		valid  bool
+	}{
+		{SourceConfig{Provider: "thunderforest", Style: "outdoors"}, true},
+		{SourceConfig{Provider: "thunderforest"}, false}, // its URL has a style placeholder
+		{SourceConfig{Provider: "cnig.es"}, true},
+	}
+	for _, test := range tests {
+		m := NewMeshtasticTileDownloader(Options{})
+		m.SetConfig(Config{Map: MapConfig{Provider: "geoapify", Style: "osm-bright", Fallback: []SourceConfig{test.source}}})
+		if err := m.PrepareFallbackSources(context.Background()); (err == nil) != test.valid {
+			t.Errorf("%s: error = %v, want valid: %v", test.source, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package downloader
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// bundledGazetteer lists countries, regions and towns of the Iberian
+// communities, so common places resolve without any gazetteer file
+//
+//go:embed gazetteer.csv
+var bundledGazetteer []byte
+
+// Place is a named place of the gazetteer
+type Place struct {
+	Name       string
+	Alternates []string
+	Country    string  // ISO 3166-1 alpha-2 code, if known
+	Point              // centroid
+	Bounds     *Region // bounding box, if known
+	Population int
+}
+
+// String returns the place with its country and centroid
+func (p Place) String() string {
+	if p.Country == "" {
+		return fmt.Sprintf("%s (%.4f,%.4f)", p.Name, p.Lat, p.Long)
+	}
+	return fmt.Sprintf("%s, %s (%.4f,%.4f)", p.Name, p.Country, p.Lat, p.Long)
+}
+
+// Gazetteer resolves place names to coordinates without network access
+type Gazetteer struct {
+	places []Place
+}
+
+// PlaceMatch is a place matching a query, with the edit distance between
+// the query and the closest of its names (0 for an exact match)
+type PlaceMatch struct {
+	Place
+	Distance int
+}
+
+// LoadGazetteer reads the bundled gazetteer followed by the given files.
+// Files are CSV with a header row, or GeoNames tab-separated dumps.
+func LoadGazetteer(files []string) (*Gazetteer, error) {
+	places, err := parseGazetteerCSV(bundledGazetteer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bundled gazetteer: %w", err)
+	}
+	g := &Gazetteer{places: places}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gazetteer: %w", err)
+		}
+
+		var places []Place
+		firstLine, _, _ := bytes.Cut(data, []byte("\n"))
+		if bytes.Count(firstLine, []byte("\t")) >= 14 {
+			places, err = parseGeoNames(data)
+		} else {
+			places, err = parseGazetteerCSV(data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse gazetteer %s: %w", file, err)
+		}
+		slog.Info("Loaded gazetteer", "places", len(places), "file", file)
+
+		// Places of the user files take precedence over the bundled ones
+		g.places = append(places, g.places...)
+	}
+	return g, nil
+}
+
+// parseGazetteerCSV reads a CSV gazetteer. The header names the columns:
+// name, latitude and longitude are required; alternates (separated by |),
+// country, north, south, east, west and population are optional.
+func parseGazetteerCSV(data []byte) ([]Place, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("missing CSV header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		switch column {
+		case "lat":
+			column = "latitude"
+		case "lon", "long", "lng":
+			column = "longitude"
+		}
+		columns[column] = i
+	}
+	for _, required := range []string{"name", "latitude", "longitude"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("CSV header needs a %s column", required)
+		}
+	}
+
+	var places []Place
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		place := Place{Name: field("name"), Country: strings.ToUpper(field("country"))}
+		if place.Lat, err = strconv.ParseFloat(field("latitude"), 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid latitude: %w", line, err)
+		}
+		if place.Long, err = strconv.ParseFloat(field("longitude"), 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid longitude: %w", line, err)
+		}
+		if alternates := field("alternates"); alternates != "" {
+			place.Alternates = strings.Split(alternates, "|")
+		}
+		if population := field("population"); population != "" {
+			place.Population, _ = strconv.Atoi(population)
+		}
+
+		if north := field("north"); north != "" {
+			var bounds [4]float64
+			for i, column := range []string{"north", "south", "east", "west"} {
+				if bounds[i], err = strconv.ParseFloat(field(column), 64); err != nil {
+					return nil, fmt.Errorf("line %d: invalid %s bound: %w", line, column, err)
+				}
+			}
+			place.Bounds = &Region{MinLat: bounds[1], MinLon: bounds[3], MaxLat: bounds[0], MaxLon: bounds[2]}
+		}
+		places = append(places, place)
+	}
+	return places, nil
+}
+
+// parseGeoNames reads a GeoNames dump, such as cities500.txt or ES.txt
+func parseGeoNames(data []byte) ([]Place, error) {
+	var places []Place
+	for line, text := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) < 15 {
+			return nil, fmt.Errorf("line %d: expected 19 tab-separated columns", line+1)
+		}
+
+		place := Place{Name: fields[1], Country: fields[8]}
+		var err error
+		if place.Lat, err = strconv.ParseFloat(fields[4], 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid latitude: %w", line+1, err)
+		}
+		if place.Long, err = strconv.ParseFloat(fields[5], 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid longitude: %w", line+1, err)
+		}
+		if fields[2] != "" && fields[2] != fields[1] {
+			place.Alternates = append(place.Alternates, fields[2])
+		}
+		if fields[3] != "" {
+			place.Alternates = append(place.Alternates, strings.Split(fields[3], ",")...)
+		}
+		place.Population, _ = strconv.Atoi(fields[14])
+		places = append(places, place)
+	}
+	return places, nil
+}
+
+// Lookup returns the places matching a query, best first. A query written as
+// "name, CC" only matches places of that country. Names match regardless of
+// case and accents, and small typos are tolerated.
+func (g *Gazetteer) Lookup(query string) []PlaceMatch {
+	name, _, _ := strings.Cut(query, ",")
+	return g.Nearest(query, max(len(foldPlaceName(name))/3, 1))
+}
+
+// Nearest returns the places whose names are within an edit distance of the
+// query, best first
+func (g *Gazetteer) Nearest(query string, maxDistance int) []PlaceMatch {
+	name, country, _ := strings.Cut(query, ",")
+	name = foldPlaceName(name)
+	country = strings.ToUpper(strings.TrimSpace(country))
+
+	var matches []PlaceMatch
+	for _, place := range g.places {
+		if country != "" && place.Country != country {
+			continue
+		}
+
+		distance := -1
+		for _, candidate := range append([]string{place.Name}, place.Alternates...) {
+			candidate = foldPlaceName(candidate)
+			d := levenshtein(name, candidate)
+			if d > 0 && len(name) >= 3 && strings.HasPrefix(candidate, name+" ") {
+				d = 1 // "Santiago" for "Santiago de Compostela"
+			}
+			if distance == -1 || d < distance {
+				distance = d
+			}
+		}
+		if distance <= maxDistance {
+			matches = append(matches, PlaceMatch{Place: place, Distance: distance})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].Population > matches[j].Population
+	})
+	return matches
+}
+
+// Gazetteer returns the gazetteer, loading it on first use
+func (m *MeshtasticTileDownloader) Gazetteer() (*Gazetteer, error) {
+	if m.gazetteer == nil {
+		gazetteer, err := LoadGazetteer(m.config.Gazetteer)
+		if err != nil {
+			return nil, err
+		}
+		m.gazetteer = gazetteer
+	}
+	return m.gazetteer, nil
+}
+
+// ResolvePlace returns the best place matching a name, and logs the other
+// candidates when the name is ambiguous or misspelled
+func (m *MeshtasticTileDownloader) ResolvePlace(query string) (Place, error) {
+	gazetteer, err := m.Gazetteer()
+	if err != nil {
+		return Place{}, err
+	}
+
+	matches := gazetteer.Lookup(query)
+	if len(matches) == 0 {
+		var closest []string
+		for _, match := range gazetteer.Nearest(query, len(query)) {
+			if len(closest) == 3 {
+				break
+			}
+			closest = append(closest, match.Place.String())
+		}
+		if len(closest) == 0 {
+			return Place{}, fmt.Errorf("place '%s' is not in the gazetteer. Add it with a gazetteer file", query)
+		}
+		return Place{}, fmt.Errorf("place '%s' is not in the gazetteer. Closest: %s. Add it with a gazetteer file", query, strings.Join(closest, "; "))
+	}
+
+	best := matches[0]
+	if best.Distance > 0 {
+		slog.Warn("Place not found, using the closest match", "place", query, "match", best.Place.String())
+	}
+	var others []string
+	var otherCountry string
+	for _, match := range matches[1:] {
+		if match.Distance == best.Distance && len(others) < 5 {
+			others = append(others, match.Place.String())
+			if otherCountry == "" && match.Country != best.Country {
+				otherCountry = match.Country
+			}
+		}
+	}
+	if len(others) > 0 {
+		hint := "Write a more specific name to choose another"
+		if otherCountry != "" {
+			name, _, _ := strings.Cut(query, ",")
+			hint = fmt.Sprintf("Add the country code, as in '%s, %s', to choose another", strings.TrimSpace(name), otherCountry)
+		}
+		slog.Warn("Place is ambiguous, using the best match", "place", query, "match", best.Place.String(),
+			"other_candidates", strings.Join(others, "; "), "hint", hint)
+	}
+	return best.Place, nil
+}
+
+// placeNameFolds removes the accents of the Latin letters used in place names
+var placeNameFolds = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ä", "a", "ã", "a", "å", "a",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ô", "o", "ö", "o", "õ", "o",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u",
+	"ñ", "n", "ç", "c", "-", " ", "'", "", ".", "",
+)
+
+// foldPlaceName normalizes a place name for comparison
+func foldPlaceName(name string) string {
+	name = placeNameFolds.Replace(strings.ToLower(name))
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// levenshtein returns the edit distance between two strings
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
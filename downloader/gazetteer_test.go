@@ -0,0 +1,101 @@
+package downloader
+
+import "testing"
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"vigo", "", 4},
+		{"", "vigo", 4},
+		{"vigo", "vigo", 0},
+		{"kitten", "sitting", 3},
+		{"flaw", "lawn", 2},
+		{"coruña", "coruna", 1}, // runes, not bytes
+		{"leon", "león", 1},
+	}
+	for _, test := range tests {
+		if got := levenshtein(test.a, test.b); got != test.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestFoldPlaceName(t *testing.T) {
+	tests := map[string]string{
+		"A Coruña":                "a coruna",
+		"  Vilagarcía  de Arousa": "vilagarcia de arousa",
+		"Sant Feliu-de-Guíxols":   "sant feliu de guixols",
+		"L'Hospitalet":            "lhospitalet",
+	}
+	for name, want := range tests {
+		if got := foldPlaceName(name); got != want {
+			t.Errorf("foldPlaceName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestGazetteerLookup(t *testing.T) {
+	places, err := parseGazetteerCSV([]byte(`name,alternates,country,latitude,longitude,population
+Valencia,València,ES,39.47,-0.38,800000
+Valencia,,VE,10.16,-68.00,1500000
+Santiago de Compostela,,ES,42.88,-8.54,97000
+Vigo,,ES,42.23,-8.71,293000
+A Coruña,La Coruña|Corunna,ES,43.36,-8.41,245000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Gazetteer{places: places}
+
+	tests := []struct {
+		query    string
+		want     []string // countries of the matches, best first
+		distance int      // of the best match
+	}{
+		{"Vigo", []string{"ES"}, 0},
+		{"vigo", []string{"ES"}, 0},
+		{"Vgo", []string{"ES"}, 1},
+		{"Valencia", []string{"VE", "ES"}, 0}, // ties go to the most populated place
+		{"Valencia, ES", []string{"ES"}, 0},
+		{"valencia, es", []string{"ES"}, 0},
+		{"València", []string{"VE", "ES"}, 0},
+		{"La Coruna", []string{"ES"}, 0},
+		{"Santiago", []string{"ES"}, 1},
+		{"Valencia, FR", nil, 0},
+		{"Madrid", nil, 0},
+	}
+	for _, test := range tests {
+		matches := g.Lookup(test.query)
+		var countries []string
+		for _, match := range matches {
+			countries = append(countries, match.Country)
+		}
+		if len(countries) != len(test.want) {
+			t.Errorf("Lookup(%q) = %v, want places of %v", test.query, matches, test.want)
+			continue
+		}
+		for i := range countries {
+			if countries[i] != test.want[i] {
+				t.Errorf("Lookup(%q) = %v, want places of %v", test.query, matches, test.want)
+				break
+			}
+		}
+		if len(matches) > 0 && matches[0].Distance != test.distance {
+			t.Errorf("Lookup(%q) best distance = %d, want %d", test.query, matches[0].Distance, test.distance)
+		}
+	}
+}
+
+func TestBundledGazetteer(t *testing.T) {
+	g, err := LoadGazetteer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches := g.Lookup("Coruña")
+	if len(matches) == 0 || matches[0].Name != "A Coruña" || matches[0].Bounds == nil {
+		t.Fatalf("Lookup(Coruña) = %v, want A Coruña with its bounds", matches)
+	}
+}
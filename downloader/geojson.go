@@ -0,0 +1,198 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// Feature is a GeoJSON feature reduced to what the downloader uses.
+// Coordinates are [longitude, latitude] pairs, as in GeoJSON.
+type Feature struct {
+	Points     [][2]float64     // Point and MultiPoint geometries
+	Lines      [][][2]float64   // LineString and MultiLineString geometries
+	Polygons   [][][][2]float64 // Polygon and MultiPolygon geometries, as rings
+	Properties map[string]any
+}
+
+// geoJSONObject covers the fields of every GeoJSON object type
+type geoJSONObject struct {
+	Type        string          `json:"type"`
+	Features    []geoJSONObject `json:"features"`
+	Geometry    *geoJSONObject  `json:"geometry"`
+	Geometries  []geoJSONObject `json:"geometries"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Properties  map[string]any  `json:"properties"`
+}
+
+// LoadGeoJSON reads the features of a GeoJSON file. Bare geometries are
+// returned as features without properties.
+func LoadGeoJSON(path string) ([]Feature, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GeoJSON file: %w", err)
+	}
+
+	var object geoJSONObject
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, fmt.Errorf("failed to parse GeoJSON file %s: %w", path, err)
+	}
+
+	var features []Feature
+	if err := collectFeatures(object, &features); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON file %s: %w", path, err)
+	}
+	return features, nil
+}
+
+// collectFeatures appends the features found in a GeoJSON object
+func collectFeatures(object geoJSONObject, features *[]Feature) error {
+	switch object.Type {
+	case "FeatureCollection":
+		for _, child := range object.Features {
+			if err := collectFeatures(child, features); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "Feature":
+		feature := Feature{Properties: object.Properties}
+		if object.Geometry != nil {
+			if err := addGeometry(*object.Geometry, &feature); err != nil {
+				return err
+			}
+		}
+		*features = append(*features, feature)
+		return nil
+	default:
+		var feature Feature
+		if err := addGeometry(object, &feature); err != nil {
+			return err
+		}
+		*features = append(*features, feature)
+		return nil
+	}
+}
+
+// addGeometry adds the coordinates of a GeoJSON geometry to a feature
+func addGeometry(geometry geoJSONObject, feature *Feature) error {
+	var err error
+	switch geometry.Type {
+	case "Point":
+		var point [2]float64
+		if err = unmarshalPosition(geometry.Coordinates, &point); err == nil {
+			feature.Points = append(feature.Points, point)
+		}
+	case "MultiPoint":
+		var points [][2]float64
+		if err = unmarshalPositions(geometry.Coordinates, &points); err == nil {
+			feature.Points = append(feature.Points, points...)
+		}
+	case "LineString":
+		var line [][2]float64
+		if err = unmarshalPositions(geometry.Coordinates, &line); err == nil {
+			feature.Lines = append(feature.Lines, line)
+		}
+	case "MultiLineString":
+		var lines [][][2]float64
+		if err = unmarshalPositions(geometry.Coordinates, &lines); err == nil {
+			feature.Lines = append(feature.Lines, lines...)
+		}
+	case "Polygon":
+		var polygon [][][2]float64
+		if err = unmarshalPositions(geometry.Coordinates, &polygon); err == nil {
+			feature.Polygons = append(feature.Polygons, polygon)
+		}
+	case "MultiPolygon":
+		var polygons [][][][2]float64
+		if err = unmarshalPositions(geometry.Coordinates, &polygons); err == nil {
+			feature.Polygons = append(feature.Polygons, polygons...)
+		}
+	case "GeometryCollection":
+		for _, child := range geometry.Geometries {
+			if err := addGeometry(child, feature); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported geometry type '%s'", geometry.Type)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid %s coordinates: %w", geometry.Type, err)
+	}
+	return nil
+}
+
+// unmarshalPosition decodes a single position, ignoring any altitude
+func unmarshalPosition(data json.RawMessage, position *[2]float64) error {
+	var values []float64
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	if len(values) < 2 {
+		return fmt.Errorf("positions need a longitude and a latitude")
+	}
+	position[0], position[1] = values[0], values[1]
+	return nil
+}
+
+// unmarshalPositions decodes nested position arrays, ignoring any altitude
+func unmarshalPositions(data json.RawMessage, target any) error {
+	var raw any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	trimmed, err := json.Marshal(trimAltitudes(raw))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(trimmed, target)
+}
+
+// trimAltitudes drops the third and further values of every position
+func trimAltitudes(value any) any {
+	list, ok := value.([]any)
+	if !ok {
+		return value
+	}
+	if len(list) > 2 {
+		if _, isNumber := list[0].(float64); isNumber {
+			return list[:2]
+		}
+	}
+	for i := range list {
+		list[i] = trimAltitudes(list[i])
+	}
+	return list
+}
+
+// Bounds returns the bounding box of every coordinate of the feature
+func (f Feature) Bounds() (minLat, minLon, maxLat, maxLon float64, ok bool) {
+	minLat, minLon = math.Inf(1), math.Inf(1)
+	maxLat, maxLon = math.Inf(-1), math.Inf(-1)
+
+	add := func(position [2]float64) {
+		minLon, maxLon = math.Min(minLon, position[0]), math.Max(maxLon, position[0])
+		minLat, maxLat = math.Min(minLat, position[1]), math.Max(maxLat, position[1])
+		ok = true
+	}
+
+	for _, point := range f.Points {
+		add(point)
+	}
+	for _, line := range f.Lines {
+		for _, position := range line {
+			add(position)
+		}
+	}
+	for _, polygon := range f.Polygons {
+		for _, ring := range polygon {
+			for _, position := range ring {
+				add(position)
+			}
+		}
+	}
+	return minLat, minLon, maxLat, maxLon, ok
+}
@@ -0,0 +1,180 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// LayerConfig is an overlay source composited onto the base map
+type LayerConfig struct {
+	SourceConfig `yaml:",inline"`
+	Opacity      float64 `yaml:"opacity"` // 0 to 1 (default: 1)
+	Blend        string  `yaml:"blend"`   // normal (default), multiply, screen or overlay
+}
+
+// errNoLayerData is returned for overlay tiles the provider has no data for
+var errNoLayerData = errors.New("no data for this tile")
+
+// KnownBlendModes returns the supported layer blend modes
+func KnownBlendModes() []string {
+	return []string{"normal", "multiply", "screen", "overlay"}
+}
+
+// blendChannel combines a base and a layer channel value in [0, 1]
+func blendChannel(mode string, base, layer float64) float64 {
+	switch mode {
+	case "multiply":
+		return base * layer
+	case "screen":
+		return base + layer - base*layer
+	case "overlay":
+		if base <= 0.5 {
+			return 2 * base * layer
+		}
+		return 1 - 2*(1-base)*(1-layer)
+	default:
+		return layer
+	}
+}
+
+// PrepareLayers checks every layer can be used
+func (m *MeshtasticTileDownloader) PrepareLayers(ctx context.Context, layers []LayerConfig) error {
+	for _, layer := range layers {
+		if err := m.ValidateLayer(layer); err != nil {
+			return err
+		}
+
+		restore := m.useSource(layer.SourceConfig)
+		err := m.PrepareProvider(ctx)
+		restore()
+
+		if err != nil {
+			return fmt.Errorf("layer provider '%s' can't be used: %w", layer.Provider, err)
+		}
+	}
+	return nil
+}
+
+// ValidateLayer checks the settings of a layer without contacting its provider
+func (m *MeshtasticTileDownloader) ValidateLayer(layer LayerConfig) error {
+	if layer.Opacity < 0 || layer.Opacity > 1 {
+		return fmt.Errorf("layer %s: opacity must be between 0 and 1", layer.SourceConfig)
+	}
+	knownBlend := layer.Blend == ""
+	for _, mode := range KnownBlendModes() {
+		knownBlend = knownBlend || layer.Blend == mode
+	}
+	if !knownBlend {
+		return fmt.Errorf("layer %s: blend mode '%s' is unknown. Known: %s", layer.SourceConfig, layer.Blend, strings.Join(KnownBlendModes(), ", "))
+	}
+
+	defer m.useSource(layer.SourceConfig)()
+	if !m.IsValidProvider() {
+		return fmt.Errorf("layer provider '%s' is unknown. Known: '%s'", layer.Provider, strings.Join(m.KnownProviders(), ", "))
+	}
+	return nil
+}
+
+// FetchLayer requests the tile of an overlay layer
+func (m *MeshtasticTileDownloader) FetchLayer(ctx context.Context, layer LayerConfig, zoom, x, y int) (image.Image, error) {
+	defer m.useSource(layer.SourceConfig)()
+
+	url := m.ParseURL(zoom, x, y)
+	imgData, _, err := m.FetchTile(ctx, url, zoom, x, y)
+	if err != nil {
+		// Overlay servers usually answer 404 where they have nothing to draw
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return nil, errNoLayerData
+		}
+		return nil, err
+	}
+	return m.LoadImageBytes(imgData)
+}
+
+// ComposeLayers fetches every overlay layer of a tile and alpha-composites them
+// onto the base tile, returning the result as PNG data
+func (m *MeshtasticTileDownloader) ComposeLayers(ctx context.Context, imgData []byte, zoom, x, y int) ([]byte, error) {
+	base, err := m.LoadImageBytes(imgData)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := base.Bounds()
+	canvas := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(canvas, canvas.Bounds(), base, bounds.Min, draw.Src)
+
+	for _, layer := range m.config.Map.Layers {
+		overlay, err := m.FetchLayer(ctx, layer, zoom, x, y)
+		if errors.Is(err, errNoLayerData) {
+			slog.Debug("Layer has no data for tile", "layer", layer.SourceConfig.String(), "tile", fmt.Sprintf("%d/%d/%d", zoom, x, y))
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %w", layer.SourceConfig, err)
+		}
+		compositeLayer(canvas, overlay, layer)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return nil, fmt.Errorf("failed to encode composited tile: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// compositeLayer blends an overlay onto the canvas following the W3C
+// compositing model, scaling the overlay to the canvas size when needed
+func compositeLayer(canvas *image.NRGBA, overlay image.Image, layer LayerConfig) {
+	if overlay.Bounds().Dx() != canvas.Bounds().Dx() || overlay.Bounds().Dy() != canvas.Bounds().Dy() {
+		scaled := image.NewNRGBA(canvas.Bounds())
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), overlay, overlay.Bounds(), draw.Src, nil)
+		overlay = scaled
+	}
+
+	opacity := layer.Opacity
+	if opacity == 0 {
+		opacity = 1
+	}
+
+	bounds := canvas.Bounds()
+	offset := overlay.Bounds().Min
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			b := canvas.NRGBAAt(x, y)
+			l := color.NRGBAModel.Convert(overlay.At(x+offset.X, y+offset.Y)).(color.NRGBA)
+
+			sourceAlpha := float64(l.A) / 255 * opacity
+			if sourceAlpha == 0 {
+				continue
+			}
+			baseAlpha := float64(b.A) / 255
+			outAlpha := sourceAlpha + baseAlpha*(1-sourceAlpha)
+
+			channel := func(bc, lc uint8) uint8 {
+				cb, cs := float64(bc)/255, float64(lc)/255
+				mixed := (1-baseAlpha)*cs + baseAlpha*blendChannel(layer.Blend, cb, cs)
+				out := (sourceAlpha*mixed + baseAlpha*cb*(1-sourceAlpha)) / outAlpha
+				return uint8(math.Round(math.Max(0, math.Min(1, out)) * 255))
+			}
+
+			canvas.SetNRGBA(x, y, color.NRGBA{
+				R: channel(b.R, l.R),
+				G: channel(b.G, l.G),
+				B: channel(b.B, l.B),
+				A: uint8(math.Round(outAlpha * 255)),
+			})
+		}
+	}
+}
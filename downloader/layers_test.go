@@ -0,0 +1,36 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchLayerMissingTiles(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/1/0/0.png":
+			http.NotFound(w, r)
+		default:
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	m := NewMeshtasticTileDownloader(Options{})
+	m.SetConfig(Config{Providers: map[string]ProviderConfig{"overlay": {URL: server.URL + "/{z}/{x}/{y}.png"}}})
+	layer := LayerConfig{SourceConfig: SourceConfig{Provider: "overlay"}}
+
+	// A 404 means the overlay has nothing to draw on the tile
+	if _, err := m.FetchLayer(context.Background(), layer, 1, 0, 0); !errors.Is(err, errNoLayerData) {
+		t.Errorf("404 error = %v, want errNoLayerData", err)
+	}
+
+	var statusErr *StatusError
+	_, err := m.FetchLayer(context.Background(), layer, 1, 1, 0)
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("503 error = %v, want the status error", err)
+	}
+}
@@ -0,0 +1,98 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// TileInfo describes how a stored tile was produced
+type TileInfo struct {
+	Source      string `json:"source,omitempty"`      // provider/style the tile was downloaded from
+	Synthesized string `json:"synthesized,omitempty"` // "overzoom" or "downsample" when built locally
+	From        string `json:"from,omitempty"`        // z/x/y of the tile it was upscaled from
+	Annotated   bool   `json:"annotated,omitempty"`   // annotations were drawn onto the tile
+}
+
+// Merge returns the tile information updated with the fields set in other
+func (t TileInfo) Merge(other TileInfo) TileInfo {
+	if other.Source != "" {
+		t.Source = other.Source
+	}
+	if other.Synthesized != "" {
+		t.Synthesized, t.From = other.Synthesized, other.From
+	}
+	t.Annotated = t.Annotated || other.Annotated
+	return t
+}
+
+// TileMetadata is the content of the tile metadata file
+type TileMetadata struct {
+	Tiles map[string]TileInfo `json:"tiles"`
+}
+
+// TileMetadataPath returns the path of the tile metadata file
+func (m *MeshtasticTileDownloader) TileMetadataPath() string {
+	return filepath.Join(m.outputDirectory, "tiles.json")
+}
+
+// TileKey returns the key of a tile in the metadata file: its path relative to the output directory
+func (m *MeshtasticTileDownloader) TileKey(zoom, x, y int) string {
+	key, err := filepath.Rel(m.outputDirectory, m.TilePath(zoom, x, y))
+	if err != nil {
+		key = m.TilePath(zoom, x, y)
+	}
+	return filepath.ToSlash(key)
+}
+
+// RecordTile remembers how a tile was produced until the metadata is saved
+func (m *MeshtasticTileDownloader) RecordTile(zoom, x, y int, info TileInfo) {
+	if m.tileMetadata == nil {
+		m.tileMetadata = make(map[string]TileInfo)
+	}
+
+	key := m.TileKey(zoom, x, y)
+	m.tileMetadata[key] = m.tileMetadata[key].Merge(info)
+}
+
+// LoadTileMetadata returns the stored tile metadata, including the tiles recorded but not saved yet
+func (m *MeshtasticTileDownloader) LoadTileMetadata() (map[string]TileInfo, error) {
+	metadata := TileMetadata{Tiles: make(map[string]TileInfo)}
+	if data, err := os.ReadFile(m.TileMetadataPath()); err == nil {
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to parse tile metadata: %w", err)
+		}
+		if metadata.Tiles == nil {
+			metadata.Tiles = make(map[string]TileInfo)
+		}
+	}
+
+	for key, info := range m.tileMetadata {
+		metadata.Tiles[key] = metadata.Tiles[key].Merge(info)
+	}
+	return metadata.Tiles, nil
+}
+
+// SaveTileMetadata merges the recorded tiles into the tile metadata file
+func (m *MeshtasticTileDownloader) SaveTileMetadata() error {
+	if len(m.tileMetadata) == 0 {
+		return nil
+	}
+
+	tiles, err := m.LoadTileMetadata()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(TileMetadata{Tiles: tiles}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode tile metadata: %w", err)
+	}
+	if err := os.WriteFile(m.TileMetadataPath(), data, 0644); err != nil {
+		return fmt.Errorf("failed to write tile metadata: %w", err)
+	}
+
+	m.tileMetadata = nil
+	return nil
+}
@@ -0,0 +1,198 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestDurationBuckets are the upper bounds in seconds of the request latency histogram
+var requestDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics counts the tiles and provider requests of runs, and serves them in
+// the Prometheus text format. A nil Metrics counts nothing.
+type Metrics struct {
+	mu              sync.Mutex
+	tilesPlanned    *metricVec
+	tiles           *metricVec
+	bytesWritten    *metricVec
+	responses       *metricVec
+	requestDuration *metricVec
+	rateLimitUntil  time.Time
+}
+
+// NewMetrics creates empty metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		tilesPlanned: newMetricVec("meshtastic_tiles_planned_total",
+			"Tiles requested from the providers or already stored, planned by the downloads", "provider", "zoom"),
+		tiles: newMetricVec("meshtastic_tiles_total",
+			"Tiles of the downloads by result: downloaded, skipped (already stored) or failed", "provider", "zoom", "result"),
+		bytesWritten: newMetricVec("meshtastic_bytes_written_total",
+			"Bytes of the downloaded tiles written to disk", "provider"),
+		responses: newMetricVec("meshtastic_http_responses_total",
+			"HTTP responses of the providers by status code", "provider", "code"),
+		requestDuration: newMetricVec("meshtastic_http_request_duration_seconds",
+			"Time taken by the providers to answer tile requests", "provider"),
+	}
+}
+
+// metricVec is a metric with a value, or a histogram, for every combination of label values
+type metricVec struct {
+	name       string
+	help       string
+	labels     []string
+	values     map[string]float64
+	histograms map[string]*histogram
+}
+
+// histogram counts observations in cumulative buckets
+type histogram struct {
+	counts []uint64 // observations up to each bucket bound
+	count  uint64
+	sum    float64
+}
+
+func newMetricVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{
+		name:       name,
+		help:       help,
+		labels:     labels,
+		values:     make(map[string]float64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+// key joins label values into a map key
+func (v *metricVec) key(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func (v *metricVec) add(value float64, labelValues ...string) {
+	v.values[v.key(labelValues)] += value
+}
+
+func (v *metricVec) observe(value float64, labelValues ...string) {
+	key := v.key(labelValues)
+	h, ok := v.histograms[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(requestDurationBuckets))}
+		v.histograms[key] = h
+	}
+	for i, bound := range requestDurationBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// labelPairs formats the labels of a key, with extra name and value pairs appended
+func (v *metricVec) labelPairs(key string, extra ...string) string {
+	var pairs []string
+	for i, value := range strings.Split(key, "\xff") {
+		if i < len(v.labels) {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", v.labels[i], value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (v *metricVec) write(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, kind)
+	for _, key := range slices.Sorted(maps.Keys(v.values)) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelPairs(key), formatValue(v.values[key]))
+	}
+	for _, key := range slices.Sorted(maps.Keys(v.histograms)) {
+		h := v.histograms[key]
+		for i, bound := range requestDurationBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelPairs(key, "le", formatValue(bound)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelPairs(key, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, v.labelPairs(key), formatValue(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, v.labelPairs(key), h.count)
+	}
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// tilesPlannedAt counts the tiles a download plans
+func (m *Metrics) tilesPlannedAt(provider string, tiles []TileCoord) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, tile := range tiles {
+		m.tilesPlanned.add(1, provider, strconv.Itoa(tile.Zoom))
+	}
+}
+
+// tileResult counts a tile of a download by result, with the bytes written for it
+func (m *Metrics) tileResult(provider string, tile TileCoord, result string, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tiles.add(1, provider, strconv.Itoa(tile.Zoom), result)
+	if bytes > 0 {
+		m.bytesWritten.add(float64(bytes), provider)
+	}
+}
+
+// response counts a response of a provider and the time it took
+func (m *Metrics) response(provider string, statusCode int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.responses.add(1, provider, strconv.Itoa(statusCode))
+	m.requestDuration.observe(duration.Seconds(), provider)
+}
+
+// rateLimitWait reports a wait for a rate limit of a provider ending at the given time
+func (m *Metrics) rateLimitWait(until time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rateLimitUntil = until
+}
+
+// Write writes the metrics in the Prometheus text format
+func (m *Metrics) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tilesPlanned.write(w, "counter")
+	m.tiles.write(w, "counter")
+	m.bytesWritten.write(w, "counter")
+	m.responses.write(w, "counter")
+	m.requestDuration.write(w, "histogram")
+
+	wait := max(time.Until(m.rateLimitUntil), 0)
+	fmt.Fprintf(w, "# HELP meshtastic_rate_limit_wait_seconds Time left waiting for a provider rate limit before retrying\n")
+	fmt.Fprintf(w, "# TYPE meshtastic_rate_limit_wait_seconds gauge\n")
+	fmt.Fprintf(w, "meshtastic_rate_limit_wait_seconds %s\n", formatValue(wait.Seconds()))
+}
+
+// ServeHTTP serves the metrics to Prometheus
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.Write(w)
+}
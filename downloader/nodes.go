@@ -0,0 +1,263 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NodesConfig covers the surroundings of every node of a Meshtastic node
+// database export, as in point-radius mode
+type NodesConfig struct {
+	File     string  `yaml:"file"`      // JSON from `meshtastic --info`, or CSV of node positions
+	RadiusKm float64 `yaml:"radius_km"` // radius around each node (default: 10)
+	Detail   int     `yaml:"detail"`    // detail level 1-4 setting the zone zoom levels (default: the zone zoom)
+}
+
+// NodePosition is the last known position of a Meshtastic node
+type NodePosition struct {
+	Name string
+	Point
+}
+
+// meshtasticNode covers the node fields of the `meshtastic --info` and
+// `meshtastic --export-config` JSON outputs
+type meshtasticNode struct {
+	Num  json.Number `json:"num"`
+	User struct {
+		ID        string `json:"id"`
+		LongName  string `json:"longName"`
+		ShortName string `json:"shortName"`
+	} `json:"user"`
+	Position struct {
+		Latitude   *float64 `json:"latitude"`
+		Longitude  *float64 `json:"longitude"`
+		LatitudeI  *int64   `json:"latitudeI"`
+		LongitudeI *int64   `json:"longitudeI"`
+	} `json:"position"`
+}
+
+// nodesHeader precedes the node database in the `meshtastic --info` output
+const nodesHeader = "Nodes in mesh:"
+
+// AddNodeCoverage appends a region around every node with a position to the
+// zone, and sets its zoom levels from the detail level when there is one
+func (m *MeshtasticTileDownloader) AddNodeCoverage(zoneName string, zone *Zone) error {
+	nodes := zone.Nodes
+	if nodes.File == "" {
+		return fmt.Errorf("nodes file is required")
+	}
+	if nodes.RadiusKm < 0 {
+		return fmt.Errorf("invalid nodes radius: %f km", nodes.RadiusKm)
+	}
+	if nodes.RadiusKm == 0 {
+		nodes.RadiusKm = 10
+	}
+	if nodes.Detail < 0 || nodes.Detail > 4 {
+		return fmt.Errorf("invalid nodes detail level: %d (valid: 1-4)", nodes.Detail)
+	}
+
+	positions, skipped, err := LoadNodePositions(nodes.File)
+	if err != nil {
+		return err
+	}
+	if len(positions) == 0 {
+		return fmt.Errorf("no node with a position in %s", nodes.File)
+	}
+	slog.Info("Loaded nodes", "zone", zoneName, "nodes", len(positions), "file", nodes.File,
+		"skipped_without_position", skipped, "radius_km", nodes.RadiusKm)
+
+	// Overlapping regions share their tiles, which PlanTiles only counts once
+	for _, node := range positions {
+		center := node.Point
+		zone.Regions = append(zone.Regions, RegionConfig{Center: &center, RadiusKm: nodes.RadiusKm})
+	}
+
+	if nodes.Detail > 0 {
+		zoomLevels := ZoomLevelsForDetail(nodes.Detail)
+		zone.Zoom.Out = zoomLevels[0]
+		zone.Zoom.In = zoomLevels[len(zoomLevels)-1]
+	}
+	return nil
+}
+
+// LoadNodePositions reads the node positions of a Meshtastic node database
+// export. It returns the number of nodes skipped for lack of a position.
+func LoadNodePositions(path string) ([]NodePosition, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read nodes file: %w", err)
+	}
+
+	var positions []NodePosition
+	var skipped int
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.Contains(data, []byte(nodesHeader)):
+		start := bytes.Index(data, []byte(nodesHeader)) + len(nodesHeader)
+		positions, skipped, err = parseNodesJSON(data[start:])
+	case bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("[")):
+		positions, skipped, err = parseNodesJSON(trimmed)
+	default:
+		positions, skipped, err = parseNodesCSV(data)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse nodes file %s: %w", path, err)
+	}
+	return positions, skipped, nil
+}
+
+// parseNodesJSON decodes the first JSON value of the data, either an object
+// of nodes keyed by node ID or an array of nodes
+func parseNodesJSON(data []byte) ([]NodePosition, int, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var raw json.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, 0, err
+	}
+
+	var nodes []meshtasticNode
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		if err := json.Unmarshal(raw, &nodes); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		var byID map[string]meshtasticNode
+		if err := json.Unmarshal(raw, &byID); err != nil {
+			return nil, 0, err
+		}
+		ids := make([]string, 0, len(byID))
+		for id := range byID {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			node := byID[id]
+			if node.User.ID == "" {
+				node.User.ID = id
+			}
+			nodes = append(nodes, node)
+		}
+	}
+
+	var positions []NodePosition
+	skipped := 0
+	for _, node := range nodes {
+		point, ok := node.point()
+		if !ok {
+			skipped++
+			continue
+		}
+		positions = append(positions, NodePosition{Name: node.name(), Point: point})
+	}
+	return positions, skipped, nil
+}
+
+// point returns the position of the node, if it has a valid one
+func (n meshtasticNode) point() (Point, bool) {
+	var point Point
+	switch {
+	case n.Position.Latitude != nil && n.Position.Longitude != nil:
+		point = Point{Lat: *n.Position.Latitude, Long: *n.Position.Longitude}
+	case n.Position.LatitudeI != nil && n.Position.LongitudeI != nil:
+		point = Point{Lat: float64(*n.Position.LatitudeI) * 1e-7, Long: float64(*n.Position.LongitudeI) * 1e-7}
+	default:
+		return point, false
+	}
+	return point, validNodePoint(point)
+}
+
+// name returns the most descriptive name of the node
+func (n meshtasticNode) name() string {
+	for _, name := range []string{n.User.LongName, n.User.ShortName, n.User.ID, n.Num.String()} {
+		if name != "" {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// validNodePoint tells if a position is valid. Nodes without a GPS fix report 0,0.
+func validNodePoint(point Point) bool {
+	if point.Lat == 0 && point.Long == 0 {
+		return false
+	}
+	return point.Lat >= -90 && point.Lat <= 90 && point.Long >= -180 && point.Long <= 180
+}
+
+// parseNodesCSV reads a CSV file of node positions with a header row naming
+// the latitude and longitude columns, and optionally a name column
+func parseNodesCSV(data []byte) ([]NodePosition, int, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, 0, fmt.Errorf("missing CSV header: %w", err)
+	}
+
+	latColumn, lonColumn, nameColumn := -1, -1, -1
+	for i, column := range header {
+		switch strings.ToLower(strings.TrimSpace(column)) {
+		case "lat", "latitude":
+			latColumn = i
+		case "lon", "long", "lng", "longitude":
+			lonColumn = i
+		case "name", "longname", "long_name", "id":
+			if nameColumn == -1 {
+				nameColumn = i
+			}
+		}
+	}
+	if latColumn == -1 || lonColumn == -1 {
+		return nil, 0, fmt.Errorf("CSV header needs latitude and longitude columns")
+	}
+
+	var positions []NodePosition
+	skipped := 0
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if latColumn >= len(record) || lonColumn >= len(record) ||
+			strings.TrimSpace(record[latColumn]) == "" || strings.TrimSpace(record[lonColumn]) == "" {
+			skipped++
+			continue
+		}
+
+		lat, err := strconv.ParseFloat(strings.TrimSpace(record[latColumn]), 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("line %d: invalid latitude: %w", line, err)
+		}
+		lon, err := strconv.ParseFloat(strings.TrimSpace(record[lonColumn]), 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("line %d: invalid longitude: %w", line, err)
+		}
+		point := Point{Lat: lat, Long: lon}
+		if !validNodePoint(point) {
+			skipped++
+			continue
+		}
+
+		name := fmt.Sprintf("line %d", line)
+		if nameColumn != -1 && nameColumn < len(record) && record[nameColumn] != "" {
+			name = record[nameColumn]
+		}
+		positions = append(positions, NodePosition{Name: name, Point: point})
+	}
+	return positions, skipped, nil
+}
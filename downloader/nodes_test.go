@@ -0,0 +1,130 @@
+package downloader
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadNodePositions(t *testing.T) {
+	tests := []struct {
+		file    string
+		want    []NodePosition
+		skipped int
+	}{
+		{"testdata/nodes-info.txt", []NodePosition{
+			{Name: "Vigo Base", Point: Point{Lat: 42.2301, Long: -8.719}},
+			{Name: "CIES", Point: Point{Lat: 42.2185, Long: -8.904}},
+		}, 3},
+		{"testdata/nodes.csv", []NodePosition{
+			{Name: "!4358d0d8", Point: Point{Lat: 42.2301, Long: -8.719}},
+			{Name: "!a1b2c3d4", Point: Point{Lat: 42.2185, Long: -8.904}},
+		}, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(filepath.Base(test.file), func(t *testing.T) {
+			positions, skipped, err := LoadNodePositions(test.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if skipped != test.skipped {
+				t.Errorf("skipped = %d, want %d", skipped, test.skipped)
+			}
+			if len(positions) != len(test.want) {
+				t.Fatalf("positions = %+v, want %+v", positions, test.want)
+			}
+			for i, position := range positions {
+				want := test.want[i]
+				if position.Name != want.Name || math.Abs(position.Lat-want.Lat) > 1e-7 || math.Abs(position.Long-want.Long) > 1e-7 {
+					t.Errorf("position %d = %+v, want %+v", i, position, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadNodePositionsErrors(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{"no header", "", "missing CSV header"},
+		{"no coordinates", "name,altitude\nVigo,40\n", "latitude and longitude columns"},
+		{"invalid latitude", "name,lat,lon\nVigo,north,-8.7\n", "line 2: invalid latitude"},
+		{"broken JSON", "Nodes in mesh: {\"!4358d0d8\": {", "unexpected EOF"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "nodes")
+			if err := os.WriteFile(file, []byte(test.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := LoadNodePositions(file); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestAddNodeCoverage(t *testing.T) {
+	m := NewMeshtasticTileDownloader(Options{})
+	existing := RegionConfig{Spec: "42.24,-8.78,42.20,-8.67"}
+	zone := Zone{Regions: []RegionConfig{existing}, Nodes: &NodesConfig{File: "testdata/nodes-info.txt", RadiusKm: 5, Detail: 2}}
+	if err := m.AddNodeCoverage("Mesh", &zone); err != nil {
+		t.Fatal(err)
+	}
+
+	if zone.Zoom.Out != 7 || zone.Zoom.In != 12 {
+		t.Errorf("zoom = %d-%d, want the 7-12 of detail 2", zone.Zoom.Out, zone.Zoom.In)
+	}
+	if len(zone.Regions) != 3 || !reflect.DeepEqual(zone.Regions[0], existing) {
+		t.Fatalf("regions = %+v, want the configured one and one per node", zone.Regions)
+	}
+
+	// Each node is covered by a square of the radius around it
+	for i, center := range []Point{{Lat: 42.2301, Long: -8.719}, {Lat: 42.2185, Long: -8.904}} {
+		region := zone.Regions[i+1]
+		if region.Center == nil || *region.Center != center || region.RadiusKm != 5 {
+			t.Errorf("region %d = %+v, want 5 km around %+v", i+1, region, center)
+			continue
+		}
+		resolved, err := m.ResolveRegion(region)
+		if err != nil || len(resolved) != 1 {
+			t.Fatalf("region %d resolves to %+v, %v", i+1, resolved, err)
+		}
+		box := resolved[0]
+		if height := (box.MaxLat - box.MinLat) * 111.32; math.Abs(height-10) > 0.1 {
+			t.Errorf("region %d is %.2f km high, want 10", i+1, height)
+		}
+		if width := (box.MaxLon - box.MinLon) * 111.32 * math.Cos(center.Lat*math.Pi/180); math.Abs(width-10) > 0.1 {
+			t.Errorf("region %d is %.2f km wide, want 10", i+1, width)
+		}
+		if box.MinLat >= center.Lat || box.MaxLat <= center.Lat || box.MinLon >= center.Long || box.MaxLon <= center.Long {
+			t.Errorf("region %d = %v, want it around %+v", i+1, box, center)
+		}
+	}
+
+	// The radius defaults to 10 km and zones keep their zoom without a detail level
+	zone = Zone{Nodes: &NodesConfig{File: "testdata/nodes.csv"}}
+	zone.Zoom.Out, zone.Zoom.In = 9, 11
+	if err := m.AddNodeCoverage("Mesh", &zone); err != nil {
+		t.Fatal(err)
+	}
+	if len(zone.Regions) != 2 || zone.Regions[0].RadiusKm != 10 || zone.Zoom.Out != 9 || zone.Zoom.In != 11 {
+		t.Errorf("zone = %+v, want two regions of 10 km at zoom 9-11", zone)
+	}
+
+	// A file without positions leaves nothing to cover
+	file := filepath.Join(t.TempDir(), "nodes.csv")
+	if err := os.WriteFile(file, []byte("name,lat,lon\nNo GPS,,\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	zone = Zone{Nodes: &NodesConfig{File: file}}
+	if err := m.AddNodeCoverage("Mesh", &zone); err == nil || !strings.Contains(err.Error(), "no node with a position") {
+		t.Errorf("error = %v, want no node with a position", err)
+	}
+}
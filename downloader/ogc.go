@@ -0,0 +1,297 @@
+package downloader
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// earthRadiusMeters is the sphere radius used by the EPSG:3857 projection
+const earthRadiusMeters = 6378137.0
+
+// LongToMercatorX projects a longitude to EPSG:3857 meters
+func LongToMercatorX(lon float64) float64 {
+	return earthRadiusMeters * lon * math.Pi / 180.0
+}
+
+// LatToMercatorY projects a latitude to EPSG:3857 meters
+func LatToMercatorY(lat float64) float64 {
+	return earthRadiusMeters * math.Log(math.Tan(math.Pi/4.0+lat*math.Pi/360.0))
+}
+
+// TileMercatorBounds returns the EPSG:3857 bounding box of a tile
+func (m *MeshtasticTileDownloader) TileMercatorBounds(zoom, x, y int) (minX, minY, maxX, maxY float64) {
+	minX = LongToMercatorX(TileXToLong(x, zoom))
+	maxX = LongToMercatorX(TileXToLong(x+1, zoom))
+	minY = LatToMercatorY(TileYToLat(y+1, zoom))
+	maxY = LatToMercatorY(TileYToLat(y, zoom))
+	return minX, minY, maxX, maxY
+}
+
+// WMSTileURL builds the WMS GetMap request covering a tile
+func (m *MeshtasticTileDownloader) WMSTileURL(zoom, x, y int) string {
+	provider := m.config.Providers[m.TileProvider()]
+	minX, minY, maxX, maxY := m.TileMercatorBounds(zoom, x, y)
+
+	version := provider.Version
+	if version == "" {
+		version = "1.3.0"
+	}
+	format := provider.Format
+	if format == "" {
+		format = "image/png"
+	}
+	crsParam := "CRS"
+	if version < "1.3.0" {
+		crsParam = "SRS"
+	}
+	size := strconv.Itoa(tileSize * max(m.config.Map.Scale, 1))
+
+	params := url.Values{}
+	params.Set("SERVICE", "WMS")
+	params.Set("REQUEST", "GetMap")
+	params.Set("VERSION", version)
+	params.Set("LAYERS", provider.Layers)
+	params.Set("STYLES", provider.Styles)
+	params.Set(crsParam, "EPSG:3857")
+	params.Set("BBOX", fmt.Sprintf("%.4f,%.4f,%.4f,%.4f", minX, minY, maxX, maxY))
+	params.Set("WIDTH", size)
+	params.Set("HEIGHT", size)
+	params.Set("FORMAT", format)
+	params.Set("TRANSPARENT", "TRUE")
+
+	return appendQuery(provider.URL, params.Encode())
+}
+
+// appendQuery adds query parameters to a URL that may already have some
+func appendQuery(base, query string) string {
+	switch {
+	case strings.HasSuffix(base, "?") || strings.HasSuffix(base, "&"):
+		return base + query
+	case strings.Contains(base, "?"):
+		return base + "&" + query
+	default:
+		return base + "?" + query
+	}
+}
+
+// wmtsCapabilities is the part of a WMTS GetCapabilities document needed to request tiles
+type wmtsCapabilities struct {
+	Operations []struct {
+		Name string `xml:"name,attr"`
+		Gets []struct {
+			Href string `xml:"href,attr"`
+		} `xml:"DCP>HTTP>Get"`
+	} `xml:"OperationsMetadata>Operation"`
+	Layers []struct {
+		Identifier string `xml:"Identifier"`
+		Styles     []struct {
+			Identifier string `xml:"Identifier"`
+			IsDefault  bool   `xml:"isDefault,attr"`
+		} `xml:"Style"`
+		Formats            []string `xml:"Format"`
+		TileMatrixSetLinks []string `xml:"TileMatrixSetLink>TileMatrixSet"`
+		ResourceURLs       []struct {
+			Format       string `xml:"format,attr"`
+			ResourceType string `xml:"resourceType,attr"`
+			Template     string `xml:"template,attr"`
+		} `xml:"ResourceURL"`
+	} `xml:"Contents>Layer"`
+	TileMatrixSets []struct {
+		Identifier   string `xml:"Identifier"`
+		SupportedCRS string `xml:"SupportedCRS"`
+		TileMatrices []struct {
+			Identifier  string `xml:"Identifier"`
+			MatrixWidth int    `xml:"MatrixWidth"`
+		} `xml:"TileMatrix"`
+	} `xml:"Contents>TileMatrixSet"`
+}
+
+// WMTSLayer holds what is needed to request the tiles of a WMTS layer
+type WMTSLayer struct {
+	Identifier    string
+	Style         string
+	Format        string
+	TileMatrixSet string
+	TileMatrices  map[int]string // tile matrix identifier by zoom level
+	Template      string         // RESTful resource URL template
+	GetTileURL    string         // KVP GetTile endpoint, used when there is no template
+}
+
+// LoadWMTSLayer reads a WMTS GetCapabilities document and selects the layer,
+// style, format and EPSG:3857 tile matrix set described by the provider settings
+func LoadWMTSLayer(ctx context.Context, provider ProviderConfig) (*WMTSLayer, error) {
+	data, err := readResource(ctx, provider.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WMTS capabilities: %w", err)
+	}
+
+	var capabilities wmtsCapabilities
+	if err := xml.Unmarshal(data, &capabilities); err != nil {
+		return nil, fmt.Errorf("failed to parse WMTS capabilities: %w", err)
+	}
+
+	if len(capabilities.Layers) == 0 {
+		return nil, fmt.Errorf("WMTS capabilities list no layers")
+	}
+	found := -1
+	available := make([]string, 0, len(capabilities.Layers))
+	for i, layer := range capabilities.Layers {
+		available = append(available, layer.Identifier)
+		if layer.Identifier == provider.Layers || (provider.Layers == "" && found < 0) {
+			found = i
+		}
+	}
+	if found < 0 {
+		return nil, fmt.Errorf("WMTS layer '%s' not found. Available: %s", provider.Layers, strings.Join(available, ", "))
+	}
+	source := capabilities.Layers[found]
+
+	layer := &WMTSLayer{
+		Identifier:   source.Identifier,
+		Style:        provider.Styles,
+		Format:       provider.Format,
+		TileMatrices: make(map[int]string),
+	}
+
+	if layer.Style == "" {
+		for _, style := range source.Styles {
+			if layer.Style == "" || style.IsDefault {
+				layer.Style = style.Identifier
+			}
+		}
+	}
+
+	if layer.Format == "" {
+		for _, format := range source.Formats {
+			if layer.Format == "" || format == "image/png" {
+				layer.Format = format
+			}
+		}
+	}
+
+	// Pick a tile matrix set in EPSG:3857 linked to the layer
+	for _, link := range source.TileMatrixSetLinks {
+		if provider.TileMatrixSet != "" && link != provider.TileMatrixSet {
+			continue
+		}
+		for _, set := range capabilities.TileMatrixSets {
+			if set.Identifier != link || !isWebMercatorCRS(set.SupportedCRS) {
+				continue
+			}
+			layer.TileMatrixSet = set.Identifier
+			for _, matrix := range set.TileMatrices {
+				if matrix.MatrixWidth > 0 && matrix.MatrixWidth&(matrix.MatrixWidth-1) == 0 {
+					layer.TileMatrices[bits.TrailingZeros(uint(matrix.MatrixWidth))] = matrix.Identifier
+				}
+			}
+			break
+		}
+		if layer.TileMatrixSet != "" {
+			break
+		}
+	}
+	if layer.TileMatrixSet == "" {
+		return nil, fmt.Errorf("WMTS layer '%s' has no EPSG:3857 tile matrix set", layer.Identifier)
+	}
+
+	for _, resource := range source.ResourceURLs {
+		if resource.ResourceType == "tile" && (layer.Template == "" || resource.Format == layer.Format) {
+			layer.Template = resource.Template
+		}
+	}
+	if layer.Template == "" {
+		for _, operation := range capabilities.Operations {
+			if operation.Name == "GetTile" && len(operation.Gets) > 0 {
+				layer.GetTileURL = operation.Gets[0].Href
+			}
+		}
+		if layer.GetTileURL == "" {
+			return nil, fmt.Errorf("WMTS layer '%s' has neither a tile URL template nor a GetTile endpoint", layer.Identifier)
+		}
+	}
+
+	return layer, nil
+}
+
+// isWebMercatorCRS checks if a CRS identifier refers to EPSG:3857
+func isWebMercatorCRS(crs string) bool {
+	for _, code := range []string{"3857", "900913", "3785"} {
+		if strings.HasSuffix(crs, ":"+code) || strings.HasSuffix(crs, "/"+code) {
+			return true
+		}
+	}
+	return false
+}
+
+// readResource reads a local file or downloads a URL
+func readResource(ctx context.Context, location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return os.ReadFile(location)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// MaxZoom returns the deepest zoom level of the layer tile matrix set
+func (l *WMTSLayer) MaxZoom() int {
+	deepest := 0
+	for zoom := range l.TileMatrices {
+		deepest = max(deepest, zoom)
+	}
+	return deepest
+}
+
+// TileURL builds the request of a tile of the layer
+func (l *WMTSLayer) TileURL(zoom, x, y int) string {
+	matrix, ok := l.TileMatrices[zoom]
+	if !ok {
+		matrix = strconv.Itoa(zoom)
+	}
+
+	if l.Template != "" {
+		replacer := strings.NewReplacer(
+			"{TileMatrixSet}", l.TileMatrixSet,
+			"{TileMatrix}", matrix,
+			"{TileRow}", strconv.Itoa(y),
+			"{TileCol}", strconv.Itoa(x),
+			"{Style}", l.Style,
+			"{style}", l.Style,
+		)
+		return replacer.Replace(l.Template)
+	}
+
+	params := url.Values{}
+	params.Set("SERVICE", "WMTS")
+	params.Set("REQUEST", "GetTile")
+	params.Set("VERSION", "1.0.0")
+	params.Set("LAYER", l.Identifier)
+	params.Set("STYLE", l.Style)
+	params.Set("FORMAT", l.Format)
+	params.Set("TILEMATRIXSET", l.TileMatrixSet)
+	params.Set("TILEMATRIX", matrix)
+	params.Set("TILEROW", strconv.Itoa(y))
+	params.Set("TILECOL", strconv.Itoa(x))
+	return appendQuery(l.GetTileURL, params.Encode())
+}
@@ -0,0 +1,119 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mercatorExtent is half the width of the EPSG:3857 world in meters
+const mercatorExtent = 20037508.342789244
+
+func TestTileMercatorBounds(t *testing.T) {
+	tests := []struct {
+		zoom, x, y             int
+		minX, minY, maxX, maxY float64
+	}{
+		{0, 0, 0, -mercatorExtent, -mercatorExtent, mercatorExtent, mercatorExtent},
+		{1, 1, 0, 0, 0, mercatorExtent, mercatorExtent},
+		{2, 1, 2, -mercatorExtent / 2, -mercatorExtent / 2, 0, 0},
+		{3, 3, 5, -mercatorExtent / 4, -mercatorExtent / 2, 0, -mercatorExtent / 4},
+	}
+	m := NewMeshtasticTileDownloader(Options{})
+	for _, test := range tests {
+		minX, minY, maxX, maxY := m.TileMercatorBounds(test.zoom, test.x, test.y)
+		for _, pair := range [][2]float64{{minX, test.minX}, {minY, test.minY}, {maxX, test.maxX}, {maxY, test.maxY}} {
+			if math.Abs(pair[0]-pair[1]) > 1e-6 {
+				t.Errorf("TileMercatorBounds(%d, %d, %d) = %.4f,%.4f,%.4f,%.4f, want %.4f,%.4f,%.4f,%.4f", test.zoom, test.x, test.y,
+					minX, minY, maxX, maxY, test.minX, test.minY, test.maxX, test.maxY)
+				break
+			}
+		}
+	}
+}
+
+func TestWMSTileURL(t *testing.T) {
+	m := NewMeshtasticTileDownloader(Options{})
+	m.SetConfig(Config{
+		Map:       MapConfig{Provider: "ign-wms"},
+		Providers: map[string]ProviderConfig{"ign-wms": {Type: "wms", URL: "https://wms.example.com/base?map=ign", Layers: "Base"}},
+	})
+	url := m.WMSTileURL(1, 1, 0)
+	for _, want := range []string{"https://wms.example.com/base?map=ign&", "BBOX=0.0000%2C0.0000%2C20037508.3428%2C20037508.3428", "CRS=EPSG%3A3857", "LAYERS=Base", "WIDTH=256"} {
+		if !strings.Contains(url, want) {
+			t.Errorf("WMSTileURL = %s, want it to contain %s", url, want)
+		}
+	}
+}
+
+func TestLoadWMTSLayer(t *testing.T) {
+	layer, err := LoadWMTSLayer(context.Background(), ProviderConfig{URL: "testdata/wmts-capabilities.xml", Layers: "Base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer.Style != "normal" || layer.Format != "image/png" || layer.TileMatrixSet != "GoogleMapsCompatible" {
+		t.Errorf("layer = style %q, format %q, set %q, want the default style, PNG and the EPSG:3857 set", layer.Style, layer.Format, layer.TileMatrixSet)
+	}
+	if layer.MaxZoom() != 2 || layer.TileMatrices[1] != "GM:1" {
+		t.Errorf("tile matrices = %v, want GM:0 to GM:2 by zoom level", layer.TileMatrices)
+	}
+	if got, want := layer.TileURL(2, 1, 3), "https://wmts.example.com/base/normal/GoogleMapsCompatible/GM:2/1/3.png"; got != want {
+		t.Errorf("TileURL = %s, want %s", got, want)
+	}
+
+	// Without a template the tiles are requested from the GetTile endpoint,
+	// in the EPSG:3857 set even when another one is listed first
+	layer, err = LoadWMTSLayer(context.Background(), ProviderConfig{URL: "testdata/wmts-capabilities.xml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer.Identifier != "Ortho" || layer.TileMatrixSet != "GoogleMapsCompatible" || layer.GetTileURL != "https://wmts.example.com/wmts?" {
+		t.Errorf("layer = %+v, want Ortho through the GetTile endpoint", layer)
+	}
+	url := layer.TileURL(1, 0, 1)
+	for _, want := range []string{"LAYER=Ortho", "TILEMATRIX=GM%3A1", "TILEROW=1", "TILECOL=0", "FORMAT=image%2Fjpeg"} {
+		if !strings.Contains(url, want) {
+			t.Errorf("TileURL = %s, want it to contain %s", url, want)
+		}
+	}
+
+	if _, err := LoadWMTSLayer(context.Background(), ProviderConfig{URL: "testdata/wmts-capabilities.xml", Layers: "Roads"}); err == nil || !strings.Contains(err.Error(), "Available: Ortho, Base") {
+		t.Errorf("unknown layer error = %v, want the available layers", err)
+	}
+}
+
+func TestLoadWMTSLayerRemote(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	_, err := LoadWMTSLayer(context.Background(), ProviderConfig{URL: server.URL + "/missing"})
+	if err == nil || !strings.HasSuffix(err.Error(), ": 404 Not Found") {
+		t.Errorf("missing capabilities error = %v, want the 404 status once", err)
+	}
+
+	// The capabilities request stops with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := LoadWMTSLayer(ctx, ProviderConfig{URL: server.URL + "/slow"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow capabilities error = %v, want the deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("slow capabilities took %v, want the request stopped at the deadline", elapsed)
+	}
+}
@@ -0,0 +1,367 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Plan is the exact list of tiles a run obtains. It is written by -plan and
+// executed by -replay, possibly on another machine holding the API keys.
+type Plan struct {
+	Created       string                    `yaml:"created"`
+	Tiles         int                       `yaml:"tiles"`          // tiles stored, downloaded or built locally
+	Requests      int                       `yaml:"requests"`       // tiles requested from the providers
+	EstimatedSize int64                     `yaml:"estimated_size"` // bytes to download
+	Providers     map[string]ProviderConfig `yaml:"providers,omitempty"`
+	Jobs          []PlanJob                 `yaml:"jobs"`
+}
+
+// PlanJob is the pyramid of a zone, or of the points of point-radius mode,
+// with the map configuration it is obtained with
+type PlanJob struct {
+	Name          string       `yaml:"name"`
+	Output        string       `yaml:"output"` // directory, absolute or relative to DOWNLOAD_DIRECTORY
+	Map           MapConfig    `yaml:"map"`
+	Sources       []PlanSource `yaml:"sources"`
+	Tiles         int          `yaml:"tiles"`
+	Requests      int          `yaml:"requests"`
+	EstimatedSize int64        `yaml:"estimated_size"`
+	PyramidPlan   `yaml:",inline"`
+}
+
+// PlanSource is a source tiles are requested from, with its URL template.
+// API keys are left as the {{API_KEY}} placeholder.
+type PlanSource struct {
+	Source string `yaml:"source"`
+	URL    string `yaml:"url"`
+}
+
+// MarshalYAML writes a tile coordinate in z/x/y notation
+func (t TileCoord) MarshalYAML() (interface{}, error) {
+	return t.String(), nil
+}
+
+// UnmarshalYAML reads a tile coordinate written in z/x/y notation
+func (t *TileCoord) UnmarshalYAML(node *yaml.Node) error {
+	tile, err := ParseTileCoord(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*t = tile
+	return nil
+}
+
+// ParseTileCoord parses a tile coordinate written in z/x/y notation
+func ParseTileCoord(text string) (TileCoord, error) {
+	parts := strings.Split(strings.TrimSpace(text), "/")
+	if len(parts) != 3 {
+		return TileCoord{}, fmt.Errorf("invalid tile %s (expected z/x/y)", text)
+	}
+
+	values := make([]int, 3)
+	for i, part := range parts {
+		value, err := strconv.Atoi(part)
+		if err != nil || value < 0 {
+			return TileCoord{}, fmt.Errorf("invalid tile %s (expected z/x/y)", text)
+		}
+		values[i] = value
+	}
+
+	tile := TileCoord{Zoom: values[0], X: values[1], Y: values[2]}
+	if tile.Zoom > maxZoomLevel || tile.X >= 1<<tile.Zoom || tile.Y >= 1<<tile.Zoom {
+		return TileCoord{}, fmt.Errorf("tile %s is out of range", text)
+	}
+	return tile, nil
+}
+
+// SourceTemplate returns the URL template of the configured provider with its
+// style and scale filled in. WMS and WMTS providers return their endpoint.
+func (m *MeshtasticTileDownloader) SourceTemplate() string {
+	if m.ProviderType() != "xyz" {
+		return m.ProviderURLTemplate()
+	}
+
+	url := NormalizeTemplate(m.ProviderURLTemplate())
+	url = strings.Replace(url, "{{MAP_STYLE}}", m.MapStyle(), -1)
+	url = strings.Replace(url, "{{SCALE}}", m.ScaleSuffix(), -1)
+	return url
+}
+
+// BuildPlanJob lists the tiles of the given areas with the map configuration in effect
+func (m *MeshtasticTileDownloader) BuildPlanJob(name, output string, areas []Area) PlanJob {
+	job := PlanJob{
+		Name:        name,
+		Output:      output,
+		Map:         m.config.Map,
+		Sources:     m.PlanSources(),
+		PyramidPlan: m.PlanPyramid(areas),
+	}
+	m.countPlanJob(&job)
+	return job
+}
+
+// PlanSources returns the sources of the map configuration in effect with their URL templates
+func (m *MeshtasticTileDownloader) PlanSources() []PlanSource {
+	var sources []PlanSource
+	for _, source := range m.Sources() {
+		restore := m.useSource(source)
+		sources = append(sources, PlanSource{Source: source.String(), URL: m.SourceTemplate()})
+		restore()
+	}
+	return sources
+}
+
+// countPlanJob fills in the tile and request counts and the estimated size
+// of a job obtained with the map configuration in effect
+func (m *MeshtasticTileDownloader) countPlanJob(job *PlanJob) {
+	requests := job.Fetch
+	if m.IsSplittingRetina() {
+		requests, _ = m.RetinaRequests(requests)
+	}
+	job.Tiles = len(job.PyramidPlan.Tiles())
+	job.Requests = len(requests)
+	job.EstimatedSize = m.EstimateSize(job.Fetch)
+}
+
+// countPlan sums the counts of the jobs of a plan
+func (p *Plan) countPlan() {
+	p.Tiles, p.Requests, p.EstimatedSize = 0, 0, 0
+	for _, job := range p.Jobs {
+		p.Tiles += job.Tiles
+		p.Requests += job.Requests
+		p.EstimatedSize += job.EstimatedSize
+	}
+}
+
+// BuildPlan lists the tiles of every zone, or of the points of point-radius
+// mode, without downloading anything
+func (m *MeshtasticTileDownloader) BuildPlan() (*Plan, error) {
+	plan := &Plan{
+		Created:   time.Now().Format(time.RFC3339),
+		Providers: m.config.Providers,
+	}
+
+	if m.isPointRadius {
+		plan.Jobs = append(plan.Jobs, m.BuildPlanJob("points", m.PointRadiusFolder(), m.PointRadiusAreas()))
+	} else {
+		for _, zoneName := range slices.Sorted(maps.Keys(m.config.Zones)) {
+			zone := m.config.Zones[zoneName]
+			regions, err := m.ZoneRegions(zone)
+			if err != nil {
+				return nil, fmt.Errorf("error in the regions of zone %s: %w", zoneName, err)
+			}
+
+			restore := m.useZone(zone)
+			plan.Jobs = append(plan.Jobs, m.BuildPlanJob(zoneName, zone.Output, []Area{{Regions: regions, ZoomLevels: ZoneZoomLevels(zone)}}))
+			restore()
+		}
+	}
+
+	plan.countPlan()
+	return plan, nil
+}
+
+// ZoneTileCount returns the number of tiles of the given zones
+func (m *MeshtasticTileDownloader) ZoneTileCount(zoneNames ...string) int {
+	count := 0
+	for _, zoneName := range zoneNames {
+		zone := m.config.Zones[zoneName]
+		regions, err := m.ZoneRegions(zone)
+		if err != nil {
+			continue
+		}
+
+		restore := m.useZone(zone)
+		count += len(m.PlanPyramid([]Area{{Regions: regions, ZoomLevels: ZoneZoomLevels(zone)}}).Tiles())
+		restore()
+	}
+	return count
+}
+
+// WritePlan writes the plan of the run to a file instead of downloading it
+func (m *MeshtasticTileDownloader) WritePlan(path string) error {
+	plan, err := m.BuildPlan()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range plan.Jobs {
+		slog.Info("Planned zone", "zone", job.Name, "tiles", job.Tiles, "requests", job.Requests, "estimated_size", FormatSize(job.EstimatedSize))
+	}
+	slog.Info("Total tiles", "tiles", plan.Tiles, "requests", plan.Requests, "estimated_size", FormatSize(plan.EstimatedSize))
+
+	if err := plan.Write(path); err != nil {
+		return err
+	}
+	slog.Info("Plan written", "file", path)
+	return nil
+}
+
+// Write writes a plan to a YAML file
+func (p *Plan) Write(path string) error {
+	var data bytes.Buffer
+	encoder := yaml.NewEncoder(&data)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(p); err != nil {
+		return fmt.Errorf("failed to encode plan: %w", err)
+	}
+	if err := os.WriteFile(path, data.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write plan: %w", err)
+	}
+	return nil
+}
+
+// LoadPlan reads a plan written by WritePlan to replay it
+func (m *MeshtasticTileDownloader) LoadPlan(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read plan: %w", err)
+	}
+
+	var plan Plan
+	if err := yaml.Unmarshal(data, &plan); err != nil {
+		return fmt.Errorf("failed to parse plan: %w", err)
+	}
+	if len(plan.Jobs) == 0 {
+		return fmt.Errorf("plan %s has no jobs", path)
+	}
+
+	m.plan = &plan
+	m.config.Providers = plan.Providers
+	m.config.Map = plan.Jobs[0].Map
+	slog.Info("Loaded plan", "file", path, "created", plan.Created, "jobs", len(plan.Jobs), "tiles", plan.Tiles, "requests", plan.Requests)
+	return nil
+}
+
+// Source returns the provider and style shared by every job of the plan. They
+// are empty when the jobs use different ones.
+func (p *Plan) Source() (provider, style string) {
+	provider, style = p.Jobs[0].Map.Provider, p.Jobs[0].Map.Style
+	for _, job := range p.Jobs[1:] {
+		if job.Map.Provider != provider {
+			provider = ""
+		}
+		if job.Map.Style != style {
+			style = ""
+		}
+	}
+	return provider, style
+}
+
+// LocalFiles returns the files the map configuration in effect reads from
+// disk: the WMTS capabilities of its sources and layers, and its annotations
+func (m *MeshtasticTileDownloader) LocalFiles() []string {
+	var files []string
+	sources := m.Sources()
+	for _, layer := range m.config.Map.Layers {
+		sources = append(sources, layer.SourceConfig)
+	}
+	for _, source := range sources {
+		restore := m.useSource(source)
+		location := m.ProviderURLTemplate()
+		if m.ProviderType() == "wmts" && !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") && !slices.Contains(files, location) {
+			files = append(files, location)
+		}
+		restore()
+	}
+	return append(files, m.config.Map.Annotations.Files...)
+}
+
+// Plan returns the plan loaded with LoadPlan, or nil
+func (m *MeshtasticTileDownloader) Plan() *Plan {
+	return m.plan
+}
+
+// PreparePlan checks the providers, layers and annotations of every job of
+// the loaded plan can be used. The files they are read from aren't part of
+// the plan, so they must be at the same paths as on the planning machine.
+func (m *MeshtasticTileDownloader) PreparePlan(ctx context.Context) bool {
+	originalMap := m.config.Map
+	defer func() { m.config.Map = originalMap }()
+
+	for _, job := range m.plan.Jobs {
+		m.config.Map = job.Map
+		for _, file := range m.LocalFiles() {
+			if _, err := os.Stat(file); err != nil {
+				slog.Error("File read by the plan is missing. Copy it from the planning machine to the same path", "zone", job.Name, "file", file, "error", err)
+				return false
+			}
+		}
+		if !m.IsValidProvider() {
+			slog.Error("Provider is unknown", "zone", job.Name, "provider", m.TileProvider(), "known", strings.Join(m.KnownProviders(), ", "))
+			return false
+		}
+		if err := m.PrepareProvider(ctx); err != nil {
+			slog.Error("Provider can't be used", "zone", job.Name, "provider", m.TileProvider(), "error", err)
+			return false
+		}
+		if err := m.PrepareFallbackSources(ctx); err != nil {
+			slog.Error("Invalid fallback sources", "zone", job.Name, "error", err)
+			return false
+		}
+		if err := m.PrepareLayers(ctx, job.Map.Layers); err != nil {
+			slog.Error("Invalid layers", "zone", job.Name, "error", err)
+			return false
+		}
+		if err := m.LoadAnnotations(); err != nil {
+			slog.Error("Invalid annotations", "zone", job.Name, "error", err)
+			return false
+		}
+	}
+	return true
+}
+
+// RunPlan obtains exactly the tiles of the loaded plan
+func (m *MeshtasticTileDownloader) RunPlan(ctx context.Context) (Summary, error) {
+	startTime := time.Now()
+	var summary Summary
+
+	for i, job := range m.plan.Jobs {
+		slog.Info("Replaying zone", "zone", job.Name, "tiles", job.Tiles, "requests", job.Requests)
+
+		jobStart := time.Now()
+		originalMap, originalOutputDir := m.config.Map, m.outputDirectory
+		m.config.Map, m.outputDirectory, m.zone = job.Map, m.ZoneOutputDirectory(Zone{Output: job.Output}), job.Name
+		var jobSummary Summary
+		err := m.LoadAnnotations()
+		if err == nil {
+			jobSummary, err = m.ExecutePyramid(ctx, job.PyramidPlan)
+		}
+		m.config.Map, m.outputDirectory, m.zone = originalMap, originalOutputDir, ""
+		jobSummary.Duration = time.Since(jobStart)
+		summary = summary.Add(jobSummary)
+		m.finishZone(job.Name, jobSummary)
+
+		if errors.Is(err, ErrCancelled) {
+			slog.Info("Download cancelled by user", "zone", job.Name)
+			summary.Duration = time.Since(startTime)
+			return summary, nil // User cancellation is not an error
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				for _, pending := range m.plan.Jobs[i+1:] {
+					summary.Remaining += pending.Tiles
+				}
+			}
+			summary.Duration = time.Since(startTime)
+			return summary, fmt.Errorf("error obtaining tiles for %s: %w", job.Name, err)
+		}
+
+		slog.Info("Finished with zone", "zone", job.Name)
+	}
+
+	summary.Duration = time.Since(startTime)
+	slog.Info("Total download time", "duration", summary.Duration.Round(time.Second))
+	return summary, nil
+}
@@ -0,0 +1,120 @@
+package downloader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testZone returns a zone covering a region from its zoom out to its zoom in level
+func testZone(region string, out, in int) Zone {
+	zone := Zone{Regions: []RegionConfig{{Spec: region}}}
+	zone.Zoom.Out, zone.Zoom.In = out, in
+	return zone
+}
+
+func TestPlanRoundTrip(t *testing.T) {
+	madrid := testZone("40.42,-3.71,40.41,-3.70", 9, 11)
+	madrid.Provider, madrid.Output = "custom", "madrid"
+
+	m := NewMeshtasticTileDownloader(Options{OutputDirectory: t.TempDir()})
+	m.SetConfig(Config{
+		Zones: map[string]Zone{
+			"Vigo":   testZone("42.24,-8.78,42.20,-8.67", 10, 12),
+			"Madrid": madrid,
+		},
+		Map:       MapConfig{Provider: "thunderforest", Style: "atlas", Downsample: 10, Fallback: []SourceConfig{{Provider: "openstreetmap"}}},
+		Providers: map[string]ProviderConfig{"custom": {URL: "https://tiles.example.com/{z}/{x}/{y}.png", MaxZoom: 10}},
+	})
+
+	plan, err := m.BuildPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "plan.yaml")
+	if err := plan.Write(path); err != nil {
+		t.Fatal(err)
+	}
+
+	replay := NewMeshtasticTileDownloader(Options{OutputDirectory: t.TempDir()})
+	if err := replay.LoadPlan(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := replay.Plan()
+	rewritten := filepath.Join(t.TempDir(), "plan.yaml")
+	if err := loaded.Write(rewritten); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := os.ReadFile(path)
+	got, _ := os.ReadFile(rewritten)
+	if string(got) != string(want) {
+		t.Errorf("loaded plan writes\n%s\nwant\n%s", got, want)
+	}
+
+	if len(loaded.Jobs) != 2 || len(loaded.Jobs[0].Overzoom) == 0 || len(loaded.Jobs[1].Downsample) == 0 {
+		t.Fatalf("jobs = %+v, want Madrid overzoomed and Vigo downsampled", loaded.Jobs)
+	}
+
+	// The jobs use different providers, so the report only names their style
+	replay.startReport()
+	if replay.report.Provider != "" || replay.report.Style != "atlas" {
+		t.Errorf("report source = %q/%q, want no provider and atlas", replay.report.Provider, replay.report.Style)
+	}
+}
+
+func TestPreparePlanLocalFiles(t *testing.T) {
+	dir := t.TempDir()
+	annotations := filepath.Join(dir, "trails.geojson")
+	capabilities := filepath.Join(dir, "capabilities.xml")
+
+	m := NewMeshtasticTileDownloader(Options{OutputDirectory: t.TempDir()})
+	m.SetConfig(Config{
+		Zones: map[string]Zone{"Vigo": testZone("42.24,-8.78,42.20,-8.67", 8, 8)},
+		Map: MapConfig{
+			Provider:    "custom",
+			Layers:      []LayerConfig{{SourceConfig: SourceConfig{Provider: "ortho"}}},
+			Annotations: AnnotationConfig{Files: []string{annotations}},
+		},
+		Providers: map[string]ProviderConfig{
+			"custom": {URL: "https://tiles.example.com/{z}/{x}/{y}.png"},
+			"ortho":  {Type: "wmts", URL: capabilities, Layers: "Ortho"},
+		},
+	})
+	if files := m.LocalFiles(); !reflect.DeepEqual(files, []string{capabilities, annotations}) {
+		t.Errorf("local files = %v, want %v", files, []string{capabilities, annotations})
+	}
+
+	plan, err := m.BuildPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "plan.yaml")
+	if err := plan.Write(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither file was copied to the replaying machine
+	replay := NewMeshtasticTileDownloader(Options{OutputDirectory: t.TempDir()})
+	if err := replay.LoadPlan(path); err != nil {
+		t.Fatal(err)
+	}
+	if replay.PreparePlan(context.Background()) {
+		t.Fatal("plan prepared without its files")
+	}
+
+	if err := os.WriteFile(annotations, []byte(`{"type":"FeatureCollection","features":[]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("testdata/wmts-capabilities.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(capabilities, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !replay.PreparePlan(context.Background()) {
+		t.Error("plan not prepared with its files copied")
+	}
+}
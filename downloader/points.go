@@ -0,0 +1,130 @@
+package downloader
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PointRadius is a point of point-radius mode, covered up to a radius at a
+// detail level
+type PointRadius struct {
+	Point
+	RadiusKm float64
+	Detail   int
+}
+
+// String returns the point in the "lat,long,radius_km,detail" notation of the -at flag
+func (p PointRadius) String() string {
+	return fmt.Sprintf("%.6f,%.6f,%g,%d", p.Lat, p.Long, p.RadiusKm, p.Detail)
+}
+
+// ParsePointRadius parses a "lat,long[,radius_km[,detail]]" point. The
+// position can also be a UTM or MGRS reference, a geohash or a Plus Code, as
+// in "29TNG2776,5". Missing radius and detail level take the given defaults.
+func ParsePointRadius(spec string, defaultRadiusKm float64, defaultDetail int) (PointRadius, error) {
+	fields := strings.Split(spec, ",")
+	point := PointRadius{RadiusKm: defaultRadiusKm, Detail: defaultDetail}
+
+	if _, err := strconv.ParseFloat(strings.TrimSpace(fields[0]), 64); err != nil {
+		// A grid reference or code takes the place of lat,long
+		position, _, err := ParseCoordinate(fields[0])
+		if err != nil {
+			return PointRadius{}, fmt.Errorf("invalid point %s: %w", spec, err)
+		}
+		point.Point = position
+		fields = append([]string{"", ""}, fields[1:]...)
+	}
+	if len(fields) < 2 || len(fields) > 4 {
+		return PointRadius{}, fmt.Errorf("invalid point format: %s (expected lat,long[,radius_km[,detail]])", spec)
+	}
+
+	var err error
+	if fields[0] != "" {
+		if point.Lat, err = strconv.ParseFloat(strings.TrimSpace(fields[0]), 64); err != nil {
+			return PointRadius{}, fmt.Errorf("invalid latitude in point %s: %w", spec, err)
+		}
+		if point.Long, err = strconv.ParseFloat(strings.TrimSpace(fields[1]), 64); err != nil {
+			return PointRadius{}, fmt.Errorf("invalid longitude in point %s: %w", spec, err)
+		}
+	}
+	if len(fields) > 2 && strings.TrimSpace(fields[2]) != "" {
+		if point.RadiusKm, err = strconv.ParseFloat(strings.TrimSpace(fields[2]), 64); err != nil {
+			return PointRadius{}, fmt.Errorf("invalid radius in point %s: %w", spec, err)
+		}
+	}
+	if len(fields) > 3 && strings.TrimSpace(fields[3]) != "" {
+		if point.Detail, err = strconv.Atoi(strings.TrimSpace(fields[3])); err != nil {
+			return PointRadius{}, fmt.Errorf("invalid detail level in point %s: %w", spec, err)
+		}
+	}
+
+	if point.Lat < -90 || point.Lat > 90 || point.Long < -180 || point.Long > 180 {
+		return PointRadius{}, fmt.Errorf("point %s is out of range", spec)
+	}
+	if point.RadiusKm <= 0 {
+		return PointRadius{}, fmt.Errorf("radius of point %s must be greater than 0", spec)
+	}
+	if point.Detail < 1 || point.Detail > 4 {
+		return PointRadius{}, fmt.Errorf("detail level of point %s is out of range (1-4)", spec)
+	}
+	return point, nil
+}
+
+// LoadPointRadiusFile reads one "lat,long[,radius_km[,detail]]" point per
+// line. Blank lines and lines starting with # are ignored.
+func LoadPointRadiusFile(path string, defaultRadiusKm float64, defaultDetail int) ([]PointRadius, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open points file: %w", err)
+	}
+	defer f.Close()
+
+	var points []PointRadius
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		point, err := ParsePointRadius(text, defaultRadiusKm, defaultDetail)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		points = append(points, point)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read points file: %w", err)
+	}
+	return points, nil
+}
+
+// PointRadiusAreas returns the area covered by each point
+func (m *MeshtasticTileDownloader) PointRadiusAreas() []Area {
+	areas := make([]Area, 0, len(m.points))
+	for _, point := range m.points {
+		areas = append(areas, Area{
+			Regions:    m.RadiusRegions(point.Point, point.RadiusKm),
+			ZoomLevels: ZoomLevelsForDetail(point.Detail),
+		})
+	}
+	return areas
+}
+
+// PointRadiusFolder names the output directory of the points. A single point
+// keeps its historical name; several points share a folder named after them.
+func (m *MeshtasticTileDownloader) PointRadiusFolder() string {
+	if len(m.points) == 1 {
+		point := m.points[0]
+		return fmt.Sprintf("point_%.4f_%.4f_r%.1f_d%d", point.Lat, point.Long, point.RadiusKm, point.Detail)
+	}
+
+	specs := make([]string, 0, len(m.points))
+	for _, point := range m.points {
+		specs = append(specs, point.String())
+	}
+	return fmt.Sprintf("points_%d_%08x", len(m.points), crc32.ChecksumIEEE([]byte(strings.Join(specs, ";"))))
+}
@@ -0,0 +1,55 @@
+package downloader
+
+import "testing"
+
+func TestParsePointRadius(t *testing.T) {
+	geohash, _, _ := ParseCoordinate("ezjmg")
+	mgrs, _, _ := ParseCoordinate("29TNG2776")
+
+	tests := []struct {
+		spec string
+		want PointRadius
+	}{
+		{"42.2406,-8.7207", PointRadius{Point{Lat: 42.2406, Long: -8.7207}, 5, 2}},
+		{"42.2406,-8.7207,10", PointRadius{Point{Lat: 42.2406, Long: -8.7207}, 10, 2}},
+		{" 42.2406 , -8.7207 , 2.5 , 4 ", PointRadius{Point{Lat: 42.2406, Long: -8.7207}, 2.5, 4}},
+		{"42.2406,-8.7207,,1", PointRadius{Point{Lat: 42.2406, Long: -8.7207}, 5, 1}},
+		{"-33.8568,151.2153,20,3", PointRadius{Point{Lat: -33.8568, Long: 151.2153}, 20, 3}},
+		{"ezjmg", PointRadius{geohash, 5, 2}},
+		{"ezjmg,3", PointRadius{geohash, 3, 2}},
+		{"29TNG2776,5,1", PointRadius{mgrs, 5, 1}},
+	}
+	for _, test := range tests {
+		got, err := ParsePointRadius(test.spec, 5, 2)
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParsePointRadius(%q) = %v, want %v", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestParsePointRadiusInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"42.2406",
+		"42.2406,-8.7207,5,2,1",
+		"42.2406,west",
+		"42.2406,-8.7207,far",
+		"42.2406,-8.7207,5,high",
+		"91,0",
+		"0,-181",
+		"42.2406,-8.7207,0",
+		"42.2406,-8.7207,-5",
+		"42.2406,-8.7207,5,0",
+		"42.2406,-8.7207,5,5",
+		"nowhere,5",
+		"ezjmg,3,2,1",
+	} {
+		if point, err := ParsePointRadius(spec, 5, 2); err == nil {
+			t.Errorf("ParsePointRadius(%q) = %v, want an error", spec, point)
+		}
+	}
+}
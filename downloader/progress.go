@@ -0,0 +1,228 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// Steps of a run reported to progress observers
+const (
+	StepDownload   = "download"   // tiles requested from the providers
+	StepDownsample = "downsample" // tiles built from their four children
+	StepOverzoom   = "overzoom"   // tiles upscaled beyond the provider maximum zoom
+	StepAnnotate   = "annotate"   // stored tiles the annotations are drawn on, only reported when failing
+)
+
+// PlanEvent reports the tiles a step of a zone is about to obtain
+type PlanEvent struct {
+	Zone          string
+	Step          string
+	ZoomLevels    []int
+	Tiles         int   // tiles the step stores
+	Requests      int   // tiles the step requests or builds, one per progress tick
+	EstimatedSize int64 // bytes to download
+}
+
+// TileEvent reports a tile being obtained
+type TileEvent struct {
+	Zone     string
+	Step     string
+	Tile     TileCoord
+	Bytes    int64         // size of the stored tile, or of its four children when splitting @2x tiles
+	Duration time.Duration // time taken to obtain the tile
+	Cached   bool          // the tile was already stored
+	Err      error
+}
+
+// ZoneEvent reports a zone, the points of point-radius mode or a plan job being finished
+type ZoneEvent struct {
+	Zone    string
+	Summary Summary
+}
+
+// ProgressObserver is told about the progress of a run. Its methods are
+// called from the goroutine running the download.
+type ProgressObserver interface {
+	PlanComputed(event PlanEvent)
+	TileStarted(event TileEvent)
+	TileSaved(event TileEvent)
+	TileFailed(event TileEvent)
+	ZoneFinished(event ZoneEvent)
+}
+
+// SilentProgress ignores every progress event
+type SilentProgress struct{}
+
+func (SilentProgress) PlanComputed(PlanEvent) {}
+func (SilentProgress) TileStarted(TileEvent)  {}
+func (SilentProgress) TileSaved(TileEvent)    {}
+func (SilentProgress) TileFailed(TileEvent)   {}
+func (SilentProgress) ZoneFinished(ZoneEvent) {}
+
+// TerminalProgress draws a progress bar for every step on the terminal and
+// logs the tiles that fail
+type TerminalProgress struct {
+	bar *progressbar.ProgressBar
+}
+
+func (p *TerminalProgress) PlanComputed(event PlanEvent) {
+	description := "Downloading tiles"
+	switch event.Step {
+	case StepDownsample:
+		description = fmt.Sprintf("Building zoom %v", event.ZoomLevels)
+		if len(event.ZoomLevels) == 1 {
+			description = fmt.Sprintf("Building zoom %d", event.ZoomLevels[0])
+		}
+	case StepOverzoom:
+		description = "Synthesizing tiles"
+	}
+	p.bar = progressbar.Default(int64(event.Requests), description)
+}
+
+func (p *TerminalProgress) TileStarted(TileEvent) {}
+
+func (p *TerminalProgress) TileSaved(TileEvent) {
+	if p.bar != nil {
+		_ = p.bar.Add(1)
+	}
+}
+
+func (p *TerminalProgress) TileFailed(event TileEvent) {
+	switch event.Step {
+	case StepDownsample:
+		slog.Error("Error building tile", "zone", event.Zone, "tile", event.Tile.String(), "error", event.Err)
+	case StepOverzoom:
+		slog.Error("Error synthesizing tile", "zone", event.Zone, "tile", event.Tile.String(), "error", event.Err)
+	default:
+		slog.Error("Error downloading tile", "zone", event.Zone, "tile", event.Tile.String(), "error", event.Err)
+	}
+	if p.bar != nil {
+		_ = p.bar.Add(1)
+	}
+}
+
+func (p *TerminalProgress) ZoneFinished(ZoneEvent) {
+	p.bar = nil
+}
+
+// JSONProgress writes every progress event as a line of JSON, for other
+// programs to follow the run
+type JSONProgress struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+// NewJSONProgress creates a progress observer writing JSON lines to a writer
+func NewJSONProgress(writer io.Writer) *JSONProgress {
+	return &JSONProgress{writer: writer}
+}
+
+// jsonEvent is a progress event as written by JSONProgress
+type jsonEvent struct {
+	Time          string   `json:"time"`
+	Event         string   `json:"event"`
+	Zone          string   `json:"zone,omitempty"`
+	Step          string   `json:"step,omitempty"`
+	ZoomLevels    []int    `json:"zoom_levels,omitempty"`
+	Tile          string   `json:"tile,omitempty"`
+	Tiles         int      `json:"tiles,omitempty"`
+	Requests      int      `json:"requests,omitempty"`
+	EstimatedSize int64    `json:"estimated_size,omitempty"`
+	Bytes         int64    `json:"bytes,omitempty"`
+	DurationMs    float64  `json:"duration_ms,omitempty"`
+	Cached        bool     `json:"cached,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	Summary       *Summary `json:"summary,omitempty"`
+}
+
+func (p *JSONProgress) write(event jsonEvent) {
+	event.Time = time.Now().Format(time.RFC3339Nano)
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, _ = p.writer.Write(append(data, '\n'))
+}
+
+func (p *JSONProgress) tileEvent(name string, event TileEvent) jsonEvent {
+	encoded := jsonEvent{
+		Event:      name,
+		Zone:       event.Zone,
+		Step:       event.Step,
+		Tile:       event.Tile.String(),
+		Bytes:      event.Bytes,
+		DurationMs: float64(event.Duration.Microseconds()) / 1000,
+		Cached:     event.Cached,
+	}
+	if event.Err != nil {
+		encoded.Error = event.Err.Error()
+	}
+	return encoded
+}
+
+func (p *JSONProgress) PlanComputed(event PlanEvent) {
+	p.write(jsonEvent{
+		Event:         "plan_computed",
+		Zone:          event.Zone,
+		Step:          event.Step,
+		ZoomLevels:    event.ZoomLevels,
+		Tiles:         event.Tiles,
+		Requests:      event.Requests,
+		EstimatedSize: event.EstimatedSize,
+	})
+}
+
+func (p *JSONProgress) TileStarted(event TileEvent) {
+	p.write(p.tileEvent("tile_started", event))
+}
+
+func (p *JSONProgress) TileSaved(event TileEvent) {
+	p.write(p.tileEvent("tile_saved", event))
+}
+
+func (p *JSONProgress) TileFailed(event TileEvent) {
+	p.write(p.tileEvent("tile_failed", event))
+}
+
+func (p *JSONProgress) ZoneFinished(event ZoneEvent) {
+	p.write(jsonEvent{
+		Event:      "zone_finished",
+		Zone:       event.Zone,
+		DurationMs: float64(event.Summary.Duration.Microseconds()) / 1000,
+		Summary:    &event.Summary,
+	})
+}
+
+// obtainTile reports a tile of a step to the progress observer while obtain
+// stores it
+func (m *MeshtasticTileDownloader) obtainTile(step string, tile TileCoord, splitting bool, obtain func() error) error {
+	event := TileEvent{Zone: m.zone, Step: step, Tile: tile, Cached: m.IsStored(tile, splitting)}
+	m.progress.TileStarted(event)
+
+	startTime := time.Now()
+	err := obtain()
+	event.Duration = time.Since(startTime)
+	if isContextError(err) {
+		return err // not a failure of the tile, which is left for the next run
+	}
+	if err != nil {
+		event.Err = err
+		m.reportTile(event, splitting)
+		m.progress.TileFailed(event)
+		return err
+	}
+
+	event.Bytes = m.StoredSize(tile, splitting)
+	m.reportTile(event, splitting)
+	m.progress.TileSaved(event)
+	return nil
+}
@@ -0,0 +1,127 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// decodeEvents decodes the JSON lines written by JSONProgress
+func decodeEvents(t *testing.T, data []byte) []jsonEvent {
+	t.Helper()
+	var events []jsonEvent
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var event jsonEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("line %q isn't a JSON event: %v", scanner.Text(), err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, event.Time); err != nil {
+			t.Errorf("event %s has no valid time: %v", event.Event, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestJSONProgress(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path == "/9/243/189.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(encodeTestTile(t, color.White, false))
+	}))
+	defer server.Close()
+
+	zone := testZone("42.24,-8.78,42.20,-8.67", 8, 9)
+	config := Config{
+		Zones:     map[string]Zone{"Vigo": zone},
+		Map:       MapConfig{Provider: "custom", Downsample: 8},
+		Providers: map[string]ProviderConfig{"custom": {URL: server.URL + "/{z}/{x}/{y}.png"}},
+	}
+
+	for _, test := range []struct {
+		name     string
+		dryRun   bool
+		requests int32
+		failed   []string
+		summary  Summary
+	}{
+		{"run", false, 5, []string{"9/243/189"}, Summary{Tiles: 4, Requests: 4, Downloaded: 3, Failed: 1, Built: 1}},
+		{"dry run", true, 0, nil, Summary{Tiles: 4, Requests: 4, Downloaded: 4, Built: 1}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var output bytes.Buffer
+			requests.Store(0)
+			m := NewMeshtasticTileDownloader(Options{OutputDirectory: t.TempDir(), DryRun: test.dryRun, Progress: NewJSONProgress(&output)})
+			m.SetConfig(config)
+			if _, err := m.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := requests.Load(); got != test.requests {
+				t.Errorf("%d requests, want %d", got, test.requests)
+			}
+
+			events := decodeEvents(t, output.Bytes())
+			if len(events) == 0 {
+				t.Fatal("no events written")
+			}
+
+			// Both steps are planned before their tiles, and every started tile ends
+			var steps, failed []string
+			var started string
+			for _, event := range events[:len(events)-1] {
+				if event.Zone != "Vigo" {
+					t.Errorf("event %s of zone %q, want Vigo", event.Event, event.Zone)
+				}
+				switch event.Event {
+				case "plan_computed":
+					steps = append(steps, event.Step)
+				case "tile_started":
+					if started != "" {
+						t.Errorf("tile %s started before %s ended", event.Tile, started)
+					}
+					started = event.Tile
+				case "tile_saved", "tile_failed":
+					if event.Tile != started {
+						t.Errorf("%s of tile %s, want %s", event.Event, event.Tile, started)
+					}
+					if event.Event == "tile_failed" {
+						failed = append(failed, event.Tile)
+						if !strings.Contains(event.Error, "404") {
+							t.Errorf("tile %s failed with %q, want the 404", event.Tile, event.Error)
+						}
+					}
+					started = ""
+				default:
+					t.Errorf("unexpected event %s", event.Event)
+				}
+			}
+			if strings.Join(steps, ",") != "download,downsample" {
+				t.Errorf("planned steps = %v, want download then downsample", steps)
+			}
+			if strings.Join(failed, ",") != strings.Join(test.failed, ",") {
+				t.Errorf("failed tiles = %v, want %v", failed, test.failed)
+			}
+
+			last := events[len(events)-1]
+			if last.Event != "zone_finished" || last.Summary == nil {
+				t.Fatalf("last event = %+v, want the zone finished", last)
+			}
+			if summary := *last.Summary; summary != test.summary {
+				t.Errorf("zone summary = %+v, want %+v", summary, test.summary)
+			}
+		})
+	}
+}
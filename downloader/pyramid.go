@@ -0,0 +1,363 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"golang.org/x/image/draw"
+)
+
+// tileSize is the width and height in pixels of a standard map tile
+const tileSize = 256
+
+// SplitZoomLevels separates the zoom levels that must be fetched from the provider
+// from the ones that can be built locally by downsampling the next deeper zoom.
+// The deepest zoom and every zoom below the downsample cutoff are always fetched.
+func (m *MeshtasticTileDownloader) SplitZoomLevels(zoomLevels []int) (fetch, build []int) {
+	cutoff := m.config.Map.Downsample
+	if cutoff <= 0 || len(zoomLevels) == 0 {
+		return zoomLevels, nil
+	}
+
+	deepest := zoomLevels[0]
+	for _, zoom := range zoomLevels {
+		if zoom > deepest {
+			deepest = zoom
+		}
+	}
+
+	for _, zoom := range zoomLevels {
+		if zoom < deepest && zoom >= cutoff {
+			build = append(build, zoom)
+		} else {
+			fetch = append(fetch, zoom)
+		}
+	}
+	return fetch, build
+}
+
+// SplitOverzoomLevels separates the zoom levels served by the provider from the
+// ones beyond its maximum zoom, which have to be synthesized
+func (m *MeshtasticTileDownloader) SplitOverzoomLevels(zoomLevels []int) (served, overzoom []int) {
+	maxZoom := m.ProviderMaxZoom()
+	if maxZoom <= 0 {
+		return zoomLevels, nil
+	}
+
+	for _, zoom := range zoomLevels {
+		if zoom > maxZoom {
+			overzoom = append(overzoom, zoom)
+		} else {
+			served = append(served, zoom)
+		}
+	}
+	return served, overzoom
+}
+
+// PyramidPlan lists the tiles of a pyramid by how each one is obtained
+type PyramidPlan struct {
+	Fetch      []TileCoord `yaml:"fetch"`                // downloaded from the provider
+	Downsample []TileCoord `yaml:"downsample,omitempty"` // built from their four children
+	Overzoom   []TileCoord `yaml:"overzoom,omitempty"`   // upscaled from their ancestor at the provider maximum zoom
+	Annotate   []TileCoord `yaml:"annotate,omitempty"`   // already stored, only their annotations are drawn again
+}
+
+// Tiles returns every tile of the pyramid obtained, leaving out the ones only annotated
+func (p PyramidPlan) Tiles() []TileCoord {
+	return slices.Concat(p.Fetch, p.Downsample, p.Overzoom)
+}
+
+// PlanPyramid lists every tile of the given areas, split by whether it is
+// downloaded or built locally from other zoom levels
+func (m *MeshtasticTileDownloader) PlanPyramid(areas []Area) PyramidPlan {
+	zoomLevels := AreaZoomLevels(areas)
+	served, overzoom := m.SplitOverzoomLevels(zoomLevels)
+	fetch, build := m.SplitZoomLevels(served)
+
+	fetchTiles, downsampleTiles := coverChildren(m.PlanAreas(areas, fetch), m.PlanAreas(areas, build))
+	return PyramidPlan{
+		Fetch:      fetchTiles,
+		Downsample: downsampleTiles,
+		Overzoom:   m.PlanAreas(areas, overzoom),
+	}
+}
+
+// coverChildren adds the missing children of every tile to downsample, down
+// to the deepest fetched zoom, so tiles on the edge of an area are built like
+// the others instead of being downloaded at every zoom level. A tile with no
+// planned children at all, as when only another area goes deeper, is fetched.
+func coverChildren(fetch, downsample []TileCoord) ([]TileCoord, []TileCoord) {
+	if len(downsample) == 0 {
+		return fetch, downsample
+	}
+
+	planned := make(map[TileCoord]bool)
+	deepest := 0
+	for _, tile := range fetch {
+		planned[tile] = true
+		deepest = max(deepest, tile.Zoom)
+	}
+	for _, tile := range downsample {
+		planned[tile] = true
+	}
+
+	// Tiles needed to build the tiles of the zoom level above them
+	required := make(map[TileCoord]bool)
+	requiredAtZoom := make(map[int][]TileCoord)
+
+	var build []TileCoord
+	zoomLevels := TileZoomLevels(downsample)
+	for zoom := zoomLevels[0]; zoom < deepest; zoom++ {
+		for _, tile := range slices.Concat(TilesAtZoom(downsample, zoom), requiredAtZoom[zoom]) {
+			if !required[tile] && !slices.ContainsFunc(tile.Children(), func(child TileCoord) bool { return planned[child] }) {
+				fetch = append(fetch, tile)
+				continue
+			}
+
+			build = append(build, tile)
+			for _, child := range tile.Children() {
+				if planned[child] || required[child] {
+					continue
+				}
+				if child.Zoom == deepest {
+					fetch = append(fetch, child)
+					planned[child] = true
+				} else {
+					required[child] = true
+					requiredAtZoom[child.Zoom] = append(requiredAtZoom[child.Zoom], child)
+				}
+			}
+		}
+	}
+	return fetch, build
+}
+
+// ObtainPyramid obtains every zoom level of the given areas, downloading only
+// what can't be built locally from other zoom levels
+func (m *MeshtasticTileDownloader) ObtainPyramid(ctx context.Context, areas []Area) (Summary, error) {
+	return m.ExecutePyramid(ctx, m.PlanPyramid(areas))
+}
+
+// ExecutePyramid obtains the tiles of a pyramid plan
+func (m *MeshtasticTileDownloader) ExecutePyramid(ctx context.Context, plan PyramidPlan) (Summary, error) {
+	defer func() {
+		if err := m.SaveTileMetadata(); err != nil {
+			slog.Error("Error saving tile metadata", "error", err)
+		}
+	}()
+
+	m.reportPlan(plan.Tiles())
+
+	// Count what is left when the context stops the pyramid
+	interrupted := func(summary Summary, remaining int, err error) (Summary, error) {
+		if ctx.Err() != nil {
+			summary.Remaining += remaining
+			summary.Interrupted = true
+		}
+		return summary, err
+	}
+
+	summary, err := m.ObtainTiles(ctx, plan.Fetch)
+	if err != nil {
+		return interrupted(summary, len(plan.Downsample)+len(plan.Overzoom), err)
+	}
+
+	if len(plan.Downsample) > 0 {
+		slog.Info("Building zoom levels locally from deeper zoom levels", "zoom_levels", TileZoomLevels(plan.Downsample))
+		built, err := m.BuildDownsampledTiles(ctx, plan.Downsample)
+		summary = summary.Add(built)
+		if err != nil {
+			return interrupted(summary, len(plan.Downsample)-built.Built-built.Failed+len(plan.Overzoom), err)
+		}
+	}
+
+	if len(plan.Overzoom) > 0 {
+		slog.Info("Synthesizing zoom levels beyond the provider maximum zoom", "zoom_levels", TileZoomLevels(plan.Overzoom), "max_zoom", m.ProviderMaxZoom())
+		built, err := m.BuildOverzoomTiles(ctx, plan.Overzoom)
+		summary = summary.Add(built)
+		if err != nil {
+			return interrupted(summary, len(plan.Overzoom)-built.Built-built.Failed, err)
+		}
+	}
+
+	failed, err := m.AnnotateTiles(ctx, slices.Concat(plan.Tiles(), plan.Annotate))
+	summary.Failed += failed
+	return interrupted(summary, 0, err)
+}
+
+// BuildDownsampledTiles builds the given tiles by stitching the four children
+// of each tile and scaling them down. Zoom levels are processed from the
+// deepest up, so each level can be built from the previous one. It returns
+// how many tiles were built or failed before the context stopped it.
+func (m *MeshtasticTileDownloader) BuildDownsampledTiles(ctx context.Context, plannedTiles []TileCoord) (Summary, error) {
+	var summary Summary
+	zoomLevels := TileZoomLevels(plannedTiles)
+	for i := len(zoomLevels) - 1; i >= 0; i-- {
+		zoom := zoomLevels[i]
+		tiles := TilesAtZoom(plannedTiles, zoom)
+
+		m.progress.PlanComputed(PlanEvent{Zone: m.zone, Step: StepDownsample, ZoomLevels: []int{zoom}, Tiles: len(tiles), Requests: len(tiles)})
+		for _, tile := range tiles {
+			if err := ctx.Err(); err != nil {
+				return summary, err
+			}
+			err := m.obtainTile(StepDownsample, tile, false, func() error {
+				return m.BuildDownsampledTile(ctx, tile.Zoom, tile.X, tile.Y)
+			})
+			if isContextError(err) {
+				return summary, err
+			}
+			if err != nil {
+				summary.Failed++
+			} else {
+				summary.Built++
+			}
+		}
+	}
+
+	return summary, nil
+}
+
+// BuildDownsampledTile builds a single tile from its four children at zoom+1.
+// When any child is missing the tile is downloaded from the provider instead.
+func (m *MeshtasticTileDownloader) BuildDownsampledTile(ctx context.Context, zoom, x, y int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tilePath := m.TilePath(zoom, x, y)
+
+	// Skip if file already exists
+	if _, err := os.Stat(tilePath); err == nil {
+		slog.Debug("File already exists. Skipping", "path", tilePath)
+		return nil
+	}
+
+	size := m.OutputTileSize()
+	mosaic := image.NewRGBA(image.Rect(0, 0, 2*size, 2*size))
+	for dx := 0; dx < 2; dx++ {
+		for dy := 0; dy < 2; dy++ {
+			child, err := m.LoadTileImage(zoom+1, 2*x+dx, 2*y+dy)
+			if err != nil {
+				slog.Warn("Can't build tile locally. Downloading it instead", "tile", fmt.Sprintf("%d/%d/%d", zoom, x, y), "error", err)
+				return m.DownloadTile(ctx, zoom, x, y)
+			}
+			cell := image.Rect(dx*size, dy*size, (dx+1)*size, (dy+1)*size)
+			draw.CatmullRom.Scale(mosaic, cell, child, child.Bounds(), draw.Src, nil)
+		}
+	}
+
+	tile := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(tile, tile.Bounds(), mosaic, mosaic.Bounds(), draw.Src, nil)
+
+	if err := os.MkdirAll(filepath.Dir(tilePath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := m.SaveDerivedImage(tile, tilePath); err != nil {
+		return err
+	}
+
+	m.RecordTile(zoom, x, y, TileInfo{Synthesized: "downsample"})
+	return nil
+}
+
+// BuildOverzoomTiles synthesizes the given tiles beyond the provider maximum
+// zoom by cropping and upscaling their ancestor at the maximum zoom. It
+// returns how many tiles were built or failed before the context stopped it.
+func (m *MeshtasticTileDownloader) BuildOverzoomTiles(ctx context.Context, tiles []TileCoord) (Summary, error) {
+	var summary Summary
+	m.progress.PlanComputed(PlanEvent{Zone: m.zone, Step: StepOverzoom, ZoomLevels: TileZoomLevels(tiles), Tiles: len(tiles), Requests: len(tiles)})
+	for _, tile := range tiles {
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+		err := m.obtainTile(StepOverzoom, tile, false, func() error {
+			return m.BuildOverzoomTile(ctx, tile.Zoom, tile.X, tile.Y)
+		})
+		if isContextError(err) {
+			return summary, err
+		}
+		if err != nil {
+			summary.Failed++
+		} else {
+			summary.Built++
+		}
+	}
+
+	return summary, nil
+}
+
+// BuildOverzoomTile synthesizes a single tile from its ancestor at the provider
+// maximum zoom, downloading the ancestor first when it isn't stored yet
+func (m *MeshtasticTileDownloader) BuildOverzoomTile(ctx context.Context, zoom, x, y int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tilePath := m.TilePath(zoom, x, y)
+
+	// Skip if file already exists
+	if _, err := os.Stat(tilePath); err == nil {
+		slog.Debug("File already exists. Skipping", "path", tilePath)
+		return nil
+	}
+
+	maxZoom := m.ProviderMaxZoom()
+	depth := zoom - maxZoom
+	parentX, parentY := x>>depth, y>>depth
+
+	if _, err := os.Stat(m.TilePath(maxZoom, parentX, parentY)); err != nil {
+		if err := m.DownloadTile(ctx, maxZoom, parentX, parentY); err != nil {
+			return fmt.Errorf("failed to obtain parent tile: %w", err)
+		}
+	}
+
+	parent, err := m.LoadTileImage(maxZoom, parentX, parentY)
+	if err != nil {
+		return err
+	}
+
+	// Crop the part of the parent covered by this tile
+	bounds := parent.Bounds()
+	cropWidth := max(bounds.Dx()>>depth, 1)
+	cropHeight := max(bounds.Dy()>>depth, 1)
+	offsetX := (x - parentX<<depth) * bounds.Dx() >> depth
+	offsetY := (y - parentY<<depth) * bounds.Dy() >> depth
+	crop := image.Rect(offsetX, offsetY, offsetX+cropWidth, offsetY+cropHeight).Add(bounds.Min)
+
+	size := m.OutputTileSize()
+	tile := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(tile, tile.Bounds(), parent, crop, draw.Src, nil)
+
+	if err := os.MkdirAll(filepath.Dir(tilePath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := m.SaveDerivedImage(tile, tilePath); err != nil {
+		return err
+	}
+
+	m.RecordTile(zoom, x, y, TileInfo{Synthesized: "overzoom", From: fmt.Sprintf("%d/%d/%d", maxZoom, parentX, parentY)})
+	return nil
+}
+
+// SaveDerivedImage saves a tile built from stored tiles. Those already had
+// contrast and gamma applied, so only the profile quantization is repeated.
+func (m *MeshtasticTileDownloader) SaveDerivedImage(img image.Image, destination string) error {
+	render := m.config.Map.Render
+	m.config.Map.Render.Contrast, m.config.Map.Render.Gamma = 0, 0
+	defer func() { m.config.Map.Render = render }()
+
+	return m.SaveImage(img, destination)
+}
+
+// LoadTileImage loads a previously stored tile from disk
+func (m *MeshtasticTileDownloader) LoadTileImage(zoom, x, y int) (image.Image, error) {
+	imgData, err := os.ReadFile(m.TilePath(zoom, x, y))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tile %d/%d/%d: %w", zoom, x, y, err)
+	}
+	return m.LoadImageBytes(imgData)
+}
@@ -0,0 +1,155 @@
+package downloader
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPlanPyramidCoversEdges(t *testing.T) {
+	m := NewMeshtasticTileDownloader(Options{OutputDirectory: t.TempDir()})
+	m.SetConfig(Config{Map: MapConfig{Downsample: 10}})
+
+	zone := Region{MinLat: 42.20617, MinLon: -8.78276, MaxLat: 42.24285, MaxLon: -8.67122}
+	other := Region{MinLat: 40.41, MinLon: -3.71, MaxLat: 40.42, MaxLon: -3.70}
+	plan := m.PlanPyramid([]Area{
+		{Regions: []Region{zone}, ZoomLevels: []int{9, 10, 11, 12, 13}},
+		{Regions: []Region{other}, ZoomLevels: []int{10, 11}},
+	})
+
+	planned := make(map[TileCoord]bool)
+	for _, tile := range plan.Tiles() {
+		if planned[tile] {
+			t.Errorf("tile %s is planned twice", tile)
+		}
+		planned[tile] = true
+	}
+
+	// Every tile of the areas is still planned
+	for _, tile := range slices.Concat(m.PlanTiles([]Region{zone}, []int{9, 10, 11, 12, 13}), m.PlanTiles([]Region{other}, []int{10, 11})) {
+		if !planned[tile] {
+			t.Errorf("tile %s of the areas is not planned", tile)
+		}
+	}
+
+	// Every built tile has its four children, so none is downloaded as a fallback
+	for _, tile := range plan.Downsample {
+		for _, child := range tile.Children() {
+			if !planned[child] {
+				t.Errorf("child %s of built tile %s is not planned", child, tile)
+			}
+		}
+	}
+
+	// The other area doesn't go deeper than 11, so its tiles there are fetched
+	for _, tile := range m.PlanTiles([]Region{other}, []int{11}) {
+		if !slices.Contains(plan.Fetch, tile) {
+			t.Errorf("tile %s of the shallower area is not fetched", tile)
+		}
+	}
+	for _, tile := range m.PlanTiles([]Region{other}, []int{10}) {
+		if !slices.Contains(plan.Downsample, tile) {
+			t.Errorf("tile %s of the shallower area is not built", tile)
+		}
+	}
+
+	if zoomLevels := TileZoomLevels(plan.Downsample); !slices.Equal(zoomLevels, []int{10, 11, 12}) {
+		t.Errorf("built zoom levels = %v, want [10 11 12]", zoomLevels)
+	}
+}
+
+// writeTestTile stores a tile of the given size, filled with a single colour
+// or, without one, with 4px wide black and white vertical stripes
+func writeTestTile(t *testing.T, m *MeshtasticTileDownloader, tile TileCoord, size int, fill color.Color) {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for i := 0; i < size*size; i++ {
+		switch {
+		case fill != nil:
+			img.Set(i%size, i/size, fill)
+		case i%size/4%2 == 0:
+			img.Set(i%size, i/size, color.Black)
+		default:
+			img.Set(i%size, i/size, color.White)
+		}
+	}
+	path := m.TilePath(tile.Zoom, tile.X, tile.Y)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildDownsampledTile(t *testing.T) {
+	colors := map[TileCoord]color.NRGBA{
+		{Zoom: 6, X: 20, Y: 10}: {R: 0xff, A: 0xff},
+		{Zoom: 6, X: 21, Y: 10}: {G: 0xff, A: 0xff},
+		{Zoom: 6, X: 20, Y: 11}: {B: 0xff, A: 0xff},
+	}
+	striped := TileCoord{Zoom: 6, X: 21, Y: 11}
+
+	tests := []struct {
+		name string
+		size int
+		mapc MapConfig
+	}{
+		{"standard", 256, MapConfig{}},
+		{"retina keep", 512, MapConfig{Scale: 2, Retina: "keep"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMeshtasticTileDownloader(Options{OutputDirectory: t.TempDir()})
+			m.SetConfig(Config{Map: test.mapc})
+			for tile, fill := range colors {
+				writeTestTile(t, m, tile, test.size, fill)
+			}
+			writeTestTile(t, m, striped, test.size, nil)
+
+			if err := m.BuildDownsampledTile(context.Background(), 5, 10, 5); err != nil {
+				t.Fatalf("BuildDownsampledTile: %v", err)
+			}
+			img, err := m.LoadTileImage(5, 10, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := img.Bounds().Dx(); size != test.size || img.Bounds().Dy() != test.size {
+				t.Fatalf("tile size = %v, want %dpx", img.Bounds(), test.size)
+			}
+
+			// Each child fills a quadrant, sharp up to a few pixels from its edge
+			half := test.size / 2
+			for tile, want := range colors {
+				x := (tile.X - 20) * half
+				y := (tile.Y - 10) * half
+				for _, point := range []image.Point{{x + 3, y + 3}, {x + half - 4, y + half - 4}, {x + half/2, y + half/2}} {
+					if got := color.NRGBAModel.Convert(img.At(point.X, point.Y)); got != want {
+						t.Errorf("pixel %v = %v, want %v of child %s", point, got, want, tile)
+					}
+				}
+			}
+
+			// The stripes are halved, not blurred by a detour through a 256px tile
+			var darkest, lightest uint8 = 0xff, 0
+			for x := half + half/4; x < half+half*3/4; x++ {
+				gray := color.GrayModel.Convert(img.At(x, half+half/2)).(color.Gray).Y
+				darkest, lightest = min(darkest, gray), max(lightest, gray)
+			}
+			if lightest-darkest < 0x80 {
+				t.Errorf("stripes range from %d to %d, want them sharp", darkest, lightest)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package downloader
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPlaceRadiusKm is the radius covered around places without bounds
+const DefaultPlaceRadiusKm = 10
+
+// Region is a bounding box in degrees, the internal form of every region syntax
+type Region struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+}
+
+// String returns the region in the "minLat,minLon,maxLat,maxLon" notation of the configuration
+func (r Region) String() string {
+	return fmt.Sprintf("%.6f,%.6f,%.6f,%.6f", r.MinLat, r.MinLon, r.MaxLat, r.MaxLon)
+}
+
+// RegionConfig is a region of a zone, written in one of these forms:
+//
+//   - 42.24285,-8.78276,42.20617,-8.67122  # lat,long,lat,long
+//   - {north: 42.24, south: 42.20, east: -8.67, west: -8.78}
+//   - {center: [42.22, -8.72], radius_km: 5}
+//   - {file: shape.geojson}
+//   - Vigo  # or {place: Vigo, radius_km: 5}
+//   - 29TNG27  # MGRS grid square, geohash or Plus Code cell
+type RegionConfig struct {
+	Spec     string   // "lat,long,lat,long", grid reference or place name
+	North    *float64 `yaml:"north"`
+	South    *float64 `yaml:"south"`
+	East     *float64 `yaml:"east"`
+	West     *float64 `yaml:"west"`
+	Center   *Point   `yaml:"center"`
+	RadiusKm float64  `yaml:"radius_km"`
+	File     string   `yaml:"file"`
+	Place    string   `yaml:"place"`
+}
+
+// UnmarshalYAML reads a region from a string or a mapping
+func (r *RegionConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*r = RegionConfig{Spec: node.Value}
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: a region is a \"lat,long,lat,long\" string or a mapping", node.Line)
+	}
+
+	var fields struct {
+		North    *float64  `yaml:"north"`
+		South    *float64  `yaml:"south"`
+		East     *float64  `yaml:"east"`
+		West     *float64  `yaml:"west"`
+		Center   yaml.Node `yaml:"center"`
+		RadiusKm float64   `yaml:"radius_km"`
+		File     string    `yaml:"file"`
+		Place    string    `yaml:"place"`
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		switch key := node.Content[i]; key.Value {
+		case "north", "south", "east", "west", "center", "radius_km", "file", "place":
+		default:
+			return fmt.Errorf("line %d: unknown region setting '%s'. Known: north, south, east, west, center, radius_km, file, place", key.Line, key.Value)
+		}
+	}
+	if err := node.Decode(&fields); err != nil {
+		return err
+	}
+
+	*r = RegionConfig{
+		North: fields.North, South: fields.South, East: fields.East, West: fields.West,
+		RadiusKm: fields.RadiusKm, File: fields.File, Place: fields.Place,
+	}
+	if fields.Center.Kind != 0 {
+		center, err := parseCenter(&fields.Center)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid region center: %w", fields.Center.Line, err)
+		}
+		r.Center = &center
+	}
+	return nil
+}
+
+// MarshalYAML writes a region in the form it was read in
+func (r RegionConfig) MarshalYAML() (interface{}, error) {
+	if r.Spec != "" {
+		return r.Spec, nil
+	}
+
+	type fields struct {
+		North    *float64  `yaml:"north,omitempty"`
+		South    *float64  `yaml:"south,omitempty"`
+		East     *float64  `yaml:"east,omitempty"`
+		West     *float64  `yaml:"west,omitempty"`
+		Center   []float64 `yaml:"center,omitempty,flow"`
+		RadiusKm float64   `yaml:"radius_km,omitempty"`
+		File     string    `yaml:"file,omitempty"`
+		Place    string    `yaml:"place,omitempty"`
+	}
+	region := fields{North: r.North, South: r.South, East: r.East, West: r.West, RadiusKm: r.RadiusKm, File: r.File, Place: r.Place}
+	if r.Center != nil {
+		region.Center = []float64{r.Center.Lat, r.Center.Long}
+	}
+	return region, nil
+}
+
+// parseCenter reads a center written as [lat, long], or as a position in any
+// of the formats of ParseCoordinate
+func parseCenter(node *yaml.Node) (Point, error) {
+	if node.Kind == yaml.ScalarNode {
+		point, _, err := ParseCoordinate(node.Value)
+		return point, err
+	}
+
+	var values []string
+	if node.Kind == yaml.SequenceNode {
+		for _, item := range node.Content {
+			values = append(values, item.Value)
+		}
+	}
+	if len(values) != 2 {
+		return Point{}, fmt.Errorf("expected [lat, long] or a position")
+	}
+
+	lat, err := strconv.ParseFloat(strings.TrimSpace(values[0]), 64)
+	if err != nil {
+		return Point{}, fmt.Errorf("invalid latitude: %w", err)
+	}
+	long, err := strconv.ParseFloat(strings.TrimSpace(values[1]), 64)
+	if err != nil {
+		return Point{}, fmt.Errorf("invalid longitude: %w", err)
+	}
+	return Point{Lat: lat, Long: long}, nil
+}
+
+// ResolveRegion normalizes a region into bounding boxes. Boxes crossing the
+// antimeridian are split in two, and GeoJSON files give one box per feature.
+func (m *MeshtasticTileDownloader) ResolveRegion(region RegionConfig) ([]Region, error) {
+	bounded := region.North != nil || region.South != nil || region.East != nil || region.West != nil
+	forms := 0
+	for _, used := range []bool{region.Spec != "", bounded, region.Center != nil, region.File != "", region.Place != ""} {
+		if used {
+			forms++
+		}
+	}
+	if forms != 1 {
+		return nil, fmt.Errorf("a region needs exactly one of: a \"lat,long,lat,long\" string, north/south/east/west, center and radius_km, file, or place")
+	}
+
+	switch {
+	case region.Spec != "" && strings.Trim(region.Spec, "0123456789.,+- ") == "":
+		minLat, minLon, maxLat, maxLon, err := ParseRegion(region.Spec)
+		if err != nil {
+			return nil, err
+		}
+		return []Region{{MinLat: minLat, MinLon: minLon, MaxLat: maxLat, MaxLon: maxLon}}, nil
+	case region.Spec != "" && IsCoordinate(region.Spec):
+		_, cell, err := ParseCoordinate(region.Spec)
+		if err != nil {
+			return nil, err
+		}
+		if cell == nil {
+			return nil, fmt.Errorf("%s is a position, not an area. Use {center: \"%s\", radius_km: ...}", region.Spec, region.Spec)
+		}
+		return []Region{*cell}, nil
+	case bounded:
+		if region.North == nil || region.South == nil || region.East == nil || region.West == nil {
+			return nil, fmt.Errorf("bounded regions need north, south, east and west")
+		}
+		if *region.South > *region.North {
+			return nil, fmt.Errorf("south (%g) is north of north (%g)", *region.South, *region.North)
+		}
+		return splitAntimeridian(*region.South, *region.West, *region.North, *region.East), nil
+	case region.Center != nil:
+		if region.RadiusKm <= 0 {
+			return nil, fmt.Errorf("regions with a center need a radius_km greater than 0")
+		}
+		return m.RadiusRegions(*region.Center, region.RadiusKm), nil
+	case region.Spec != "":
+		// Any other string is a place name
+		region.Place = region.Spec
+		fallthrough
+	case region.Place != "":
+		place, err := m.ResolvePlace(region.Place)
+		if err != nil {
+			return nil, err
+		}
+		// Places without bounds, or with an explicit radius, cover a radius around their centroid
+		if place.Bounds != nil && region.RadiusKm == 0 {
+			return splitAntimeridian(place.Bounds.MinLat, place.Bounds.MinLon, place.Bounds.MaxLat, place.Bounds.MaxLon), nil
+		}
+		radiusKm := region.RadiusKm
+		if radiusKm <= 0 {
+			radiusKm = DefaultPlaceRadiusKm
+		}
+		return m.RadiusRegions(place.Point, radiusKm), nil
+	default:
+		features, err := LoadGeoJSON(region.File)
+		if err != nil {
+			return nil, err
+		}
+		var regions []Region
+		for _, feature := range features {
+			if minLat, minLon, maxLat, maxLon, ok := feature.Bounds(); ok {
+				regions = append(regions, Region{MinLat: minLat, MinLon: minLon, MaxLat: maxLat, MaxLon: maxLon})
+			}
+		}
+		if len(regions) == 0 {
+			return nil, fmt.Errorf("GeoJSON file %s has no geometry", region.File)
+		}
+		return regions, nil
+	}
+}
+
+// ZoneRegions returns the bounding boxes of every region of a zone
+func (m *MeshtasticTileDownloader) ZoneRegions(zone Zone) ([]Region, error) {
+	var regions []Region
+	for _, region := range zone.Regions {
+		resolved, err := m.ResolveRegion(region)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, resolved...)
+	}
+	return regions, nil
+}
+
+// RadiusRegions returns the bounding boxes covering a radius around a point
+func (m *MeshtasticTileDownloader) RadiusRegions(center Point, radiusKm float64) []Region {
+	minLat, minLon, maxLat, maxLon := PointRadiusBounds(center, radiusKm)
+	minLat = math.Max(minLat, -maxMercatorLat)
+	maxLat = math.Min(maxLat, maxMercatorLat)
+	return splitAntimeridian(minLat, minLon, maxLat, maxLon)
+}
+
+// splitAntimeridian returns a bounding box, split in two when its west edge
+// is east of its east edge because it crosses the antimeridian
+func splitAntimeridian(minLat, west, maxLat, east float64) []Region {
+	if west <= east {
+		return []Region{{MinLat: minLat, MinLon: west, MaxLat: maxLat, MaxLon: east}}
+	}
+	return []Region{
+		{MinLat: minLat, MinLon: west, MaxLat: maxLat, MaxLon: 180},
+		{MinLat: minLat, MinLon: -180, MaxLat: maxLat, MaxLon: east},
+	}
+}
@@ -0,0 +1,97 @@
+package downloader
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRadiusRegionsAntimeridian(t *testing.T) {
+	m := NewMeshtasticTileDownloader(Options{})
+	regions := m.RadiusRegions(Point{Lat: -17.8, Long: 179.9}, 30)
+	if len(regions) != 2 {
+		t.Fatalf("regions = %v, want the radius split in two at the antimeridian", regions)
+	}
+
+	for zoom := 0; zoom <= 12; zoom++ {
+		for _, region := range regions {
+			minX, maxX, minY, maxY := TileRange(region.MinLat, region.MinLon, region.MaxLat, region.MaxLon, zoom)
+			if minX < 0 || maxX >= 1<<zoom || minY < 0 || maxY >= 1<<zoom {
+				t.Errorf("zoom %d: region %v plans tiles x %d-%d, y %d-%d out of the %d tiles of the level", zoom, region, minX, maxX, minY, maxY, 1<<zoom)
+			}
+		}
+	}
+}
+
+func TestTileRangeEdges(t *testing.T) {
+	minX, maxX, minY, maxY := TileRange(-maxMercatorLat, -180, maxMercatorLat, 180, 4)
+	if minX != 0 || maxX != 15 || minY != 0 || maxY != 15 {
+		t.Errorf("world at zoom 4 = x %d-%d, y %d-%d, want x 0-15, y 0-15", minX, maxX, minY, maxY)
+	}
+}
+
+func TestRegionConfigUnmarshalYAML(t *testing.T) {
+	north, south, east, west := 42.24, 42.20, -8.67, -8.78
+	tests := []struct {
+		yaml string
+		want RegionConfig
+	}{
+		{`42.24285,-8.78276,42.20617,-8.67122`, RegionConfig{Spec: "42.24285,-8.78276,42.20617,-8.67122"}},
+		{`Vigo`, RegionConfig{Spec: "Vigo"}},
+		{`29TNG27`, RegionConfig{Spec: "29TNG27"}},
+		{`{north: 42.24, south: 42.20, east: -8.67, west: -8.78}`, RegionConfig{North: &north, South: &south, East: &east, West: &west}},
+		{`{center: [42.23, -8.72], radius_km: 5}`, RegionConfig{Center: &Point{Lat: 42.23, Long: -8.72}, RadiusKm: 5}},
+		{`{file: vigo.geojson}`, RegionConfig{File: "vigo.geojson"}},
+		{`{place: Vigo, radius_km: 3}`, RegionConfig{Place: "Vigo", RadiusKm: 3}},
+	}
+	for _, test := range tests {
+		var got RegionConfig
+		if err := yaml.Unmarshal([]byte(test.yaml), &got); err != nil {
+			t.Errorf("%s: %v", test.yaml, err)
+			continue
+		}
+		if !sameRegionConfig(got, test.want) {
+			t.Errorf("%s = %+v, want %+v", test.yaml, got, test.want)
+		}
+	}
+
+	// Centers accept the positions of ParseCoordinate
+	var region RegionConfig
+	if err := yaml.Unmarshal([]byte(`{center: "29T 526000 4675000", radius_km: 5}`), &region); err != nil {
+		t.Fatal(err)
+	}
+	want, _, _ := ParseCoordinate("29T 526000 4675000")
+	if region.Center == nil || *region.Center != want {
+		t.Errorf("UTM center = %v, want %v", region.Center, want)
+	}
+}
+
+func TestRegionConfigUnmarshalYAMLInvalid(t *testing.T) {
+	tests := []struct {
+		yaml, want string
+	}{
+		{`{nort: 42.24, south: 42.20, east: -8.67, west: -8.78}`, "unknown region setting 'nort'"},
+		{`[42.24, -8.78]`, "is a \"lat,long,lat,long\" string or a mapping"},
+		{`{center: [42.23], radius_km: 5}`, "invalid region center"},
+		{`{center: [42.23, west], radius_km: 5}`, "invalid longitude"},
+		{`{center: "nowhere", radius_km: 5}`, "invalid region center"},
+		{`{north: north}`, "cannot unmarshal"},
+	}
+	for _, test := range tests {
+		var region RegionConfig
+		err := yaml.Unmarshal([]byte(test.yaml), &region)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error = %v, want it to contain %q", test.yaml, err, test.want)
+		}
+	}
+}
+
+// sameRegionConfig compares region configurations by the values of their fields
+func sameRegionConfig(a, b RegionConfig) bool {
+	sameFloat := func(x, y *float64) bool { return x == nil && y == nil || x != nil && y != nil && *x == *y }
+	samePoint := func(x, y *Point) bool { return x == nil && y == nil || x != nil && y != nil && *x == *y }
+	return a.Spec == b.Spec && a.RadiusKm == b.RadiusKm && a.File == b.File && a.Place == b.Place &&
+		sameFloat(a.North, b.North) && sameFloat(a.South, b.South) && sameFloat(a.East, b.East) && sameFloat(a.West, b.West) &&
+		samePoint(a.Center, b.Center)
+}
@@ -0,0 +1,195 @@
+package downloader
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// RenderConfig selects how tiles are rendered before being saved
+type RenderConfig struct {
+	Profile  string  `yaml:"profile"`  // color, grayscale, gray4 or mono
+	Dither   string  `yaml:"dither"`   // none, ordered or diffusion
+	Contrast float64 `yaml:"contrast"` // 1.0 keeps the original contrast
+	Gamma    float64 `yaml:"gamma"`    // 1.0 keeps the original brightness
+}
+
+// KnownRenderProfiles returns the number of gray levels of each rendering profile.
+// Zero means the profile keeps colours.
+func KnownRenderProfiles() map[string]int {
+	return map[string]int{
+		"color":     0,
+		"grayscale": 256,
+		"gray4":     4,
+		"mono":      2,
+	}
+}
+
+// KnownDitherModes returns the supported dithering modes
+func KnownDitherModes() []string {
+	return []string{"none", "ordered", "diffusion"}
+}
+
+// Validate checks the rendering profile and dithering mode are known
+func (r RenderConfig) Validate() error {
+	if _, ok := KnownRenderProfiles()[r.Profile]; r.Profile != "" && !ok {
+		return fmt.Errorf("render profile '%s' is unknown. Known: color, grayscale, gray4, mono", r.Profile)
+	}
+
+	if r.Dither != "" {
+		known := false
+		for _, mode := range KnownDitherModes() {
+			known = known || r.Dither == mode
+		}
+		if !known {
+			return fmt.Errorf("dither mode '%s' is unknown. Known: %s", r.Dither, strings.Join(KnownDitherModes(), ", "))
+		}
+	}
+
+	if r.Contrast < 0 {
+		return fmt.Errorf("contrast must not be negative")
+	}
+	if r.Gamma < 0 {
+		return fmt.Errorf("gamma must not be negative")
+	}
+	return nil
+}
+
+// IsIdentity reports whether rendering leaves images untouched
+func (r RenderConfig) IsIdentity() bool {
+	return (r.Profile == "" || r.Profile == "color") &&
+		(r.Contrast == 0 || r.Contrast == 1) &&
+		(r.Gamma == 0 || r.Gamma == 1)
+}
+
+// tone applies contrast and gamma adjustments to a channel value in [0, 1]
+func (r RenderConfig) tone(v float64) float64 {
+	if r.Contrast > 0 && r.Contrast != 1 {
+		v = (v-0.5)*r.Contrast + 0.5
+	}
+	v = math.Max(0, math.Min(1, v))
+	if r.Gamma > 0 && r.Gamma != 1 {
+		v = math.Pow(v, 1/r.Gamma)
+	}
+	return v
+}
+
+// RenderImage applies the rendering profile to an image
+func (m *MeshtasticTileDownloader) RenderImage(img image.Image) image.Image {
+	render := m.config.Map.Render
+	if render.IsIdentity() {
+		return img
+	}
+
+	levels := KnownRenderProfiles()[render.Profile]
+	if levels == 0 {
+		return renderColor(img, render)
+	}
+
+	luma := grayLevels(img, render)
+	if levels == 256 {
+		return quantizeGray(luma, img.Bounds(), 256, "none")
+	}
+
+	dither := render.Dither
+	if dither == "" && levels == 2 {
+		dither = "ordered"
+	}
+	return quantizeGray(luma, img.Bounds(), levels, dither)
+}
+
+// renderColor applies contrast and gamma to every colour channel
+func renderColor(img image.Image, render RenderConfig) image.Image {
+	bounds := img.Bounds()
+	out := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			out.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(math.Round(render.tone(float64(c.R)/255) * 255)),
+				G: uint8(math.Round(render.tone(float64(c.G)/255) * 255)),
+				B: uint8(math.Round(render.tone(float64(c.B)/255) * 255)),
+				A: c.A,
+			})
+		}
+	}
+	return out
+}
+
+// grayLevels returns the toned luminance of every pixel in [0, 1], row by row.
+// Transparent areas are flattened onto white, as screens have no alpha.
+func grayLevels(img image.Image, render RenderConfig) []float64 {
+	bounds := img.Bounds()
+	luma := make([]float64, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			white := float64(0xffff - a)
+			v := (0.299*(float64(r)+white) + 0.587*(float64(g)+white) + 0.114*(float64(b)+white)) / 0xffff
+			luma = append(luma, render.tone(v))
+		}
+	}
+	return luma
+}
+
+// bayer4 is the 4x4 Bayer threshold matrix used for ordered dithering
+var bayer4 = [4][4]float64{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// quantizeGray reduces luminance values to the given number of evenly spaced
+// gray levels. Images with fewer than 256 levels are paletted, so the PNG
+// encoder writes them with 1 or 2 bits per pixel.
+func quantizeGray(luma []float64, bounds image.Rectangle, levels int, dither string) image.Image {
+	width := bounds.Dx()
+	steps := float64(levels - 1)
+	indexes := make([]uint8, len(luma))
+
+	for i := range luma {
+		x, y := i%width, i/width
+		v := luma[i] * steps
+
+		var level float64
+		switch dither {
+		case "ordered":
+			level = math.Floor(v + (bayer4[y%4][x%4]+0.5)/16)
+		default:
+			level = math.Round(v)
+		}
+		level = math.Max(0, math.Min(steps, level))
+		indexes[i] = uint8(level)
+
+		if dither == "diffusion" {
+			// Floyd-Steinberg: push the quantization error to the unvisited neighbours
+			quantError := (v - level) / steps
+			if x+1 < width {
+				luma[i+1] += quantError * 7 / 16
+			}
+			if i+width < len(luma) {
+				if x > 0 {
+					luma[i+width-1] += quantError * 3 / 16
+				}
+				luma[i+width] += quantError * 5 / 16
+				if x+1 < width {
+					luma[i+width+1] += quantError * 1 / 16
+				}
+			}
+		}
+	}
+
+	if levels == 256 {
+		return &image.Gray{Pix: indexes, Stride: width, Rect: bounds}
+	}
+
+	palette := make(color.Palette, levels)
+	for i := range palette {
+		gray := uint8(math.Round(float64(i) * 255 / steps))
+		palette[i] = color.Gray{Y: gray}
+	}
+	return &image.Paletted{Pix: indexes, Stride: width, Rect: bounds, Palette: palette}
+}
@@ -0,0 +1,147 @@
+package downloader
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// flatImage returns a 16x16 image of a single colour
+func flatImage(c color.Color) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < 16*16; i++ {
+		img.Set(i%16, i/16, c)
+	}
+	return img
+}
+
+// renderTest renders an image with the given settings
+func renderTest(render RenderConfig, img image.Image) image.Image {
+	m := NewMeshtasticTileDownloader(Options{})
+	m.SetConfig(Config{Map: MapConfig{Render: render}})
+	return m.RenderImage(img)
+}
+
+// countGray counts the pixels of each gray value of an image
+func countGray(img image.Image) map[uint8]int {
+	counts := make(map[uint8]int)
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			counts[color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y]++
+		}
+	}
+	return counts
+}
+
+func TestRenderProfiles(t *testing.T) {
+	gray := flatImage(color.Gray{Y: 128})
+
+	tests := []struct {
+		name    string
+		render  RenderConfig
+		img     image.Image
+		palette []uint8       // gray levels of the palette, nil for unpaletted images
+		want    map[uint8]int // pixel count of each gray value
+	}{
+		{"grayscale", RenderConfig{Profile: "grayscale"}, flatImage(color.NRGBA{R: 255, A: 255}), nil, map[uint8]int{76: 256}},
+		{"grayscale flattens transparency", RenderConfig{Profile: "grayscale"}, flatImage(color.Transparent), nil, map[uint8]int{255: 256}},
+		{"gray4", RenderConfig{Profile: "gray4"}, gray, []uint8{0, 85, 170, 255}, map[uint8]int{170: 256}},
+		{"gray4 ordered", RenderConfig{Profile: "gray4", Dither: "ordered"}, flatImage(color.Gray{Y: 212}), []uint8{0, 85, 170, 255}, map[uint8]int{170: 128, 255: 128}},
+		{"mono without dithering", RenderConfig{Profile: "mono", Dither: "none"}, gray, []uint8{0, 255}, map[uint8]int{255: 256}},
+		{"mono ordered by default", RenderConfig{Profile: "mono"}, gray, []uint8{0, 255}, map[uint8]int{0: 128, 255: 128}},
+		{"mono", RenderConfig{Profile: "mono"}, flatImage(color.Gray{Y: 96}), []uint8{0, 255}, map[uint8]int{0: 160, 255: 96}},
+		{"mono contrast", RenderConfig{Profile: "mono", Contrast: 3}, flatImage(color.Gray{Y: 96}), []uint8{0, 255}, map[uint8]int{0: 224, 255: 32}},
+		{"mono gamma", RenderConfig{Profile: "mono", Dither: "none", Gamma: 2}, flatImage(color.Gray{Y: 96}), []uint8{0, 255}, map[uint8]int{255: 256}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img := renderTest(test.render, test.img)
+			paletted, ok := img.(*image.Paletted)
+			if ok != (test.palette != nil) {
+				t.Fatalf("image is %T, want paletted %v", img, test.palette != nil)
+			}
+			if ok {
+				if len(paletted.Palette) != len(test.palette) {
+					t.Fatalf("palette has %d colours, want %d", len(paletted.Palette), len(test.palette))
+				}
+				for i, c := range paletted.Palette {
+					if c != (color.Gray{Y: test.palette[i]}) {
+						t.Errorf("palette colour %d = %v, want gray %d", i, c, test.palette[i])
+					}
+				}
+			}
+			counts := countGray(img)
+			if len(counts) != len(test.want) {
+				t.Errorf("gray values = %v, want %v", counts, test.want)
+			}
+			for value, count := range test.want {
+				if counts[value] != count {
+					t.Errorf("gray values = %v, want %v", counts, test.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestRenderOrderedDither(t *testing.T) {
+	// Half gray turns on the pixels of the upper half of the Bayer matrix
+	img := renderTest(RenderConfig{Profile: "mono", Dither: "ordered"}, flatImage(color.Gray{Y: 128}))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			want := uint8(0)
+			if bayer4[y%4][x%4] >= 8 {
+				want = 255
+			}
+			if got := color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y; got != want {
+				t.Fatalf("pixel %d,%d = %d, want %d", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestRenderDiffusionDither(t *testing.T) {
+	// Floyd-Steinberg keeps the average brightness
+	for _, value := range []uint8{32, 128, 200} {
+		img := renderTest(RenderConfig{Profile: "mono", Dither: "diffusion"}, flatImage(color.Gray{Y: value}))
+		white := countGray(img)[255]
+		want := float64(value) / 255 * 256
+		if math.Abs(float64(white)-want) > 8 {
+			t.Errorf("gray %d: %d white pixels, want about %.0f", value, white, want)
+		}
+		if counts := countGray(img); counts[0]+counts[255] != 256 {
+			t.Errorf("gray %d: gray values = %v, want only black and white", value, counts)
+		}
+	}
+
+	// Gray between two levels is drawn with both
+	img := renderTest(RenderConfig{Profile: "gray4", Dither: "diffusion"}, flatImage(color.Gray{Y: 128}))
+	if counts := countGray(img); counts[85] == 0 || counts[170] == 0 || counts[85]+counts[170] != 256 {
+		t.Errorf("gray values = %v, want a mix of the two nearest levels", counts)
+	}
+}
+
+func TestRenderColor(t *testing.T) {
+	tests := []struct {
+		name   string
+		render RenderConfig
+		in     color.NRGBA
+		want   color.NRGBA
+	}{
+		{"identity", RenderConfig{Contrast: 1, Gamma: 1}, color.NRGBA{R: 64, G: 128, B: 192, A: 200}, color.NRGBA{R: 64, G: 128, B: 192, A: 200}},
+		{"contrast", RenderConfig{Contrast: 1.5}, color.NRGBA{R: 64, G: 128, B: 255, A: 255}, color.NRGBA{R: 32, G: 128, B: 255, A: 255}},
+		{"gamma", RenderConfig{Gamma: 2}, color.NRGBA{R: 64, G: 255, A: 200}, color.NRGBA{R: 128, G: 255, A: 200}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img := renderTest(test.render, flatImage(test.in))
+			if got := color.NRGBAModel.Convert(img.At(5, 5)); got != test.want {
+				t.Errorf("pixel = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,358 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Categories of the errors of failed tiles in the run report
+const (
+	ErrorNetwork      = "network"       // the provider could not be reached
+	ErrorHTTPStatus   = "http_status"   // the provider answered with an error status
+	ErrorNotImage     = "not_image"     // the provider answered with something else than an image
+	ErrorInvalidImage = "invalid_image" // the image could not be decoded
+	ErrorStorage      = "storage"       // the tile could not be read or written on disk
+	ErrorOther        = "other"
+)
+
+// Report is the machine-readable record of a run: what was planned and
+// obtained for every zone and zoom level, and which tiles failed
+type Report struct {
+	Started     time.Time      `json:"started"`
+	Finished    time.Time      `json:"finished"`
+	DurationMs  float64        `json:"duration_ms"`
+	Provider    string         `json:"provider"`
+	Style       string         `json:"style"`
+	Config      any            `json:"config"` // configuration used, with its secrets redacted
+	Summary     Summary        `json:"summary"`
+	Bytes       int64          `json:"bytes"` // bytes written by the run
+	Complete    bool           `json:"complete"`
+	DryRun      bool           `json:"dry_run,omitempty"` // tiles were logged instead of being obtained
+	Error       string         `json:"error,omitempty"`
+	Zones       []*ZoneReport  `json:"zones"`
+	FailedTiles []FailedTile   `json:"failed_tiles"`
+	zones       map[string]int // index of each zone in Zones
+	output      string         // download directory the zone outputs are relative to
+}
+
+// ZoneReport records a zone, the points of point-radius mode or a plan job
+type ZoneReport struct {
+	Name       string        `json:"name"`
+	Provider   string        `json:"provider"`
+	Style      string        `json:"style"`
+	Output     string        `json:"output"` // relative to the download directory when inside it, empty for the directory itself
+	DurationMs float64       `json:"duration_ms"`
+	Summary    Summary       `json:"summary"`
+	Bytes      int64         `json:"bytes"`
+	ZoomLevels []*ZoomReport `json:"zoom_levels"`
+	failed     PlanJob       // failed tiles, with the map configuration to retry them
+}
+
+// ZoomReport counts the tiles of a zoom level of a zone. Tiles split from @2x
+// tiles are counted at their own zoom level.
+type ZoomReport struct {
+	Zoom       int     `json:"zoom"`
+	Planned    int     `json:"planned"`
+	Skipped    int     `json:"skipped"`    // already stored
+	Downloaded int     `json:"downloaded"` // downloaded from the providers
+	Reduced    int     `json:"reduced"`    // downloaded and reduced to 8 bits
+	Built      int     `json:"built"`      // built locally from other zoom levels
+	Failed     int     `json:"failed"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"` // time spent obtaining the tiles
+}
+
+// FailedTile is a tile that could not be obtained
+type FailedTile struct {
+	Zone     string `json:"zone"`
+	Step     string `json:"step"`
+	Tile     string `json:"tile"`
+	Category string `json:"category"`
+	Error    string `json:"error"`
+}
+
+// ErrorCategory classifies the error of a failed tile
+func ErrorCategory(err error) string {
+	var statusErr *StatusError
+	var netErr net.Error
+	var pathErr *fs.PathError
+	switch {
+	case errors.As(err, &statusErr):
+		return ErrorHTTPStatus
+	case errors.Is(err, ErrNotImage):
+		return ErrorNotImage
+	case errors.Is(err, ErrInvalidImage):
+		return ErrorInvalidImage
+	case errors.As(err, &netErr):
+		return ErrorNetwork
+	case errors.As(err, &pathErr):
+		return ErrorStorage
+	}
+	return ErrorOther
+}
+
+// Report returns the report of the last run, or nil before the first one
+func (m *MeshtasticTileDownloader) Report() *Report {
+	return m.report
+}
+
+// startReport begins the report of a run
+func (m *MeshtasticTileDownloader) startReport() {
+	provider, style := m.TileProvider(), m.MapStyle()
+	if m.plan != nil {
+		provider, style = m.plan.Source()
+	}
+	m.report = &Report{
+		Started:     time.Now(),
+		Provider:    provider,
+		Style:       style,
+		Config:      m.RedactedConfig(),
+		DryRun:      m.dryRun,
+		Zones:       []*ZoneReport{},
+		FailedTiles: []FailedTile{},
+		zones:       make(map[string]int),
+		output:      m.outputDirectory,
+	}
+}
+
+// finishReport completes the report of a run with its outcome
+func (m *MeshtasticTileDownloader) finishReport(summary Summary, err error) {
+	report := m.report
+	report.Finished = time.Now()
+	report.DurationMs = float64(report.Finished.Sub(report.Started).Microseconds()) / 1000
+	report.Summary = summary
+	report.Complete = !m.dryRun && err == nil && summary.Failed == 0 && len(report.FailedTiles) == 0 && summary.Remaining == 0 && !summary.Interrupted
+	if err != nil {
+		report.Error = m.RedactKey(err.Error())
+	}
+}
+
+// reportZone returns the report of the current zone, adding it when needed
+func (m *MeshtasticTileDownloader) reportZone() *ZoneReport {
+	if i, ok := m.report.zones[m.zone]; ok {
+		return m.report.Zones[i]
+	}
+
+	// Outputs inside the download directory are kept relative to it
+	output, err := filepath.Rel(m.report.output, m.outputDirectory)
+	if err != nil || !filepath.IsLocal(output) {
+		output = m.outputDirectory
+	} else if output == "." {
+		output = ""
+	}
+
+	zone := &ZoneReport{
+		Name:       m.zone,
+		Provider:   m.TileProvider(),
+		Style:      m.MapStyle(),
+		Output:     output,
+		ZoomLevels: []*ZoomReport{},
+		failed:     PlanJob{Name: m.zone, Output: output, Map: m.config.Map, Sources: m.PlanSources()},
+	}
+	m.report.zones[m.zone] = len(m.report.Zones)
+	m.report.Zones = append(m.report.Zones, zone)
+	return zone
+}
+
+// reportZoom returns the report of a zoom level of a zone, adding it when needed
+func (z *ZoneReport) reportZoom(zoom int) *ZoomReport {
+	i, found := slices.BinarySearchFunc(z.ZoomLevels, zoom, func(level *ZoomReport, zoom int) int {
+		return level.Zoom - zoom
+	})
+	if !found {
+		z.ZoomLevels = slices.Insert(z.ZoomLevels, i, &ZoomReport{Zoom: zoom})
+	}
+	return z.ZoomLevels[i]
+}
+
+// reportPlan records the tiles planned for the current zone
+func (m *MeshtasticTileDownloader) reportPlan(tiles []TileCoord) {
+	if m.report == nil {
+		return
+	}
+
+	zone := m.reportZone()
+	for _, tile := range tiles {
+		zone.reportZoom(tile.Zoom).Planned++
+	}
+}
+
+// reportTile records how a tile of the current zone was obtained. A split
+// @2x tile is recorded as its four children.
+func (m *MeshtasticTileDownloader) reportTile(event TileEvent, splitting bool) {
+	if m.report == nil {
+		return
+	}
+
+	tiles := []TileCoord{event.Tile}
+	if splitting {
+		tiles = event.Tile.Children()
+	}
+
+	zone := m.reportZone()
+	for _, tile := range tiles {
+		zoom := zone.reportZoom(tile.Zoom)
+		zoom.DurationMs += float64(event.Duration.Microseconds()) / 1000 / float64(len(tiles))
+		switch {
+		case event.Err != nil:
+			zoom.Failed++
+			switch event.Step {
+			case StepDownsample:
+				zone.failed.Downsample = append(zone.failed.Downsample, tile)
+			case StepOverzoom:
+				zone.failed.Overzoom = append(zone.failed.Overzoom, tile)
+			case StepAnnotate:
+				zone.failed.Annotate = append(zone.failed.Annotate, tile)
+			default:
+				zone.failed.Fetch = append(zone.failed.Fetch, tile)
+			}
+			m.report.FailedTiles = append(m.report.FailedTiles, FailedTile{
+				Zone:     m.zone,
+				Step:     event.Step,
+				Tile:     tile.String(),
+				Category: ErrorCategory(event.Err),
+				Error:    m.RedactKey(event.Err.Error()),
+			})
+		case event.Cached:
+			zoom.Skipped++
+		case event.Step == StepDownload:
+			zoom.Downloaded++
+			if !splitting && m.IsReducing(tile.Zoom) {
+				zoom.Reduced++
+			}
+		default:
+			zoom.Built++
+		}
+	}
+
+	if event.Err == nil && !event.Cached {
+		zoom := zone.reportZoom(tiles[0].Zoom)
+		zoom.Bytes += event.Bytes
+		zone.Bytes += event.Bytes
+		m.report.Bytes += event.Bytes
+	}
+}
+
+// finishZone tells the progress observer a zone is finished and records its summary
+func (m *MeshtasticTileDownloader) finishZone(name string, summary Summary) {
+	if m.report != nil {
+		if i, ok := m.report.zones[name]; ok {
+			zone := m.report.Zones[i]
+			zone.Summary = summary
+			zone.DurationMs = float64(summary.Duration.Microseconds()) / 1000
+		}
+	}
+	m.progress.ZoneFinished(ZoneEvent{Zone: name, Summary: summary})
+}
+
+// FailedPlan returns a plan of the tiles that failed in the last run, with the
+// map configuration of their zones to retry them, or nil when none failed
+func (m *MeshtasticTileDownloader) FailedPlan() *Plan {
+	if m.report == nil {
+		return nil
+	}
+
+	originalMap := m.config.Map
+	defer func() { m.config.Map = originalMap }()
+
+	plan := &Plan{Created: m.report.Finished.Format(time.RFC3339), Providers: m.config.Providers}
+	for _, zone := range m.report.Zones {
+		job := zone.failed
+		if len(job.PyramidPlan.Tiles()) == 0 && len(job.Annotate) == 0 {
+			continue
+		}
+		m.config.Map = job.Map
+		m.countPlanJob(&job)
+		plan.Jobs = append(plan.Jobs, job)
+	}
+	if len(plan.Jobs) == 0 {
+		return nil
+	}
+	plan.countPlan()
+	return plan
+}
+
+// WriteFailedPlan writes the plan of the tiles that failed in the last run to
+// a file, to be retried by loading it with LoadPlan. A previous file is
+// removed when no tile failed. It returns the plan written, if any.
+func (m *MeshtasticTileDownloader) WriteFailedPlan(path string) (*Plan, error) {
+	plan := m.FailedPlan()
+	if plan == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove previous failed tiles: %w", err)
+		}
+		return nil, nil
+	}
+	return plan, plan.Write(path)
+}
+
+// RedactedConfig returns the configuration in use as generic values, with the
+// API keys and the credentials of provider URLs redacted
+func (m *MeshtasticTileDownloader) RedactedConfig() any {
+	data, err := yaml.Marshal(m.config)
+	if err != nil {
+		return nil
+	}
+	var config any
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil
+	}
+	return m.redactSecrets(config)
+}
+
+// redactSecrets redacts the secrets of every string in a decoded configuration
+func (m *MeshtasticTileDownloader) redactSecrets(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, item := range value {
+			value[key] = m.redactSecrets(item)
+		}
+	case []any:
+		for i, item := range value {
+			value[i] = m.redactSecrets(item)
+		}
+	case string:
+		return m.RedactKey(redactURL(value))
+	}
+	return value
+}
+
+// redactURL redacts the password and the key or token query parameters of a
+// URL, keeping the placeholders of URL templates
+func redactURL(value string) string {
+	value = regexp.MustCompile(`(://[^:/@]+):[^@/]+@`).ReplaceAllString(value, "${1}:REDACTED@")
+	return regexp.MustCompile(`(?i)([?&][^=&]*(?:key|token|secret|password)[^=&]*=)([^&{][^&]*)`).ReplaceAllString(value, "${1}REDACTED")
+}
+
+// WriteReport writes the report of the last run to a JSON file
+func (m *MeshtasticTileDownloader) WriteReport(path string) error {
+	if m.report == nil {
+		return fmt.Errorf("no run to report")
+	}
+
+	data, err := json.MarshalIndent(m.report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+// isContextError reports whether an error comes from a cancelled context or
+// a passed deadline
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,173 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReportZoneOutput(t *testing.T) {
+	dir := t.TempDir()
+	m := NewMeshtasticTileDownloader(Options{OutputDirectory: dir})
+	m.startReport()
+
+	// Zones are reported with the same output as their failed tiles plan
+	for _, test := range []struct{ zone, directory, want string }{
+		{"Europe", dir, ""},
+		{"Vigo", filepath.Join(dir, "vigo"), "vigo"},
+		{"Elsewhere", filepath.Join(filepath.Dir(dir), "elsewhere"), filepath.Join(filepath.Dir(dir), "elsewhere")},
+	} {
+		m.zone, m.outputDirectory = test.zone, test.directory
+		zone := m.reportZone()
+		if zone.Output != test.want || zone.failed.Output != test.want {
+			t.Errorf("%s: output %q, failed tiles output %q, want %q", test.zone, zone.Output, zone.failed.Output, test.want)
+		}
+	}
+}
+
+func TestReportComplete(t *testing.T) {
+	tile := TileCoord{Zoom: 3, X: 1, Y: 2}
+	for _, test := range []struct {
+		name     string
+		summary  Summary
+		failed   bool
+		dryRun   bool
+		err      error
+		complete bool
+	}{
+		{"every tile obtained", Summary{Tiles: 1, Downloaded: 1}, false, false, nil, true},
+		{"download failed", Summary{Tiles: 1, Failed: 1}, true, false, nil, false},
+		{"tile failed without counting in the summary", Summary{Tiles: 1, Downloaded: 1}, true, false, nil, false},
+		{"interrupted", Summary{Tiles: 1, Remaining: 1, Interrupted: true}, false, false, nil, false},
+		{"dry run", Summary{Tiles: 1}, false, true, nil, false},
+		{"error", Summary{}, false, false, errors.New("no zones"), false},
+	} {
+		m := NewMeshtasticTileDownloader(Options{OutputDirectory: t.TempDir(), DryRun: test.dryRun})
+		m.startReport()
+		m.reportPlan([]TileCoord{tile})
+		if test.failed {
+			m.reportTile(TileEvent{Step: StepAnnotate, Tile: tile, Err: errors.New("broken tile")}, false)
+		}
+		m.finishReport(test.summary, test.err)
+		if m.Report().Complete != test.complete {
+			t.Errorf("%s: complete = %v, want %v", test.name, m.Report().Complete, test.complete)
+		}
+	}
+}
+
+func TestBuiltTilesFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	m := NewMeshtasticTileDownloader(Options{OutputDirectory: t.TempDir()})
+	m.SetConfig(Config{
+		Map:       MapConfig{Provider: "custom"},
+		Providers: map[string]ProviderConfig{"custom": {URL: server.URL + "/{z}/{x}/{y}.png", MaxZoom: 2}},
+	})
+	m.startReport()
+
+	tiles := []TileCoord{{Zoom: 3, X: 0, Y: 0}, {Zoom: 3, X: 1, Y: 0}}
+	m.reportPlan(tiles)
+	summary, err := m.BuildOverzoomTiles(context.Background(), tiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Failed != 2 || summary.Built != 0 {
+		t.Errorf("summary = %+v, want 2 failed tiles and none built", summary)
+	}
+
+	m.finishReport(summary, nil)
+	if report := m.Report(); report.Complete || len(report.FailedTiles) != 2 || report.FailedTiles[0].Step != StepOverzoom {
+		t.Errorf("report = complete %v, failed tiles %v, want the overzoom failures", report.Complete, report.FailedTiles)
+	}
+}
+
+func TestRetryFailedAnnotations(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(encodeTestTile(t, color.White, false))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	tile := TileCoord{Zoom: 5, X: 15, Y: 11}
+	lon := (TileXToLong(tile.X, tile.Zoom) + TileXToLong(tile.X+1, tile.Zoom)) / 2
+	lat := (TileYToLat(tile.Y, tile.Zoom) + TileYToLat(tile.Y+1, tile.Zoom)) / 2
+	annotations := filepath.Join(dir, "points.geojson")
+	geojson := fmt.Sprintf(`{"type":"Feature","geometry":{"type":"Point","coordinates":[%f,%f]},"properties":{}}`, lon, lat)
+	if err := os.WriteFile(annotations, []byte(geojson), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{
+		Map:       MapConfig{Provider: "custom", Annotations: AnnotationConfig{Files: []string{annotations}}},
+		Providers: map[string]ProviderConfig{"custom": {URL: server.URL + "/{z}/{x}/{y}.png"}},
+	}
+
+	// The stored tile is broken, so it is skipped and can't be annotated
+	m := NewMeshtasticTileDownloader(Options{OutputDirectory: filepath.Join(dir, "maps")})
+	m.SetConfig(config)
+	tilePath := m.TilePath(tile.Zoom, tile.X, tile.Y)
+	if err := os.MkdirAll(filepath.Dir(tilePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tilePath, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.LoadAnnotations(); err != nil {
+		t.Fatal(err)
+	}
+	m.startReport()
+	summary, err := m.ExecutePyramid(context.Background(), PyramidPlan{Fetch: []TileCoord{tile}})
+	m.finishReport(summary, err)
+	if err != nil || summary.Skipped != 1 || summary.Failed != 1 {
+		t.Fatalf("summary = %+v, %v, want the tile skipped and failed", summary, err)
+	}
+
+	failedFile := filepath.Join(dir, "failed-tiles.yaml")
+	plan, err := m.WriteFailedPlan(failedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan == nil || len(plan.Jobs) != 1 || len(plan.Jobs[0].PyramidPlan.Tiles()) != 0 || len(plan.Jobs[0].Annotate) != 1 || plan.Jobs[0].Annotate[0] != tile {
+		t.Fatalf("failed plan = %+v, want only %s to annotate", plan, tile)
+	}
+
+	// Retrying only annotates the repaired tile, without downloading it again
+	if err := os.WriteFile(tilePath, encodeTestTile(t, color.White, true), 0644); err != nil {
+		t.Fatal(err)
+	}
+	retry := NewMeshtasticTileDownloader(Options{OutputDirectory: filepath.Join(dir, "maps")})
+	if err := retry.LoadPlan(failedFile); err != nil {
+		t.Fatal(err)
+	}
+	retry.startReport()
+	summary, err = retry.RunPlan(context.Background())
+	retry.finishReport(summary, err)
+	if err != nil || summary.Failed != 0 || requests.Load() != 0 {
+		t.Errorf("retry = %+v, %v with %d requests, want the tile annotated without requests", summary, err, requests.Load())
+	}
+	metadata, err := retry.LoadTileMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metadata[retry.TileKey(tile.Zoom, tile.X, tile.Y)].Annotated {
+		t.Error("tile not annotated by the retry")
+	}
+
+	if plan, err := retry.WriteFailedPlan(failedFile); err != nil || plan != nil {
+		t.Errorf("failed plan after the retry = %+v, %v, want none", plan, err)
+	}
+	if _, err := os.Stat(failedFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("failed tiles file after the retry: %v, want it removed", err)
+	}
+}
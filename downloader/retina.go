@@ -0,0 +1,172 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// KnownRetinaModes returns how @2x tiles can be stored
+func KnownRetinaModes() []string {
+	return []string{"keep", "downscale", "split"}
+}
+
+// IsValidRetinaMode checks if the retina mode is known
+func (m *MeshtasticTileDownloader) IsValidRetinaMode() bool {
+	for _, mode := range KnownRetinaModes() {
+		if m.config.Map.Retina == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsScale checks if the provider can serve @2x tiles. WMS services render
+// tiles of any size, XYZ templates need a {{SCALE}} placeholder.
+func (m *MeshtasticTileDownloader) SupportsScale() bool {
+	if m.ProviderType() == "wms" {
+		return true
+	}
+	return m.ProviderType() == "xyz" && strings.Contains(m.ProviderURLTemplate(), "{{SCALE}}")
+}
+
+// ScaleSuffix returns the value of the {{SCALE}} URL placeholder
+func (m *MeshtasticTileDownloader) ScaleSuffix() string {
+	if m.config.Map.Scale == 2 {
+		return "@2x"
+	}
+	return ""
+}
+
+// IsSplittingRetina reports whether @2x tiles are split into four tiles at zoom+1
+func (m *MeshtasticTileDownloader) IsSplittingRetina() bool {
+	return m.config.Map.Scale == 2 && m.config.Map.Retina == "split"
+}
+
+// OutputTileSize returns the size in pixels of the tiles written to disk
+func (m *MeshtasticTileDownloader) OutputTileSize() int {
+	size := m.DeviceProfile().TileSize
+	if m.config.Map.Scale == 2 && m.config.Map.Retina == "keep" {
+		size *= 2
+	}
+	return size
+}
+
+// IsPassthrough reports whether PNG tiles from the provider can be stored untouched
+func (m *MeshtasticTileDownloader) IsPassthrough() bool {
+	device := m.DeviceProfile()
+	return device.Format == "png" && device.ColorDepth == 32 &&
+		m.OutputTileSize() == tileSize*max(m.config.Map.Scale, 1)
+}
+
+// RetinaParents maps tiles to the zoom-1 tiles whose @2x version covers them.
+// Requesting each parent once saves three requests out of four. Zoom 0 tiles
+// have no parent and are left out.
+func (m *MeshtasticTileDownloader) RetinaParents(tiles []TileCoord) []TileCoord {
+	var parents []TileCoord
+	seen := make(map[TileCoord]bool)
+
+	for _, tile := range tiles {
+		if tile.Zoom == 0 {
+			continue
+		}
+		parent := TileCoord{Zoom: tile.Zoom - 1, X: tile.X / 2, Y: tile.Y / 2}
+		if !seen[parent] {
+			seen[parent] = true
+			parents = append(parents, parent)
+		}
+	}
+	return parents
+}
+
+// RetinaRequests returns the tiles requested when splitting @2x tiles: the
+// zoom 0 tiles, which are requested as they are, followed by the parents of
+// the other tiles. It also returns how many zoom 0 tiles come first.
+func (m *MeshtasticTileDownloader) RetinaRequests(tiles []TileCoord) ([]TileCoord, int) {
+	requests := TilesAtZoom(tiles, 0)
+	direct := len(requests)
+	return append(requests, m.RetinaParents(tiles)...), direct
+}
+
+// DownloadSplitTile downloads the @2x version of a tile and splits it into
+// its four children at zoom+1
+func (m *MeshtasticTileDownloader) DownloadSplitTile(ctx context.Context, zoom, x, y int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	url := m.ParseURL(zoom, x, y)
+	redactedURL := m.RedactKey(url)
+
+	// Skip if every child already exists
+	missing := false
+	for dx := 0; dx < 2; dx++ {
+		for dy := 0; dy < 2; dy++ {
+			if _, err := os.Stat(m.TilePath(zoom+1, 2*x+dx, 2*y+dy)); err != nil {
+				missing = true
+			}
+		}
+	}
+	if !missing {
+		slog.Debug("Children already exist. Skipping", "tile", fmt.Sprintf("%d/%d/%d", zoom, x, y), "url", redactedURL)
+		return nil
+	}
+
+	// Skip download in dry-run mode
+	if m.IsDryRun() {
+		slog.Info("Dry run: not obtaining tile", "url", redactedURL, "would_split_into_zoom", zoom+1)
+		return nil
+	}
+
+	imgData, _, source, err := m.FetchTileWithFallback(ctx, zoom, x, y)
+	if err != nil {
+		return err
+	}
+
+	// Composite the overlay layers before splitting
+	if len(m.config.Map.Layers) > 0 {
+		imgData, err = m.ComposeLayers(ctx, imgData, zoom, x, y)
+		if err != nil {
+			return err
+		}
+	}
+
+	img, err := m.LoadImageBytes(imgData)
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("Splitting tile", "url", redactedURL, "zoom", zoom+1)
+	bounds := img.Bounds()
+	halfWidth, halfHeight := bounds.Dx()/2, bounds.Dy()/2
+	for dx := 0; dx < 2; dx++ {
+		for dy := 0; dy < 2; dy++ {
+			tilePath := m.TilePath(zoom+1, 2*x+dx, 2*y+dy)
+			if _, err := os.Stat(tilePath); err == nil {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(tilePath), 0755); err != nil {
+				return fmt.Errorf("failed to create directory: %w", err)
+			}
+
+			quadrant := image.Rect(dx*halfWidth, dy*halfHeight, (dx+1)*halfWidth, (dy+1)*halfHeight).Add(bounds.Min)
+			child := image.NewRGBA(image.Rect(0, 0, halfWidth, halfHeight))
+			draw.Draw(child, child.Bounds(), img, quadrant.Min, draw.Src)
+
+			if err := m.SaveImage(child, tilePath); err != nil {
+				return err
+			}
+			if len(m.config.Map.Fallback) > 0 {
+				m.RecordTile(zoom+1, 2*x+dx, 2*y+dy, TileInfo{Source: source.String()})
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package downloader
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestRetinaRequests(t *testing.T) {
+	tiles := []TileCoord{
+		{Zoom: 0, X: 0, Y: 0},
+		{Zoom: 1, X: 0, Y: 0}, {Zoom: 1, X: 1, Y: 0}, {Zoom: 1, X: 0, Y: 1}, {Zoom: 1, X: 1, Y: 1},
+		{Zoom: 2, X: 3, Y: 3}, {Zoom: 2, X: 3, Y: 2},
+	}
+	m := NewMeshtasticTileDownloader(Options{})
+
+	// The zoom 0 tile is requested as it is, and also as the parent of zoom 1
+	requests, direct := m.RetinaRequests(tiles)
+	want := []TileCoord{{Zoom: 0, X: 0, Y: 0}, {Zoom: 0, X: 0, Y: 0}, {Zoom: 1, X: 1, Y: 1}}
+	if !slices.Equal(requests, want) || direct != 1 {
+		t.Errorf("RetinaRequests = %v, %d, want %v, 1", requests, direct, want)
+	}
+}
+
+func TestObtainTilesSplitRetinaZoomZero(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_ = png.Encode(w, image.NewRGBA(image.Rect(0, 0, 2*tileSize, 2*tileSize)))
+	}))
+	defer server.Close()
+
+	m := NewMeshtasticTileDownloader(Options{OutputDirectory: t.TempDir()})
+	m.SetConfig(Config{
+		Map:       MapConfig{Provider: "custom", Scale: 2, Retina: "split"},
+		Providers: map[string]ProviderConfig{"custom": {URL: server.URL + "/{z}/{x}/{y}{{SCALE}}.png"}},
+	})
+
+	tiles := []TileCoord{{Zoom: 0, X: 0, Y: 0}, {Zoom: 1, X: 0, Y: 0}, {Zoom: 1, X: 1, Y: 0}, {Zoom: 1, X: 0, Y: 1}, {Zoom: 1, X: 1, Y: 1}}
+	summary, err := m.ObtainTiles(context.Background(), tiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Requests != 2 || summary.Failed != 0 {
+		t.Errorf("summary = %+v, want 2 requests without failures", summary)
+	}
+	for _, tile := range tiles {
+		file, err := os.Open(m.TilePath(tile.Zoom, tile.X, tile.Y))
+		if err != nil {
+			t.Errorf("tile %s: %v", tile, err)
+			continue
+		}
+		config, err := png.DecodeConfig(file)
+		file.Close()
+		if err != nil || config.Width != tileSize {
+			t.Errorf("tile %s is %dpx (%v), want %dpx", tile, config.Width, err, tileSize)
+		}
+	}
+}
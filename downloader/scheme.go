@@ -0,0 +1,73 @@
+package downloader
+
+import (
+	"fmt"
+	"strings"
+)
+
+// KnownSchemes returns the supported tile addressing schemes
+func KnownSchemes() []string {
+	return []string{"xyz", "tms", "quadkey"}
+}
+
+// ProviderScheme returns the tile addressing scheme of the configured provider
+func (m *MeshtasticTileDownloader) ProviderScheme() string {
+	if custom, ok := m.config.Providers[m.TileProvider()]; ok && custom.Scheme != "" {
+		return custom.Scheme
+	}
+	return "xyz"
+}
+
+// ValidateScheme checks the addressing scheme is known and usable with the URL template
+func (m *MeshtasticTileDownloader) ValidateScheme() error {
+	scheme := m.ProviderScheme()
+	template := NormalizeTemplate(m.ProviderURLTemplate())
+
+	switch scheme {
+	case "xyz", "tms":
+		return nil
+	case "quadkey":
+		if !strings.Contains(template, "{{QUADKEY}}") {
+			return fmt.Errorf("quadkey providers need a {{QUADKEY}} or {q} placeholder in their URL")
+		}
+		return nil
+	default:
+		return fmt.Errorf("scheme '%s' is unknown. Known: %s", scheme, strings.Join(KnownSchemes(), ", "))
+	}
+}
+
+// NormalizeTemplate rewrites the single brace placeholders used by Leaflet, QGIS
+// and most tile servers into the placeholders understood by ParseURL
+func NormalizeTemplate(template string) string {
+	replacer := strings.NewReplacer(
+		"{z}", "{{ZOOM}}",
+		"{x}", "{{X}}",
+		"{y}", "{{Y}}",
+		"{-y}", "{{-Y}}",
+		"{q}", "{{QUADKEY}}",
+		"{quadkey}", "{{QUADKEY}}",
+	)
+	return replacer.Replace(template)
+}
+
+// FlipY converts a tile Y coordinate between the XYZ and TMS schemes
+func FlipY(y, zoom int) int {
+	return (1 << zoom) - 1 - y
+}
+
+// QuadKey returns the Bing Maps quadkey of a tile
+func QuadKey(zoom, x, y int) string {
+	var key strings.Builder
+	for i := zoom; i > 0; i-- {
+		digit := '0'
+		mask := 1 << (i - 1)
+		if x&mask != 0 {
+			digit++
+		}
+		if y&mask != 0 {
+			digit += 2
+		}
+		key.WriteRune(digit)
+	}
+	return key.String()
+}
@@ -0,0 +1,69 @@
+package downloader
+
+import "testing"
+
+func TestQuadKey(t *testing.T) {
+	tests := []struct {
+		zoom, x, y int
+		want       string
+	}{
+		{0, 0, 0, ""},
+		{1, 0, 0, "0"},
+		{1, 1, 0, "1"},
+		{1, 0, 1, "2"},
+		{1, 1, 1, "3"},
+		{3, 3, 5, "213"}, // example of the Bing Maps tile system documentation
+		{2, 3, 3, "33"},
+		{16, 0, 0, "0000000000000000"},
+	}
+	for _, test := range tests {
+		if got := QuadKey(test.zoom, test.x, test.y); got != test.want {
+			t.Errorf("QuadKey(%d, %d, %d) = %q, want %q", test.zoom, test.x, test.y, got, test.want)
+		}
+	}
+}
+
+func TestFlipY(t *testing.T) {
+	tests := []struct{ y, zoom, want int }{
+		{0, 0, 0},
+		{0, 1, 1},
+		{1, 1, 0},
+		{0, 3, 7},
+		{5, 3, 2},
+		{1000, 12, 3095},
+	}
+	for _, test := range tests {
+		if got := FlipY(test.y, test.zoom); got != test.want {
+			t.Errorf("FlipY(%d, %d) = %d, want %d", test.y, test.zoom, got, test.want)
+		}
+	}
+
+	for zoom := 0; zoom <= 10; zoom++ {
+		for y := 0; y < 1<<zoom; y++ {
+			if flipped := FlipY(y, zoom); flipped < 0 || flipped >= 1<<zoom || FlipY(flipped, zoom) != y {
+				t.Fatalf("FlipY is not its own inverse for row %d of zoom %d", y, zoom)
+			}
+		}
+	}
+}
+
+func TestParseURLSchemes(t *testing.T) {
+	tests := []struct {
+		scheme, url, want string
+	}{
+		{"", "https://tiles.example.com/{z}/{x}/{y}.png", "https://tiles.example.com/3/3/5.png"},
+		{"tms", "https://tiles.example.com/{z}/{x}/{y}.png", "https://tiles.example.com/3/3/2.png"},
+		{"", "https://tiles.example.com/{z}/{x}/{-y}.png", "https://tiles.example.com/3/3/2.png"},
+		{"quadkey", "https://tiles.example.com/a{q}.jpeg", "https://tiles.example.com/a213.jpeg"},
+	}
+	for _, test := range tests {
+		m := NewMeshtasticTileDownloader(Options{})
+		m.SetConfig(Config{
+			Map:       MapConfig{Provider: "custom"},
+			Providers: map[string]ProviderConfig{"custom": {URL: test.url, Scheme: test.scheme}},
+		})
+		if got := m.ParseURL(3, 3, 5); got != test.want {
+			t.Errorf("%s scheme %q: ParseURL = %q, want %q", test.url, test.scheme, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxMercatorLat is the latitude limit of the Web Mercator tile pyramid
+const maxMercatorLat = 85.05112878
+
+// maxZoomLevel is the deepest zoom level accepted in the configuration
+const maxZoomLevel = 24
+
+// ConfigError is a problem found in the configuration file
+type ConfigError struct {
+	File    string // configuration file
+	Line    int    // line of the offending YAML node, 0 when unknown
+	Zone    string // zone the problem belongs to, if any
+	Field   string // dotted path of the offending field, such as map.reduce or zoom.in within a zone
+	Message string
+}
+
+// Error formats the problem as file:line: [zone] field: message
+func (e ConfigError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d", e.Line)
+	}
+	b.WriteString(": ")
+	if e.Zone != "" {
+		fmt.Fprintf(&b, "[%s] ", e.Zone)
+	}
+	if e.Field != "" {
+		fmt.Fprintf(&b, "%s: ", e.Field)
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+// configChecker collects the problems found in a configuration
+type configChecker struct {
+	m      *MeshtasticTileDownloader
+	errors []ConfigError
+}
+
+// add records a problem with the field at the given path of the YAML document
+func (c *configChecker) add(zone string, path []string, format string, args ...any) {
+	field := path
+	if zone != "" {
+		field = path[2:] // zones.<zone> is shown as [zone]
+	}
+	c.errors = append(c.errors, ConfigError{
+		File:    c.m.configFile,
+		Line:    c.m.ConfigLine(path...),
+		Zone:    zone,
+		Field:   strings.Join(field, "."),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// CheckConfig validates the whole configuration without contacting any
+// provider, and returns every problem found instead of fixing it
+func (m *MeshtasticTileDownloader) CheckConfig() []ConfigError {
+	c := &configChecker{m: m}
+
+	c.checkUnknownFields()
+	if !m.isPointRadius {
+		zoneNames := make([]string, 0, len(m.config.Zones))
+		for zoneName := range m.config.Zones {
+			zoneNames = append(zoneNames, zoneName)
+		}
+		sort.Strings(zoneNames)
+		for _, zoneName := range zoneNames {
+			c.checkZone(zoneName, m.config.Zones[zoneName])
+		}
+		c.checkZonePaths(zoneNames)
+	}
+	c.checkMap()
+	c.checkProviders()
+	for i, file := range m.config.Gazetteer {
+		if _, err := os.Stat(file); err != nil {
+			c.add("", []string{"gazetteer", strconv.Itoa(i)}, "%v", err)
+		}
+	}
+
+	sort.SliceStable(c.errors, func(i, j int) bool {
+		return c.errors[i].Line < c.errors[j].Line
+	})
+	return c.errors
+}
+
+// yamlErrorLine matches the line number yaml.v3 prefixes its errors with
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlUnknownField matches the yaml.v3 error of keys without a matching setting
+var yamlUnknownField = regexp.MustCompile(`^field (.+) not found in type downloader\.(\w+)$`)
+
+// checkUnknownFields reports keys that don't match any setting, usually typos
+func (c *configChecker) checkUnknownFields() {
+	if len(c.m.configData) == 0 {
+		return
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(c.m.configData))
+	decoder.KnownFields(true)
+	var config Config
+	err := decoder.Decode(&config)
+
+	var typeError *yaml.TypeError
+	if !errors.As(err, &typeError) {
+		return
+	}
+	for _, message := range typeError.Errors {
+		configError := ConfigError{File: c.m.configFile, Message: message}
+		if match := yamlErrorLine.FindStringSubmatch(message); match != nil {
+			configError.Line, _ = strconv.Atoi(match[1])
+			configError.Message = match[2]
+		}
+		if match := yamlUnknownField.FindStringSubmatch(configError.Message); match != nil {
+			configError.Message = fmt.Sprintf("unknown setting '%s' in %s", match[1], match[2])
+		}
+		c.errors = append(c.errors, configError)
+	}
+}
+
+// checkZone validates the regions, zoom levels and overrides of a zone
+func (c *configChecker) checkZone(zoneName string, zone Zone) {
+	path := func(fields ...string) []string {
+		return append([]string{"zones", zoneName}, fields...)
+	}
+
+	if len(zone.Regions) == 0 && zone.Nodes == nil {
+		c.add(zoneName, path(), "zone has no regions")
+	}
+	for i, region := range zone.Regions {
+		c.checkRegion(zoneName, path("regions", strconv.Itoa(i)), region)
+	}
+
+	zoomIn, zoomOut := zone.Zoom.In, zone.Zoom.Out
+	if zoomIn == 0 {
+		zoomIn = 8
+	}
+	if zoomOut == 0 {
+		zoomOut = 1
+	}
+	if zone.Zoom.In < 0 || zone.Zoom.In > maxZoomLevel {
+		c.add(zoneName, path("zoom", "in"), "zoom level %d is out of range (0-%d)", zone.Zoom.In, maxZoomLevel)
+	}
+	if zone.Zoom.Out < 0 || zone.Zoom.Out > maxZoomLevel {
+		c.add(zoneName, path("zoom", "out"), "zoom level %d is out of range (0-%d)", zone.Zoom.Out, maxZoomLevel)
+	}
+	if zoomIn < zoomOut && (zone.Nodes == nil || zone.Nodes.Detail == 0) {
+		c.add(zoneName, path("zoom"), "in (%d) is lower than out (%d), so no zoom level would be downloaded. In is the closest zoom level, out the furthest (defaults: in 8, out 1)", zoomIn, zoomOut)
+	}
+
+	if zone.Reduce != 0 {
+		c.checkReduce(zoneName, path("reduce"), zone.Reduce)
+	}
+	if zone.Provider != "" {
+		c.checkProvider(zoneName, path("provider"), zone.Provider)
+	}
+	if zone.Render != nil {
+		if err := zone.Render.Validate(); err != nil {
+			c.add(zoneName, path("render"), "%v", err)
+		}
+	}
+	for i, layer := range zone.Layers {
+		if err := c.m.ValidateLayer(layer); err != nil {
+			c.add(zoneName, path("layers", strconv.Itoa(i)), "%v", err)
+		}
+	}
+
+	if nodes := zone.Nodes; nodes != nil {
+		if nodes.File == "" {
+			c.add(zoneName, path("nodes", "file"), "nodes file is required")
+		} else if _, err := os.Stat(nodes.File); err != nil {
+			c.add(zoneName, path("nodes", "file"), "%v", err)
+		}
+		if nodes.RadiusKm < 0 {
+			c.add(zoneName, path("nodes", "radius_km"), "radius must not be negative")
+		}
+		if nodes.Detail < 0 || nodes.Detail > 4 {
+			c.add(zoneName, path("nodes", "detail"), "detail level %d is out of range (1-4)", nodes.Detail)
+		}
+	}
+}
+
+// checkZonePaths reports zones that would store tiles of different providers
+// at the same paths, because the device layout doesn't include the provider.
+// Stored tiles are skipped, so the second zone would silently keep the first
+// zone's tiles.
+func (c *configChecker) checkZonePaths(zoneNames []string) {
+	layout := c.m.DeviceProfile().Layout
+	if strings.Contains(layout, "{provider}") {
+		return
+	}
+
+	type tileDirectory struct{ output, style string }
+	owners := make(map[tileDirectory]string)
+	for _, zoneName := range zoneNames {
+		zone := c.m.config.Zones[zoneName]
+		mapConfig := c.m.ZoneMapConfig(zone)
+		directory := tileDirectory{c.m.ZoneOutputDirectory(zone), mapConfig.Style}
+		owner, ok := owners[directory]
+		if !ok {
+			owners[directory] = zoneName
+			continue
+		}
+		if ownerProvider := c.m.ZoneMapConfig(c.m.config.Zones[owner]).Provider; ownerProvider != mapConfig.Provider {
+			c.add(zoneName, []string{"zones", zoneName, "provider"},
+				"zone stores %s tiles at the same paths as the %s tiles of zone %s, as the %s device layout %s has no {provider}. Give the zone its own output or style",
+				mapConfig.Provider, ownerProvider, owner, c.m.config.Map.Device, layout)
+		}
+	}
+}
+
+// checkRegion validates a region and the bounding boxes it resolves to
+func (c *configChecker) checkRegion(zoneName string, path []string, region RegionConfig) {
+	regions, err := c.m.ResolveRegion(region)
+	if err != nil {
+		if region.Spec != "" {
+			c.add(zoneName, path, "%v. Regions are written as \"minLat,minLon,maxLat,maxLon\"", err)
+		} else {
+			c.add(zoneName, path, "%v", err)
+		}
+		return
+	}
+
+	for _, bounds := range regions {
+		if bounds.MinLat < -maxMercatorLat || bounds.MaxLat > maxMercatorLat {
+			c.add(zoneName, path, "latitudes must be within ±%.2f, the limit of map tiles", maxMercatorLat)
+		}
+		if bounds.MinLon < -180 || bounds.MaxLon > 180 {
+			c.add(zoneName, path, "longitudes must be within ±180")
+		}
+		if region.Spec != "" && (bounds.MinLat == bounds.MaxLat || bounds.MinLon == bounds.MaxLon) {
+			c.add(zoneName, path, "region has no area")
+		}
+	}
+}
+
+// checkReduce validates a reduce level
+func (c *configChecker) checkReduce(zoneName string, path []string, reduce int) {
+	if reduce < 1 || reduce > 16 {
+		c.add(zoneName, path, "reduce level %d is out of range (1-16)", reduce)
+	}
+}
+
+// checkProvider validates a provider name refers to a built-in or custom provider
+func (c *configChecker) checkProvider(zoneName string, path []string, provider string) {
+	defer c.m.useSource(SourceConfig{Provider: provider})()
+	if !c.m.IsValidProvider() {
+		c.add(zoneName, path, "provider '%s' is unknown. Known: '%s'", provider, strings.Join(c.m.KnownProviders(), ", "))
+	}
+}
+
+// checkMap validates the map section
+func (c *configChecker) checkMap() {
+	mapConfig := c.m.config.Map
+	path := func(fields ...string) []string {
+		return append([]string{"map"}, fields...)
+	}
+
+	if mapConfig.Provider != "" {
+		c.checkProvider("", path("provider"), mapConfig.Provider)
+	}
+	if mapConfig.Reduce != 0 {
+		c.checkReduce("", path("reduce"), mapConfig.Reduce)
+	}
+	if mapConfig.Downsample < 0 || mapConfig.Downsample > maxZoomLevel {
+		c.add("", path("downsample"), "zoom level %d is out of range (0-%d)", mapConfig.Downsample, maxZoomLevel)
+	}
+	if err := mapConfig.Render.Validate(); err != nil {
+		c.add("", path("render"), "%v", err)
+	}
+	if mapConfig.Scale != 0 && mapConfig.Scale != 1 && mapConfig.Scale != 2 {
+		c.add("", path("scale"), "scale %d is not supported. Valid scales: 1, 2", mapConfig.Scale)
+	}
+	if mapConfig.Retina != "" && !c.m.IsValidRetinaMode() {
+		c.add("", path("retina"), "retina mode '%s' is unknown. Known: %s", mapConfig.Retina, strings.Join(KnownRetinaModes(), ", "))
+	}
+	if !c.m.IsValidDevice() {
+		c.add("", path("device"), "device '%s' is unknown. Known: '%s'", mapConfig.Device, strings.Join(KnownDevices(), ", "))
+	}
+	for i, source := range mapConfig.Fallback {
+		c.checkProvider("", path("fallback", strconv.Itoa(i), "provider"), source.Provider)
+		restore := c.m.useSource(source)
+		if source.Style == "" && c.m.IsValidProvider() && c.m.NeedsStyle() {
+			c.add("", path("fallback", strconv.Itoa(i)), "provider '%s' needs a style", source.Provider)
+		}
+		restore()
+	}
+	for i, layer := range mapConfig.Layers {
+		if err := c.m.ValidateLayer(layer); err != nil {
+			c.add("", path("layers", strconv.Itoa(i)), "%v", err)
+		}
+	}
+	for i, file := range mapConfig.Annotations.Files {
+		if _, err := os.Stat(file); err != nil {
+			c.add("", path("annotations", "files", strconv.Itoa(i)), "%v", err)
+		}
+	}
+}
+
+// checkProviders validates the custom provider settings, without loading WMTS capabilities
+func (c *configChecker) checkProviders() {
+	providers := make([]string, 0, len(c.m.config.Providers))
+	for provider := range c.m.config.Providers {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+
+	for _, provider := range providers {
+		custom := c.m.config.Providers[provider]
+		path := func(fields ...string) []string {
+			return append([]string{"providers", provider}, fields...)
+		}
+		_, builtIn := c.m.GetTileProviderURLTemplate()[provider]
+		if custom.URL == "" && !builtIn {
+			c.add("", path("url"), "custom providers need a url")
+		}
+		if custom.MaxZoom < 0 || custom.MaxZoom > maxZoomLevel {
+			c.add("", path("max_zoom"), "zoom level %d is out of range (0-%d)", custom.MaxZoom, maxZoomLevel)
+		}
+
+		restore := c.m.useSource(SourceConfig{Provider: provider})
+		switch c.m.ProviderType() {
+		case "xyz":
+			if err := c.m.ValidateScheme(); err != nil {
+				c.add("", path("scheme"), "%v", err)
+			}
+		case "wms":
+			if custom.Layers == "" {
+				c.add("", path("layers"), "WMS providers need the layers to request")
+			}
+		case "wmts":
+		default:
+			c.add("", path("type"), "provider type '%s' is unknown. Known: xyz, wms, wmts", custom.Type)
+		}
+		restore()
+	}
+}
+
+// ConfigLine returns the line of the YAML node at the given path of keys and
+// sequence indexes, or of its deepest existing ancestor
+func (m *MeshtasticTileDownloader) ConfigLine(path ...string) int {
+	node := &m.configNode
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	line := node.Line
+	for _, key := range path {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					next, line = node.Content[i+1], node.Content[i].Line
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if index, err := strconv.Atoi(key); err == nil && index >= 0 && index < len(node.Content) {
+				next = node.Content[index]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return line
+}
@@ -0,0 +1,92 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfigUnknownField(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	data := "zones:\n  Vigo:\n    regions:\n      - 42.24,-8.78,42.20,-8.67\n    zom:\n      in: 12\nmap:\n  style: atlas\n  provider: thunderforest\n"
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMeshtasticTileDownloader(Options{})
+	if err := m.LoadConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, configError := range m.CheckConfig() {
+		if strings.Contains(configError.Message, "zom") {
+			if configError.Message != "unknown setting 'zom' in Zone" {
+				t.Errorf("message = %q, want %q", configError.Message, "unknown setting 'zom' in Zone")
+			}
+			if configError.Line != 5 {
+				t.Errorf("line = %d, want 5", configError.Line)
+			}
+			return
+		}
+	}
+	t.Error("unknown field zom not reported")
+}
+
+func TestCheckConfigZonePaths(t *testing.T) {
+	region := RegionConfig{Spec: "42.24,-8.78,42.20,-8.67"}
+	tests := []struct {
+		name   string
+		device string
+		zones  map[string]Zone
+		want   string // zone reported, empty for none
+	}{
+		{"provider in layout", "", map[string]Zone{
+			"A": {Regions: []RegionConfig{region}},
+			"B": {Regions: []RegionConfig{region}, Provider: "openstreetmap"},
+		}, ""},
+		{"same provider", "tdeck", map[string]Zone{
+			"A": {Regions: []RegionConfig{region}},
+			"B": {Regions: []RegionConfig{region}, Reduce: 2},
+		}, ""},
+		{"different provider", "tdeck", map[string]Zone{
+			"A": {Regions: []RegionConfig{region}},
+			"B": {Regions: []RegionConfig{region}, Provider: "openstreetmap", Style: "atlas"},
+		}, "B"},
+		{"different style", "eink", map[string]Zone{
+			"A": {Regions: []RegionConfig{region}},
+			"B": {Regions: []RegionConfig{region}, Provider: "openstreetmap", Style: "osm"},
+		}, ""},
+		{"different output", "indicator", map[string]Zone{
+			"A": {Regions: []RegionConfig{region}},
+			"B": {Regions: []RegionConfig{region}, Provider: "openstreetmap", Output: "osm"},
+		}, ""},
+		{"same resolved output", "indicator", map[string]Zone{
+			"A": {Regions: []RegionConfig{region}, Output: "maps"},
+			"B": {Regions: []RegionConfig{region}, Provider: "openstreetmap", Output: "./maps/"},
+		}, "B"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMeshtasticTileDownloader(Options{OutputDirectory: t.TempDir()})
+			m.SetConfig(Config{
+				Zones: test.zones,
+				Map:   MapConfig{Provider: "thunderforest", Style: "atlas", Device: test.device},
+			})
+
+			var reported []string
+			for _, configError := range m.CheckConfig() {
+				if strings.Contains(configError.Message, "same paths") {
+					reported = append(reported, configError.Zone)
+				}
+			}
+			if test.want == "" && len(reported) > 0 {
+				t.Errorf("zones %v reported, want none", reported)
+			}
+			if test.want != "" && (len(reported) != 1 || reported[0] != test.want) {
+				t.Errorf("zones %v reported, want %s", reported, test.want)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ go 1.24
 
 require (
 	github.com/schollz/progressbar/v3 v3.18.0
+	golang.org/x/image v0.30.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -1,24 +1,22 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"image"
-	_ "image/jpeg" // Register JPEG decoder
-	"image/png"
-	"io"
-	"log"
-	"math"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/schollz/progressbar/v3"
-	"gopkg.in/yaml.v3"
+	"meshtastic-tile-downloader/downloader"
 )
 
 /*
@@ -34,750 +32,394 @@ Map providers:
   - CNIG.es
 */
 
-// Config represents the YAML configuration structure
-type Config struct {
-	Zones map[string]Zone `yaml:"zones"`
-	Map   MapConfig       `yaml:"map"`
-}
-
-// Zone represents a geographical zone with regions and zoom levels
-type Zone struct {
-	Regions []string `yaml:"regions"`
-	Zoom    struct {
-		In  int `yaml:"in"`
-		Out int `yaml:"out"`
-	} `yaml:"zoom"`
-}
-
-// MapConfig represents map provider configuration
-type MapConfig struct {
-	Provider string `yaml:"provider"`
-	Style    string `yaml:"style"`
-	Reduce   int    `yaml:"reduce"`
-}
-
-// Point represents a point on the map
-type Point struct {
-	Lat  float64
-	Long float64
-}
+// pointFlags collects the values of a repeated command-line flag
+type pointFlags []string
 
-// MeshtasticTileDownloader is the main application struct
-type MeshtasticTileDownloader struct {
-	config          Config
-	outputDirectory string
-	apiKey          string
-	isPointRadius   bool
-	centerPoint     Point
-	radiusKm        float64
-	detailLevel     int
+func (p *pointFlags) String() string {
+	return strings.Join(*p, " ")
 }
 
-// NewMeshtasticTileDownloader creates a new tile downloader
-func NewMeshtasticTileDownloader(outputDirectory string) *MeshtasticTileDownloader {
-	return &MeshtasticTileDownloader{
-		outputDirectory: outputDirectory,
-	}
-}
-
-// LoadConfig loads configuration from a YAML file
-func (m *MeshtasticTileDownloader) LoadConfig(configFile string) error {
-	data, err := os.ReadFile(configFile)
-	if err != nil {
-		return fmt.Errorf("failed to read config file: %w", err)
-	}
-
-	if err := yaml.Unmarshal(data, &m.config); err != nil {
-		return fmt.Errorf("failed to parse YAML: %w", err)
-	}
-
+func (p *pointFlags) Set(value string) error {
+	*p = append(*p, value)
 	return nil
 }
 
-// ValidateConfig validates the configuration
-func (m *MeshtasticTileDownloader) ValidateConfig() bool {
-	log.Println("Analysing configuration.")
-
-	// When using point-radius mode, we don't need to validate zones
-	if m.isPointRadius {
-		log.Printf("Using point-radius mode: center (%f, %f), radius %f km, detail level %d",
-			m.centerPoint.Lat, m.centerPoint.Long, m.radiusKm, m.detailLevel)
-	} else {
-		// Check zones
-		log.Printf("Found %d zones", len(m.config.Zones))
-		for zoneName, zone := range m.config.Zones {
-			log.Printf("[%s] contains %d regions", zoneName, len(zone.Regions))
-
-			// Set default zoom levels if not specified
-			modified := false
-			if zone.Zoom.In == 0 {
-				zone.Zoom.In = 8
-				modified = true
-				log.Printf("Setting default zoom in level for [%s] to 8", zoneName)
-			}
-			if zone.Zoom.Out == 0 {
-				zone.Zoom.Out = 1
-				modified = true
-				log.Printf("Setting default zoom out level for [%s] to 1", zoneName)
-			}
+// confirmDownload asks on the terminal before large downloads
+func confirmDownload(estimatedSize int64) bool {
+	// Keep the prompt off stdout, where -progress json writes its events
+	fmt.Fprintf(os.Stderr, "\nWarning: The estimated download size is %s. Continue? (y/n): ", downloader.FormatSize(estimatedSize))
+	var answer string
+	fmt.Scanln(&answer)
+	return strings.ToLower(answer) == "y" || strings.ToLower(answer) == "yes"
+}
 
-			// If we modified the zone, update it in the map
-			if modified {
-				m.config.Zones[zoneName] = zone
-			}
-		}
+// checkConfig validates a configuration file without downloading anything and
+// returns the exit code
+func checkConfig(configFile string) int {
+	if configFile == "" {
+		configFile = "config.yaml"
 	}
 
-	// Set map defaults if needed
-	if m.config.Map.Provider == "" {
-		m.config.Map.Provider = "thunderforest"
-		log.Println("Setting default provider to thunderforest")
-	}
-	if m.config.Map.Style == "" {
-		m.config.Map.Style = "atlas"
-		log.Println("Setting default style to atlas")
-	}
-	if m.config.Map.Reduce == 0 {
-		m.config.Map.Reduce = 12
-		log.Println("Setting default reduce level to 12")
-	} else if m.config.Map.Reduce < 1 || m.config.Map.Reduce > 16 {
-		m.config.Map.Reduce = 100
-		log.Println("Setting reduce level to 100 due to out-of-range value")
+	app := downloader.NewMeshtasticTileDownloader(downloader.Options{})
+	if err := app.LoadConfig(configFile); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configFile, err)
+		return 1
 	}
 
-	// Validate provider
-	if !m.IsValidProvider() {
-		knownProviders := strings.Join(m.KnownProviders(), ", ")
-		log.Printf("Provider '%s' is unknown. Known: '%s'", m.config.Map.Provider, knownProviders)
-		return false
+	configErrors := app.CheckConfig()
+	for _, configError := range configErrors {
+		fmt.Fprintln(os.Stderr, configError)
 	}
-
-	return true
-}
-
-// TileProvider returns the configured tile provider
-func (m *MeshtasticTileDownloader) TileProvider() string {
-	return m.config.Map.Provider
-}
-
-// MapStyle returns the configured map style
-func (m *MeshtasticTileDownloader) MapStyle() string {
-	return m.config.Map.Style
-}
-
-// IsValidProvider checks if the provider is valid
-func (m *MeshtasticTileDownloader) IsValidProvider() bool {
-	_, ok := m.GetTileProviderURLTemplate()[m.TileProvider()]
-	return ok
-}
-
-// KnownProviders returns a list of known providers
-func (m *MeshtasticTileDownloader) KnownProviders() []string {
-	providers := make([]string, 0, len(m.GetTileProviderURLTemplate()))
-	for k := range m.GetTileProviderURLTemplate() {
-		providers = append(providers, k)
+	if len(configErrors) > 0 {
+		fmt.Fprintf(os.Stderr, "Found %d problems in %s\n", len(configErrors), configFile)
+		return 1
 	}
-	return providers
+	fmt.Printf("%s is valid\n", configFile)
+	return 0
 }
 
-// GetTileProviderURLTemplate returns a map of provider URL templates
-func (m *MeshtasticTileDownloader) GetTileProviderURLTemplate() map[string]string {
-	return map[string]string{
-		"thunderforest": "https://tile.thunderforest.com/{{MAP_STYLE}}/{{ZOOM}}/{{X}}/{{Y}}.png?apikey={{API_KEY}}",
-		"geoapify":      "https://maps.geoapify.com/v1/tile/{{MAP_STYLE}}/{{ZOOM}}/{{X}}/{{Y}}.png?apiKey={{API_KEY}}",
-		"cnig.es":       "https://tms-ign-base.idee.es/1.0.0/IGNBaseTodo/{{ZOOM}}/{{X}}/{{Y}}.jpeg",
+// logMissingTiles logs how many tiles of a plan are missing, by zone and zoom
+// level, and how many stored tiles weren't annotated
+func logMissingTiles(plan *downloader.Plan) {
+	slog.Warn("Tiles missing", "tiles", plan.Tiles)
+	for _, job := range plan.Jobs {
+		tiles := job.PyramidPlan.Tiles()
+		for _, zoom := range downloader.TileZoomLevels(tiles) {
+			slog.Warn("Tiles missing", "zone", job.Name, "zoom", zoom, "tiles", len(downloader.TilesAtZoom(tiles, zoom)))
+		}
+		if len(job.Annotate) > 0 {
+			slog.Warn("Tiles not annotated", "zone", job.Name, "tiles", len(job.Annotate))
+		}
 	}
 }
 
-// ParseURL parses a URL template with the given parameters
-func (m *MeshtasticTileDownloader) ParseURL(zoom, x, y int) string {
-	url := m.GetTileProviderURLTemplate()[m.TileProvider()]
-	url = strings.Replace(url, "{{MAP_STYLE}}", m.MapStyle(), -1)
-	url = strings.Replace(url, "{{ZOOM}}", strconv.Itoa(zoom), -1)
-	url = strings.Replace(url, "{{X}}", strconv.Itoa(x), -1)
-	url = strings.Replace(url, "{{Y}}", strconv.Itoa(y), -1)
-	url = strings.Replace(url, "{{API_KEY}}", m.apiKey, -1)
-	return url
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
-// RedactKey redacts the API key in a URL for logging
-func (m *MeshtasticTileDownloader) RedactKey(url string) string {
-	if m.apiKey != "" {
-		return strings.Replace(url, m.apiKey, "[REDACTED]", -1)
+// newLogHandler creates the handler of the logs written to stderr
+func newLogHandler(format, level string) (slog.Handler, error) {
+	var options slog.HandlerOptions
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("log level '%s' is unknown. Known: debug, info, warn, error", level)
 	}
-	return url
-}
-
-// LongToTileX converts longitude to tile X coordinate
-func (m *MeshtasticTileDownloader) LongToTileX(lon float64, zoom int) int {
-	xyTilesCount := math.Pow(2, float64(zoom))
-	return int(math.Floor(((lon + 180.0) / 360.0) * xyTilesCount))
-}
-
-// LatToTileY converts latitude to tile Y coordinate
-func (m *MeshtasticTileDownloader) LatToTileY(lat float64, zoom int) int {
-	xyTilesCount := math.Pow(2, float64(zoom))
-	return int(math.Floor(((1.0 - math.Log(math.Tan((lat*math.Pi)/180.0)+1.0/math.Cos((lat*math.Pi)/180.0))/math.Pi) / 2.0) * xyTilesCount))
-}
-
-// TileXToLong converts tile X coordinate to longitude
-func (m *MeshtasticTileDownloader) TileXToLong(x int, zoom int) float64 {
-	xyTilesCount := math.Pow(2, float64(zoom))
-	return (float64(x) / xyTilesCount * 360.0) - 180.0
-}
-
-// TileYToLat converts tile Y coordinate to latitude
-func (m *MeshtasticTileDownloader) TileYToLat(y int, zoom int) float64 {
-	xyTilesCount := math.Pow(2, float64(zoom))
-	n := math.Pi - 2.0*math.Pi*float64(y)/xyTilesCount
-	return 180.0 / math.Pi * math.Atan(0.5*(math.Exp(n)-math.Exp(-n)))
-}
+	options.Level = logLevel
 
-// IsInDebugMode checks if debug mode is enabled
-func (m *MeshtasticTileDownloader) IsInDebugMode() bool {
-	debug := os.Getenv("DEBUG")
-	return strings.ToLower(debug) != "false" && debug != ""
-}
-
-// LoadImageBytes loads and returns an image from bytes
-func (m *MeshtasticTileDownloader) LoadImageBytes(imgData []byte) (image.Image, error) {
-	img, _, err := image.Decode(bytes.NewReader(imgData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode image: %w", err)
+	switch format {
+	case "text":
+		return slog.NewTextHandler(os.Stderr, &options), nil
+	case "json":
+		return slog.NewJSONHandler(os.Stderr, &options), nil
 	}
-	return img, nil
+	return nil, fmt.Errorf("log format '%s' is unknown. Known: text, json", format)
 }
 
-// DownloadTile downloads a single tile
-func (m *MeshtasticTileDownloader) DownloadTile(zoom, x, y int) error {
-	reducing := zoom >= m.config.Map.Reduce
-	url := m.ParseURL(zoom, x, y)
-	redactedURL := m.RedactKey(url)
-
-	// Determine the output path
-	tileDir := filepath.Join(m.outputDirectory, m.TileProvider(), m.MapStyle(), strconv.Itoa(zoom), strconv.Itoa(x))
-	tilePath := filepath.Join(tileDir, fmt.Sprintf("%d.png", y))
-
-	// Create directories if they don't exist
-	if err := os.MkdirAll(tileDir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
-	}
-
-	// Skip if file already exists
-	if _, err := os.Stat(tilePath); err == nil {
-		log.Printf("[%s] file already exists. Skipping... %s", tilePath, redactedURL)
-		return nil
-	}
-
-	// Skip download in debug mode
-	if m.IsInDebugMode() {
-		log.Printf("DEBUG IS ACTIVE: not obtaining tile: %s (Would reduce: %v)", redactedURL, reducing)
-		return nil
-	}
-
-	// Download the tile
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("failed to download: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download tile %d/%d/%d: %d %s", zoom, x, y, resp.StatusCode, resp.Status)
-	}
-
-	contentType := resp.Header.Get("Content-Type")
-	if !strings.HasPrefix(contentType, "image/") {
-		return fmt.Errorf("failed to parse tile %d/%d/%d: %d: not an image", zoom, x, y, resp.StatusCode)
-	}
-
-	// Read the image data
-	imgData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
-	}
-
-	// Process and save the image
-	if reducing {
-		log.Printf("Reducing tile from %s → %s", redactedURL, tilePath)
-		return m.ReduceTile(imgData, tilePath)
-	}
+func main() {
+	// Parse command-line arguments for point-radius mode
+	var latArg, longArg string
+	var radius float64
+	var detailLevel int
+	var usePointMode bool
+	var pointSpecs pointFlags
+	var pointsFile string
+	var placeNames pointFlags
+	var planFile, replayFile string
+	var progressMode string
+	var timeBudget time.Duration
+	var reportFile string
+	var retry bool
+	var failedFile string
+	var logLevel, logFormat string
+	var dryRun bool
+	var metricsAddr string
+
+	flag.StringVar(&latArg, "lat", "", "Center latitude for point-radius mode, or a UTM, MGRS, geohash or Plus Code position without -long")
+	flag.StringVar(&longArg, "long", "", "Center longitude for point-radius mode")
+	flag.Float64Var(&radius, "radius", 0, "Radius in kilometers for point-radius mode")
+	flag.IntVar(&detailLevel, "detail", 2, "Detail level (1-4) for point-radius mode")
+	flag.BoolVar(&usePointMode, "point", false, "Enable point-radius mode")
+	flag.Var(&pointSpecs, "at", "Point \"lat,long[,radius_km[,detail]]\" for point-radius mode (repeatable)")
+	flag.StringVar(&pointsFile, "points", "", "File with one \"lat,long[,radius_km[,detail]]\" point per line for point-radius mode")
+	flag.Var(&placeNames, "place", "Place name from the gazetteer, such as \"Vigo\" or \"Santiago, ES\", for point-radius mode (repeatable)")
+	flag.StringVar(&planFile, "plan", "", "Write the tiles to obtain, with their counts and estimated size, to a plan file instead of downloading them")
+	flag.StringVar(&replayFile, "replay", "", "Obtain exactly the tiles of a plan file written with -plan, without reading config.yaml")
+	flag.StringVar(&progressMode, "progress", "terminal", "How progress is reported: terminal (progress bars), json (one JSON event per line on stdout) or silent")
+	flag.DurationVar(&timeBudget, "time-budget", 0, "Stop downloading after this long, such as 2h or 45m, keeping what was obtained (default: no limit)")
+	flag.StringVar(&reportFile, "report", "", "JSON file the run report is written to (default: report.json in the download directory)")
+	flag.BoolVar(&retry, "retry", false, "Obtain only the tiles that failed in the previous run, with the same provider settings")
+	flag.StringVar(&failedFile, "failed", "", "Plan file the failed tiles of each run are written to, and retried from with -retry (default: failed-tiles.yaml in the download directory)")
+	flag.StringVar(&logLevel, "log-level", "", "Verbosity of the logs: debug, info, warn or error (default: info, or debug when the DEBUG env var is set)")
+	flag.StringVar(&logFormat, "log-format", "text", "Format of the logs written to stderr: text or json")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log the tiles that would be obtained instead of obtaining them")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address, such as :9100, of an HTTP listener serving Prometheus metrics on /metrics while downloading (default: none)")
+	flag.Parse()
 
-	log.Printf("Saving not altered tile %s → %s", redactedURL, tilePath)
-	if contentType != "image/png" {
-		return m.SaveConvertedTile(imgData, tilePath)
+	// Only validate the configuration with check-config [file]
+	if flag.Arg(0) == "check-config" {
+		os.Exit(checkConfig(flag.Arg(1)))
 	}
 
-	return os.WriteFile(tilePath, imgData, 0644)
-}
-
-// ReduceTile reduces the color depth of an image
-func (m *MeshtasticTileDownloader) ReduceTile(imgData []byte, destination string) error {
-	img, err := m.LoadImageBytes(imgData)
-	if err != nil {
-		return err
+	// Configure logging
+	if logLevel == "" {
+		logLevel = "info"
+		if debug := os.Getenv("DEBUG"); debug != "" && strings.ToLower(debug) != "false" {
+			logLevel = "debug"
+		}
 	}
-
-	// Save the image with compression
-	f, err := os.Create(destination)
+	handler, err := newLogHandler(logFormat, logLevel)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
-	}
-	defer f.Close()
-
-	// Use png encoder with best compression
-	encoder := png.Encoder{
-		CompressionLevel: png.BestCompression,
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(slog.New(handler))
+	slog.Debug("Log level is set", "level", logLevel)
+	if dryRun {
+		slog.Info("Dry run: tiles are logged instead of being obtained")
+	}
+
+	// Choose how progress is reported
+	var progress downloader.ProgressObserver
+	switch progressMode {
+	case "terminal":
+		progress = &downloader.TerminalProgress{}
+	case "json":
+		progress = downloader.NewJSONProgress(os.Stdout)
+	case "silent":
+		progress = downloader.SilentProgress{}
+	default:
+		fatal("Progress mode is unknown", "progress", progressMode, "known", "terminal, json, silent")
 	}
-	return encoder.Encode(f, img)
-}
 
-// SaveConvertedTile saves a tile converted to PNG
-func (m *MeshtasticTileDownloader) SaveConvertedTile(imgData []byte, destination string) error {
-	img, err := m.LoadImageBytes(imgData)
-	if err != nil {
-		return err
+	// Get output directory
+	outputDir := os.Getenv("DOWNLOAD_DIRECTORY")
+	if outputDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			fatal("Could not determine home directory", "error", err)
+		}
+		outputDir = filepath.Join(homeDir, "Desktop", "maps")
 	}
 
-	f, err := os.Create(destination)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+	// Create output directory
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		fatal("Destination can't be created", "directory", outputDir, "error", err)
 	}
-	defer f.Close()
-
-	// Use png encoder with best compression
-	encoder := png.Encoder{
-		CompressionLevel: png.BestCompression,
+	slog.Info("Store destination set", "directory", outputDir)
+	if failedFile == "" {
+		failedFile = filepath.Join(outputDir, "failed-tiles.yaml")
 	}
-	return encoder.Encode(f, img)
-}
-
-// CalculatePointRadiusBounds calculates the bounding box around a point using the Haversine formula
-func (m *MeshtasticTileDownloader) CalculatePointRadiusBounds() (minLat, minLon, maxLat, maxLon float64) {
-	// Earth's radius in kilometers
-	//earthRadius := 6371.0
-
-	// Convert radius from km to degrees (approximate)
-	// 1 degree of latitude is approximately 111.32 km at the equator
-	// 1 degree of longitude varies with latitude
-	latRadius := m.radiusKm / 111.32
-
-	// Longitude degrees per km varies with latitude
-	// cos(lat) gives the scale factor
-	longRadius := m.radiusKm / (111.32 * math.Cos(m.centerPoint.Lat*math.Pi/180.0))
-
-	minLat = m.centerPoint.Lat - latRadius
-	maxLat = m.centerPoint.Lat + latRadius
-	minLon = m.centerPoint.Long - longRadius
-	maxLon = m.centerPoint.Long + longRadius
 
-	// Handle latitude boundary conditions
-	if minLat < -90.0 {
-		minLat = -90.0
-	}
-	if maxLat > 90.0 {
-		maxLat = 90.0
+	// Serve the metrics of the download while it runs
+	var metrics *downloader.Metrics
+	if metricsAddr != "" {
+		metrics = downloader.NewMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		listener, err := net.Listen("tcp", metricsAddr)
+		if err != nil {
+			fatal("Metrics listener can't be started", "address", metricsAddr, "error", err)
+		}
+		slog.Info("Serving metrics", "url", "http://"+listener.Addr().String()+"/metrics")
+		go func() {
+			if err := http.Serve(listener, mux); err != nil {
+				slog.Error("Metrics listener stopped", "error", err)
+			}
+		}()
 	}
 
-	// Handle longitude wrap-around
-	if minLon < -180.0 {
-		minLon += 360.0
-	}
-	if maxLon > 180.0 {
-		maxLon -= 360.0
+	// Create app
+	app := downloader.NewMeshtasticTileDownloader(downloader.Options{
+		OutputDirectory: outputDir,
+		DryRun:          dryRun,
+		ConfirmDownload: confirmDownload,
+		Progress:        progress,
+		Metrics:         metrics,
+	})
+
+	// Convert the center given with -lat and -long
+	var lat, long float64
+	if latArg != "" || longArg != "" {
+		position := latArg
+		if longArg != "" {
+			position = latArg + "," + longArg
+		} else if _, err := strconv.ParseFloat(latArg, 64); err == nil {
+			fatal("-long is required with a decimal -lat")
+		}
+		center, _, err := downloader.ParseCoordinate(position)
+		if err != nil {
+			fatal("Invalid position", "error", err)
+		}
+		lat, long = center.Lat, center.Long
 	}
 
-	return minLat, minLon, maxLat, maxLon
-}
-
-// GetZoomLevelsForDetail returns the appropriate zoom level range based on detail level
-func (m *MeshtasticTileDownloader) GetZoomLevelsForDetail() []int {
-	var minZoom, maxZoom int
-
-	// Map detail level to zoom levels
-	switch m.detailLevel {
-	case 1: // Low detail - good for very large areas
-		minZoom = 6
-		maxZoom = 10
-	case 2: // Medium detail - balanced for regional areas
-		minZoom = 7
-		maxZoom = 12
-	case 3: // High detail - good for cities and towns
-		minZoom = 8
-		maxZoom = 14
-	case 4: // Very high detail - for detailed city navigation
-		minZoom = 9
-		maxZoom = 16
-	default: // Default to medium detail
-		minZoom = 7
-		maxZoom = 12
+	// Stop cleanly on Ctrl+C, or when the time budget is spent. The budget
+	// also covers preparing the providers, such as reading WMTS capabilities.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if timeBudget > 0 {
+		slog.Info("Time budget", "duration", timeBudget)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeBudget)
+		defer cancel()
 	}
 
-	// Create zoom level range
-	zoomLevels := make([]int, 0, maxZoom-minZoom+1)
-	for i := minZoom; i <= maxZoom; i++ {
-		zoomLevels = append(zoomLevels, i)
+	// Retry the failed tiles of the previous run, which are a plan to replay
+	if retry {
+		if _, err := os.Stat(failedFile); errors.Is(err, os.ErrNotExist) {
+			slog.Info("No failed tiles to retry", "file", failedFile)
+			return
+		}
+		replayFile = failedFile
 	}
 
-	return zoomLevels
-}
+	// Replay a plan, or check if we're using point-radius mode
+	if replayFile != "" {
+		if err := app.LoadPlan(replayFile); err != nil {
+			fatal("Failed to load plan", "error", err)
+		}
+		if retry {
+			logMissingTiles(app.Plan())
+		}
+		if !app.PreparePlan(ctx) {
+			fatal("Plan can't be replayed")
+		}
+	} else if usePointMode || len(pointSpecs) > 0 || pointsFile != "" || len(placeNames) > 0 {
+		if usePointMode && lat == 0 && long == 0 && len(pointSpecs) == 0 && pointsFile == "" && len(placeNames) == 0 {
+			fatal("When using point mode, you must specify lat and long parameters")
+		}
 
-// estimateTileSize estimates the average size of a tile at a specific zoom level
-func (m *MeshtasticTileDownloader) estimateTileSize(zoom int) int64 {
-	// These are rough estimates based on average tile sizes
-	// Size generally increases with zoom level as tiles contain more detail
-	switch {
-	case zoom <= 5:
-		return 20 * 1024 // ~20KB for very low zoom levels
-	case zoom <= 8:
-		return 30 * 1024 // ~30KB for low zoom levels
-	case zoom <= 11:
-		return 50 * 1024 // ~50KB for medium zoom levels
-	case zoom <= 14:
-		return 80 * 1024 // ~80KB for high zoom levels
-	default:
-		return 120 * 1024 // ~120KB for very high zoom levels
-	}
-}
+		if detailLevel < 1 || detailLevel > 4 {
+			slog.Warn("Detail level is out of range (1-4), using default level 2", "detail", detailLevel)
+			detailLevel = 2
+		}
 
-// formatSize formats a byte size to a human-readable string (KB, MB, GB)
-func formatSize(bytes int64) string {
-	const (
-		KB = 1024
-		MB = 1024 * KB
-		GB = 1024 * MB
-	)
-
-	switch {
-	case bytes >= GB:
-		return fmt.Sprintf("%.2f GB", float64(bytes)/float64(GB))
-	case bytes >= MB:
-		return fmt.Sprintf("%.2f MB", float64(bytes)/float64(MB))
-	case bytes >= KB:
-		return fmt.Sprintf("%.2f KB", float64(bytes)/float64(KB))
-	default:
-		return fmt.Sprintf("%d bytes", bytes)
-	}
-}
+		// Still need to load config for map provider settings
+		if err := app.LoadConfig("config.yaml"); err != nil {
+			slog.Warn("Failed to load configuration. Using defaults", "error", err)
+			// Set some sensible defaults
+			app.SetConfig(downloader.Config{Map: downloader.MapConfig{Provider: "thunderforest", Style: "atlas", Reduce: 12}})
+		}
 
-// ObtainTiles downloads all tiles for the given regions and zoom levels
-func (m *MeshtasticTileDownloader) ObtainTiles(regions []string, zoomLevels []int) error {
-	totalTiles := 0
-	estimatedSize := int64(0)
-	tileCountByZoom := make(map[int]int)
-
-	// Calculate total tiles first for progress bar and size estimation
-	for _, zoom := range zoomLevels {
-		for _, region := range regions {
-			coords := strings.Split(region, ",")
-			if len(coords) != 4 {
-				return fmt.Errorf("invalid region format: %s", region)
+		// -lat and -long add a point; -radius and -detail are the defaults of the other points
+		var points []downloader.PointRadius
+		if lat != 0 || long != 0 {
+			if radius <= 0 {
+				fatal("Radius must be greater than 0")
 			}
-
-			minLat, err := strconv.ParseFloat(coords[0], 64)
+			points = append(points, downloader.PointRadius{Point: downloader.Point{Lat: lat, Long: long}, RadiusKm: radius, Detail: detailLevel})
+		}
+		for _, spec := range pointSpecs {
+			point, err := downloader.ParsePointRadius(spec, radius, detailLevel)
 			if err != nil {
-				return fmt.Errorf("invalid latitude: %w", err)
+				fatal("Invalid point", "error", err)
 			}
-			minLon, err := strconv.ParseFloat(coords[1], 64)
+			points = append(points, point)
+		}
+		if pointsFile != "" {
+			filePoints, err := downloader.LoadPointRadiusFile(pointsFile, radius, detailLevel)
 			if err != nil {
-				return fmt.Errorf("invalid longitude: %w", err)
+				fatal("Invalid points file", "error", err)
 			}
-			maxLat, err := strconv.ParseFloat(coords[2], 64)
+			points = append(points, filePoints...)
+		}
+		for _, name := range placeNames {
+			place, err := app.ResolvePlace(name)
 			if err != nil {
-				return fmt.Errorf("invalid latitude: %w", err)
+				fatal("Invalid place", "error", err)
 			}
-			maxLon, err := strconv.ParseFloat(coords[3], 64)
-			if err != nil {
-				return fmt.Errorf("invalid longitude: %w", err)
+			placeRadius := radius
+			if placeRadius <= 0 {
+				placeRadius = downloader.DefaultPlaceRadiusKm
 			}
-
-			startX := m.LongToTileX(minLon, zoom)
-			endX := m.LongToTileX(maxLon, zoom)
-			startY := m.LatToTileY(maxLat, zoom)
-			endY := m.LatToTileY(minLat, zoom)
-
-			minX := int(math.Min(float64(startX), float64(endX)))
-			maxX := int(math.Max(float64(startX), float64(endX)))
-			minY := int(math.Min(float64(startY), float64(endY)))
-			maxY := int(math.Max(float64(startY), float64(endY)))
-
-			tilesX := maxX - minX + 1
-			tilesY := maxY - minY + 1
-			tilesInZoom := tilesX * tilesY
-
-			tileCountByZoom[zoom] += tilesInZoom
-			totalTiles += tilesInZoom
+			slog.Info("Place resolved", "place", name, "match", place.String())
+			points = append(points, downloader.PointRadius{Point: place.Point, RadiusKm: placeRadius, Detail: detailLevel})
 		}
-	}
-
-	// Calculate estimated size
-	for zoom, count := range tileCountByZoom {
-		zoomSize := int64(count) * m.estimateTileSize(zoom)
-		estimatedSize += zoomSize
-		log.Printf("Zoom level %d: %d tiles, estimated %s", zoom, count, formatSize(zoomSize))
-	}
-
-	log.Printf("Total tiles: %d, Estimated download size: %s", totalTiles, formatSize(estimatedSize))
-
-	// Ask for confirmation if size is large
-	if estimatedSize > 100*1024*1024 { // 100MB
-		fmt.Printf("\nWarning: The estimated download size is %s. Continue? (y/n): ", formatSize(estimatedSize))
-		var answer string
-		fmt.Scanln(&answer)
-		if strings.ToLower(answer) != "y" && strings.ToLower(answer) != "yes" {
-			return fmt.Errorf("download cancelled by user")
+		if len(points) == 0 {
+			fatal("No point given for point-radius mode")
 		}
-	}
 
-	// Create progress bar
-	bar := progressbar.Default(int64(totalTiles), "Downloading tiles")
-
-	// Download tiles
-	for _, zoom := range zoomLevels {
-		for _, region := range regions {
-			coords := strings.Split(region, ",")
-
-			minLat, _ := strconv.ParseFloat(coords[0], 64)
-			minLon, _ := strconv.ParseFloat(coords[1], 64)
-			maxLat, _ := strconv.ParseFloat(coords[2], 64)
-			maxLon, _ := strconv.ParseFloat(coords[3], 64)
-
-			startX := m.LongToTileX(minLon, zoom)
-			endX := m.LongToTileX(maxLon, zoom)
-			startY := m.LatToTileY(maxLat, zoom)
-			endY := m.LatToTileY(minLat, zoom)
-
-			minX := int(math.Min(float64(startX), float64(endX)))
-			maxX := int(math.Max(float64(startX), float64(endX)))
-			minY := int(math.Min(float64(startY), float64(endY)))
-			maxY := int(math.Max(float64(startY), float64(endY)))
-
-			for x := minX; x <= maxX; x++ {
-				for y := minY; y <= maxY; y++ {
-					if err := m.DownloadTile(zoom, x, y); err != nil {
-						log.Printf("Error downloading tile %d/%d/%d: %v", zoom, x, y, err)
-					}
-					_ = bar.Add(1)
-				}
-			}
+		// Set point-radius mode parameters
+		app.AddPoints(points...)
+	} else {
+		// Regular mode - load config
+		if err := app.LoadConfig("config.yaml"); err != nil {
+			fatal("Failed to load configuration", "error", err)
 		}
 	}
 
-	return nil
-}
-
-// RunPointRadius executes the tile download process for point-radius mode
-func (m *MeshtasticTileDownloader) RunPointRadius() bool {
-	startTime := time.Now()
-
-	// Calculate bounding box from point and radius
-	minLat, minLon, maxLat, maxLon := m.CalculatePointRadiusBounds()
-	regionStr := fmt.Sprintf("%.6f,%.6f,%.6f,%.6f", minLat, minLon, maxLat, maxLon)
-	regions := []string{regionStr}
-
-	log.Printf("Point-radius mode: center (%.6f, %.6f), radius %.2f km",
-		m.centerPoint.Lat, m.centerPoint.Long, m.radiusKm)
-	log.Printf("Bounding box: %.6f,%.6f,%.6f,%.6f", minLat, minLon, maxLat, maxLon)
-
-	// Get zoom levels based on detail level
-	zoomLevels := m.GetZoomLevelsForDetail()
-	log.Printf("Detail level %d maps to zoom levels %v", m.detailLevel, zoomLevels)
-
-	folderName := fmt.Sprintf("point_%.4f_%.4f_r%.1f_d%d",
-		m.centerPoint.Lat, m.centerPoint.Long, m.radiusKm, m.detailLevel)
-
-	// Create a dedicated output directory for this point
-	pointOutputDir := filepath.Join(m.outputDirectory, folderName)
-	if err := os.MkdirAll(pointOutputDir, 0755); err != nil {
-		log.Printf("Error creating output directory for point: %v", err)
-		return false
-	}
-
-	// Save the bounds to a metadata file
-	metadataPath := filepath.Join(pointOutputDir, "metadata.txt")
-	metadataContent := fmt.Sprintf("Center: %.6f, %.6f\nRadius: %.2f km\nDetail Level: %d\nZoom Levels: %v\nBounding Box: %.6f,%.6f,%.6f,%.6f\nTimestamp: %s\n",
-		m.centerPoint.Lat, m.centerPoint.Long, m.radiusKm, m.detailLevel,
-		zoomLevels, minLat, minLon, maxLat, maxLon, time.Now().Format(time.RFC3339))
-
-	if err := os.WriteFile(metadataPath, []byte(metadataContent), 0644); err != nil {
-		log.Printf("Error writing metadata: %v", err)
+	// Validate config
+	if replayFile == "" && !app.ValidateConfig(ctx) {
+		fatal("Configuration is not valid")
 	}
 
-	// Store original output directory
-	originalOutputDir := m.outputDirectory
-	// Set output directory to the point-specific directory
-	m.outputDirectory = pointOutputDir
-
-	if err := m.ObtainTiles(regions, zoomLevels); err != nil {
-		if err.Error() == "download cancelled by user" {
-			log.Println("Download cancelled by user")
-			// Restore original output directory
-			m.outputDirectory = originalOutputDir
-			return true // User cancellation is not an error
+	// Only write the plan, which needs no API key
+	if planFile != "" {
+		if err := app.WritePlan(planFile); err != nil {
+			fatal("Failed to plan", "error", err)
 		}
-		log.Printf("Error obtaining tiles: %v", err)
-		// Restore original output directory
-		m.outputDirectory = originalOutputDir
-		return false
-	}
-
-	// Restore original output directory
-	m.outputDirectory = originalOutputDir
-
-	elapsedTime := time.Since(startTime)
-	log.Printf("Total download time: %s", elapsedTime.Round(time.Second))
-
-	return true
-}
-
-// Run executes the tile download process for all configured zones
-func (m *MeshtasticTileDownloader) Run() bool {
-	if !m.IsValidProvider() {
-		log.Printf("Unknown provider '%s'", m.TileProvider())
-		return false
+		return
 	}
 
-	// If in point-radius mode, use that instead of the configuration file
-	if m.isPointRadius {
-		return m.RunPointRadius()
-	}
-
-	startTime := time.Now()
-
-	for zoneName, zone := range m.config.Zones {
-		// Create zoom level range
-		zoomLevels := make([]int, 0, zone.Zoom.In-zone.Zoom.Out+1)
-		for i := zone.Zoom.Out; i <= zone.Zoom.In; i++ {
-			zoomLevels = append(zoomLevels, i)
+	// Get API keys from environment for every provider in use
+	for _, provider := range app.ProvidersInUse() {
+		providerEnvVar := downloader.APIKeyEnvVar(provider)
+		apiKey := os.Getenv(providerEnvVar)
+		if apiKey == "" {
+			apiKey = os.Getenv("API_KEY")
 		}
 
-		log.Printf("Obtaining zone [%s] [zoom: %d → %d] regions: %v",
-			zoneName, zone.Zoom.Out, zone.Zoom.In, zone.Regions)
-
-		if err := m.ObtainTiles(zone.Regions, zoomLevels); err != nil {
-			if err.Error() == "download cancelled by user" {
-				log.Printf("Download cancelled by user for zone %s", zoneName)
-				return true // User cancellation is not an error
-			}
-			log.Printf("Error obtaining tiles for zone %s: %v", zoneName, err)
-			return false
+		// Check if API key is required and present
+		if apiKey == "" && app.ProviderRequiresAPIKey(provider) {
+			fatal("Neither API_KEY env var or PROVIDER_API_KEY found. If your provider doesn't need an API Key, set the env var with any content",
+				"provider", provider, "env_var", providerEnvVar)
 		}
-
-		log.Printf("Finished with zone %s", zoneName)
-	}
-
-	elapsedTime := time.Since(startTime)
-	log.Printf("Total download time: %s", elapsedTime.Round(time.Second))
-
-	// List all processed zones
-	zoneNames := make([]string, 0, len(m.config.Zones))
-	for zoneName := range m.config.Zones {
-		zoneNames = append(zoneNames, zoneName)
+		app.SetAPIKey(provider, apiKey)
 	}
-	log.Printf("Finished processing zones: %s", strings.Join(zoneNames, ", "))
-
-	return true
-}
 
-func main() {
-	// Parse command-line arguments for point-radius mode
-	var lat, long, radius float64
-	var detailLevel int
-	var usePointMode bool
-
-	flag.Float64Var(&lat, "lat", 0, "Center latitude for point-radius mode")
-	flag.Float64Var(&long, "long", 0, "Center longitude for point-radius mode")
-	flag.Float64Var(&radius, "radius", 0, "Radius in kilometers for point-radius mode")
-	flag.IntVar(&detailLevel, "detail", 2, "Detail level (1-4) for point-radius mode")
-	flag.BoolVar(&usePointMode, "point", false, "Enable point-radius mode")
-	flag.Parse()
-
-	// Configure logging
-	if os.Getenv("DEBUG") == "true" {
-		log.Println("Log level is set to DEBUG")
-	} else {
-		log.Println("Running in normal mode")
-	}
-
-	// Get output directory
-	outputDir := os.Getenv("DOWNLOAD_DIRECTORY")
-	if outputDir == "" {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			log.Fatalf("Could not determine home directory: %v", err)
-		}
-		outputDir = filepath.Join(homeDir, "Desktop", "maps")
+	// Run app
+	summary, err := app.Run(ctx)
+	slog.Info("Download summary", "downloaded", summary.Downloaded, "skipped", summary.Skipped,
+		"failed", summary.Failed, "built", summary.Built)
+	if summary.Interrupted {
+		slog.Warn("Stopped with tiles left. Run again to continue: stored tiles are skipped",
+			"duration", summary.Duration.Round(time.Second), "remaining", summary.Remaining)
 	}
 
-	// Create output directory
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		log.Fatalf("Destination '%s' can't be created: %v", outputDir, err)
+	// Write the run report, for automation to check the tiles are complete
+	if reportFile == "" {
+		reportFile = filepath.Join(outputDir, "report.json")
 	}
-	log.Printf("Store destination set at: %s", outputDir)
-
-	// Create app
-	app := NewMeshtasticTileDownloader(outputDir)
-
-	// Check if we're using point-radius mode
-	if usePointMode {
-		if lat == 0 && long == 0 {
-			log.Fatal("Error: When using point mode, you must specify lat and long parameters")
-		}
-
-		if radius <= 0 {
-			log.Fatal("Error: Radius must be greater than 0")
-		}
-
-		if detailLevel < 1 || detailLevel > 4 {
-			log.Printf("Warning: Detail level %d is out of range (1-4), using default level 2", detailLevel)
-			detailLevel = 2
-		}
-
-		// Set point-radius mode parameters
-		app.isPointRadius = true
-		app.centerPoint = Point{Lat: lat, Long: long}
-		app.radiusKm = radius
-		app.detailLevel = detailLevel
-
-		// Still need to load config for map provider settings
-		if err := app.LoadConfig("config.yaml"); err != nil {
-			log.Printf("Warning: Failed to load configuration: %v. Using defaults.", err)
-			// Set some sensible defaults
-			app.config.Map.Provider = "thunderforest"
-			app.config.Map.Style = "atlas"
-			app.config.Map.Reduce = 12
-		}
+	if reportErr := app.WriteReport(reportFile); reportErr != nil {
+		slog.Error("Error writing the run report", "error", reportErr)
 	} else {
-		// Regular mode - load config
-		if err := app.LoadConfig("config.yaml"); err != nil {
-			log.Fatalf("Failed to load configuration: %v", err)
-		}
+		slog.Info("Run report written", "file", reportFile)
 	}
 
-	// Validate config
-	if !app.ValidateConfig() {
-		log.Fatal("Configuration is not valid.")
+	// Keep the failed tiles for -retry
+	if failed, failedErr := app.WriteFailedPlan(failedFile); failedErr != nil {
+		slog.Error("Error writing the failed tiles", "error", failedErr)
+	} else if failed != nil {
+		logMissingTiles(failed)
+		slog.Info("Failed tiles written. Run with -retry to obtain only them", "file", failedFile)
 	}
 
-	// Get API key from environment
-	providerEnvVar := strings.ToUpper(app.TileProvider() + "_API_KEY")
-	app.apiKey = os.Getenv(providerEnvVar)
-	if app.apiKey == "" {
-		app.apiKey = os.Getenv("API_KEY")
+	// Stopping on purpose leaves the tiles stored so far, to continue later,
+	// so it isn't an error
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Info("Time budget spent", "duration", timeBudget)
+		slog.Info("Program finished within its time budget")
+		return
 	}
-
-	// Check if API key is required and present
-	if app.apiKey == "" && app.TileProvider() != "cnig.es" {
-		log.Printf("Neither API_KEY env var or PROVIDER_API_KEY (ex: %s) found", providerEnvVar)
-		log.Println("If your provider doesn't need an API Key, set the env var with any content.")
-		os.Exit(1)
+	if errors.Is(err, context.Canceled) {
+		slog.Info("Program stopped on request")
+		return
 	}
-
-	// Run app
-	if !app.Run() {
-		log.Println("Program finished with errors.")
-		os.Exit(1)
+	if err != nil {
+		fatal("Program finished with errors", "error", err)
 	}
 
-	log.Println("Program finished successfully")
+	slog.Info("Program finished successfully")
 }